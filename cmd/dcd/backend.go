@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+
+	dcd "github.com/progsoftware/dcd/internal/dcd"
+)
+
+func backendCommand(args []string) {
+	if len(args) < 1 {
+		fmt.Fprintln(os.Stderr, "Usage: dcd backend <command> [args...]")
+		fmt.Fprintln(os.Stderr, "Commands: init, migrate-build-ids")
+		os.Exit(1)
+	}
+	switch args[0] {
+	case "init":
+		initBackend(args[1:])
+	case "migrate-build-ids":
+		migrateBuildIDs(args[1:])
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown backend command: %s\n", args[0])
+		os.Exit(1)
+	}
+}
+
+func initBackend(args []string) {
+	flags := flag.NewFlagSet("backend init", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: dcd backend init [flags]")
+		fmt.Fprintln(os.Stderr, "Creates the backend, or upgrades one created by an older version of dcd.")
+		flags.PrintDefaults()
+	}
+	config := addConfigFlags(flags)
+	flags.Parse(args)
+	if flags.NArg() != 0 {
+		flags.Usage()
+		os.Exit(1)
+	}
+
+	cfg, err := config.loadConfig()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	changes, err := dcd.InitBackend(context.Background(), &cfg.Backend)
+	for _, change := range changes {
+		fmt.Println(change)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if len(changes) == 0 {
+		fmt.Println("the backend is up to date")
+	}
+}
+
+func migrateBuildIDs(args []string) {
+	flags := flag.NewFlagSet("backend migrate-build-ids", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: dcd backend migrate-build-ids [flags]")
+		fmt.Fprintln(os.Stderr, "Moves builds numbered from the old global build ID counter to per-component sequences.")
+		flags.PrintDefaults()
+	}
+	config := addConfigFlags(flags)
+	flags.Parse(args)
+	if flags.NArg() != 0 {
+		flags.Usage()
+		os.Exit(1)
+	}
+
+	ctx := context.Background()
+	backend, err := config.newBackend(ctx)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	migrator, ok := backend.(dcd.BuildIDMigrator)
+	if !ok {
+		fmt.Fprintln(os.Stderr, "this backend has nothing to migrate")
+		os.Exit(1)
+	}
+	moved, err := migrator.MigrateBuildIDs(ctx)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "migrated %d builds before failing: %v\n", moved, err)
+		os.Exit(1)
+	}
+	fmt.Printf("migrated %d builds\n", moved)
+}
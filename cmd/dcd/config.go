@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+
+	dcd "github.com/progsoftware/dcd/internal/dcd"
+)
+
+// configFlags are the command line flags that override the configuration file
+// and environment.
+type configFlags struct {
+	configPath string
+	backend    dcd.BackendConfig
+	outboxPath string
+}
+
+func addConfigFlags(flags *flag.FlagSet) *configFlags {
+	f := &configFlags{}
+	flags.StringVar(&f.configPath, "config", "", "path to the configuration file (default .dcd.yaml in the repo root)")
+	flags.StringVar(&f.backend.Type, "backend", "", "backend storing the build history: dynamodb or file (env DCD_BACKEND)")
+	flags.StringVar(&f.backend.DynamoDB.Table, "dynamodb-table", "", "DynamoDB table name (env DCD_DYNAMODB_TABLE)")
+	flags.StringVar(&f.backend.DynamoDB.Region, "dynamodb-region", "", "AWS region of the DynamoDB table (env DCD_DYNAMODB_REGION)")
+	flags.StringVar(&f.backend.DynamoDB.Endpoint, "dynamodb-endpoint", "", "DynamoDB endpoint override, e.g. for dynamodb-local (env DCD_DYNAMODB_ENDPOINT)")
+	flags.StringVar(&f.backend.File.Path, "history-path", "", "directory for the file backend (env DCD_HISTORY_PATH, default dcd/history in the .git directory)")
+	flags.StringVar(&f.backend.Archive.Bucket, "archive-bucket", "", "S3 bucket to archive step output in (env DCD_ARCHIVE_BUCKET)")
+	flags.StringVar(&f.backend.Archive.Endpoint, "archive-endpoint", "", "S3 endpoint override, e.g. for MinIO (env DCD_ARCHIVE_ENDPOINT)")
+	flags.StringVar(&f.outboxPath, "outbox-path", "", "directory builds are recorded in while the backend is unreachable (env DCD_OUTBOX_PATH, default dcd/outbox in the .git directory)")
+	return f
+}
+
+// loadConfig reads the configuration file, then applies environment and flag overrides.
+func (f *configFlags) loadConfig() (*dcd.Config, error) {
+	path := f.configPath
+	if path == "" {
+		path = dcd.DefaultConfigPath()
+	} else if _, err := os.Stat(path); err != nil {
+		return nil, fmt.Errorf("failed to read config: %w", err)
+	}
+	cfg, err := dcd.LoadConfig(path)
+	if err != nil {
+		return nil, err
+	}
+	cfg.ApplyEnv()
+	override(&cfg.Backend.Type, f.backend.Type)
+	override(&cfg.Backend.DynamoDB.Table, f.backend.DynamoDB.Table)
+	override(&cfg.Backend.DynamoDB.Region, f.backend.DynamoDB.Region)
+	override(&cfg.Backend.DynamoDB.Endpoint, f.backend.DynamoDB.Endpoint)
+	override(&cfg.Backend.File.Path, f.backend.File.Path)
+	override(&cfg.Backend.Archive.Bucket, f.backend.Archive.Bucket)
+	override(&cfg.Backend.Archive.Endpoint, f.backend.Archive.Endpoint)
+	override(&cfg.Outbox.Path, f.outboxPath)
+	return cfg, nil
+}
+
+// newBackend creates the configured backend, checking that it is reachable.
+// An unreachable backend is returned along with a *dcd.BackendUnreachableError.
+func (f *configFlags) newBackend(ctx context.Context) (dcd.Backend, error) {
+	cfg, err := f.loadConfig()
+	if err != nil {
+		return nil, err
+	}
+	return dcd.NewBackend(ctx, &cfg.Backend)
+}
+
+// newArchive returns the configured archive, or nil if there is none.
+func (f *configFlags) newArchive(ctx context.Context) (dcd.LogArchive, error) {
+	cfg, err := f.loadConfig()
+	if err != nil {
+		return nil, err
+	}
+	return cfg.Backend.Archive.NewArchive(ctx)
+}
+
+// newOutbox returns the configured outbox, or nil if it is disabled.
+func (f *configFlags) newOutbox() (*dcd.Outbox, error) {
+	cfg, err := f.loadConfig()
+	if err != nil {
+		return nil, err
+	}
+	return cfg.Outbox.NewOutbox(), nil
+}
+
+func override(field *string, value string) {
+	if value != "" {
+		*field = value
+	}
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	dcd "github.com/progsoftware/dcd/internal/dcd"
+)
+
+// historyEntry is a build as output by dcd history --json.
+type historyEntry struct {
+	BuildID   int64      `json:"buildId"`
+	Component string     `json:"component"`
+	GitSHA    string     `json:"gitSha"`
+	Status    string     `json:"status"`
+	StartTime time.Time  `json:"startTime"`
+	EndTime   *time.Time `json:"endTime,omitempty"`
+	Duration  *float64   `json:"durationSeconds,omitempty"`
+	User      string     `json:"user"`
+	EnvHash   string     `json:"envHash,omitempty"`
+	EnvNames  []string   `json:"envNames,omitempty"`
+	// RetriedSteps are the steps that only succeeded when they were retried.
+	RetriedSteps []string `json:"retriedSteps,omitempty"`
+	// SkippedSteps are the steps that did not run because of their when
+	// expression.
+	SkippedSteps []string `json:"skippedSteps,omitempty"`
+	// PendingSync is set for builds recorded in the outbox while the backend
+	// was unreachable, which have a provisional build ID if Provisional is set.
+	PendingSync bool `json:"pendingSync,omitempty"`
+	Provisional bool `json:"provisional,omitempty"`
+}
+
+func history(args []string) {
+	flags := flag.NewFlagSet("history", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: dcd history [flags]")
+		flags.PrintDefaults()
+	}
+	config := addConfigFlags(flags)
+	component := flags.String("component", "", "component to list builds for (default from the git remote)")
+	status := flags.String("status", "", "only list builds with this status")
+	sha := flags.String("sha", "", "only list builds whose git SHA starts with this")
+	since := flags.String("since", "", "only list builds started since this date, time or duration ago (e.g. 2024-01-02, 2024-01-02T15:04:05Z or 48h)")
+	until := flags.String("until", "", "only list builds started before this date, time or duration ago")
+	limit := flags.Int("limit", dcd.DefaultBuildPageSize, "maximum number of builds to list")
+	jsonOutput := flags.Bool("json", false, "output as JSON")
+	flags.Parse(args)
+	if flags.NArg() != 0 {
+		flags.Usage()
+		os.Exit(1)
+	}
+
+	ctx := context.Background()
+	backend, err := config.newBackend(ctx)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	query := &dcd.BuildQuery{
+		Component: *component,
+		Status:    *status,
+		GitSHA:    *sha,
+		Limit:     *limit,
+	}
+	if query.Component == "" {
+		metadata, err := dcd.ReadMetadata()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		query.Component = metadata.Component
+	}
+	if query.StartedAfter, err = parseTimeFlag("since", *since); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if query.StartedBefore, err = parseTimeFlag("until", *until); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	page, err := backend.ListBuilds(ctx, query)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	entries, err := pendingSyncEntries(ctx, config, query)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	spooled := map[int64]bool{}
+	for _, entry := range entries {
+		if !entry.Provisional {
+			spooled[entry.BuildID] = true
+		}
+	}
+	for _, build := range page.Builds {
+		// The outbox has the latest state of a build it holds.
+		if !spooled[build.BuildID] {
+			entries = append(entries, newHistoryEntry(build))
+		}
+	}
+
+	if *jsonOutput {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(entries); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+	writer := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(writer, "BUILD\tGIT SHA\tSTATUS\tSTARTED\tDURATION\tENV\tUSER")
+	for _, entry := range entries {
+		duration := "-"
+		if entry.Duration != nil {
+			duration = entry.EndTime.Sub(entry.StartTime).Round(time.Second).String()
+		}
+		buildID := strconv.FormatInt(entry.BuildID, 10)
+		if entry.Provisional {
+			buildID = dcd.ProvisionalBuildIDString(entry.BuildID)
+		}
+		status := entry.Status
+		if len(entry.RetriedSteps) > 0 {
+			status += fmt.Sprintf(" (retried %s)", strings.Join(entry.RetriedSteps, ", "))
+		}
+		if entry.PendingSync {
+			status += " (pending sync)"
+		}
+		fmt.Fprintf(writer, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			buildID,
+			shortSHA(entry.GitSHA),
+			status,
+			entry.StartTime.Local().Format("2006-01-02 15:04:05"),
+			duration,
+			shortEnvHash(entry.EnvHash),
+			entry.User,
+		)
+	}
+	writer.Flush()
+}
+
+func newHistoryEntry(build dcd.PipelineState) historyEntry {
+	entry := historyEntry{
+		BuildID:      build.BuildID,
+		Component:    build.Component,
+		GitSHA:       build.GitSHA,
+		Status:       build.Status,
+		StartTime:    build.StartTime,
+		User:         build.User,
+		EnvHash:      build.EnvHash,
+		EnvNames:     build.EnvNames,
+		RetriedSteps: build.RetriedSteps,
+		SkippedSteps: build.SkippedSteps,
+	}
+	if !build.EndTime.IsZero() {
+		endTime := build.EndTime
+		duration := build.EndTime.Sub(build.StartTime).Seconds()
+		entry.EndTime = &endTime
+		entry.Duration = &duration
+	}
+	return entry
+}
+
+// pendingSyncEntries returns the builds matching the query that are waiting
+// in the outbox to be synced.
+func pendingSyncEntries(ctx context.Context, config *configFlags, query *dcd.BuildQuery) ([]historyEntry, error) {
+	entries := []historyEntry{}
+	outbox, err := config.newOutbox()
+	if err != nil || outbox == nil {
+		return entries, err
+	}
+	builds, err := outbox.ListBuilds(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	for _, build := range builds {
+		entry := newHistoryEntry(build.PipelineState)
+		entry.PendingSync = true
+		entry.Provisional = build.Provisional
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+func shortSHA(sha string) string {
+	if len(sha) > 12 {
+		return sha[:12]
+	}
+	return sha
+}
+
+// shortEnvHash abbreviates the hash of a build's environment, which builds
+// recorded before it was added do not have.
+func shortEnvHash(hash string) string {
+	if hash == "" {
+		return "-"
+	}
+	if len(hash) > 8 {
+		return hash[:8]
+	}
+	return hash
+}
+
+// parseTimeFlag parses a date, an RFC 3339 time or a duration before now.
+func parseTimeFlag(name, value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	if t, err := time.ParseInLocation("2006-01-02", value, time.Local); err == nil {
+		return t, nil
+	}
+	if d, err := time.ParseDuration(value); err == nil {
+		return time.Now().Add(-d), nil
+	}
+	return time.Time{}, fmt.Errorf("invalid --%s %q: expected a date (2006-01-02), time (2006-01-02T15:04:05Z07:00) or duration (48h)", name, value)
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	dcd "github.com/progsoftware/dcd/internal/dcd"
+)
+
+const followPollInterval = time.Second
+
+func logs(args []string) {
+	flags := flag.NewFlagSet("logs", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: dcd logs [flags] <build-id>")
+		flags.PrintDefaults()
+	}
+	config := addConfigFlags(flags)
+	component := flags.String("component", "", "component the build belongs to (default from the git remote)")
+	step := flags.String("step", "", "only show the events of this step")
+	timestamps := flags.Bool("timestamps", false, "show the time of each event")
+	follow := flags.Bool("follow", false, "keep showing new events until the build finishes")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(1)
+	}
+	buildID, err := strconv.ParseInt(flags.Arg(0), 10, 64)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid build ID %q\n", flags.Arg(0))
+		os.Exit(1)
+	}
+
+	ctx := context.Background()
+	backend, err := config.newBackend(ctx)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	archive, err := config.newArchive(ctx)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if archive != nil {
+		backend = dcd.NewArchivedLogBackend(backend, archive)
+	}
+	if *component == "" {
+		metadata, err := dcd.ReadMetadata()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		*component = metadata.Component
+	}
+	if _, err := backend.GetPipeline(ctx, *component, buildID); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	cursor := ""
+	for {
+		page, err := backend.ListPipelineEvents(ctx, *component, buildID, cursor, dcd.DefaultEventPageSize)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		for _, event := range page.Events {
+			if *step == "" || dcd.EventStepName(event) == *step {
+				printEvent(event, *timestamps)
+			}
+			if isPipelineFinished(event) {
+				return
+			}
+		}
+		cursor = page.Cursor
+		if len(page.Events) > 0 {
+			continue
+		}
+		if !*follow {
+			return
+		}
+		// Stop following a build that has finished without a final event,
+		// checking for events written just before the state changed first.
+		state, err := backend.GetPipeline(ctx, *component, buildID)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		if state.Status != dcd.StatusPending && state.Status != dcd.StatusRunning {
+			*follow = false
+			continue
+		}
+		time.Sleep(followPollInterval)
+	}
+}
+
+// printEvent prints an event as it is shown while the pipeline runs.
+func printEvent(event dcd.Event, timestamp bool) {
+	if timestamp {
+		fmt.Printf("%s %s\n", event.Timestamp().Local().Format("2006-01-02 15:04:05.000"), event.LogMessage())
+		return
+	}
+	fmt.Println(event.LogMessage())
+}
+
+func isPipelineFinished(event dcd.Event) bool {
+	switch event.(type) {
+	case dcd.PipelineSuccessEvent, dcd.PipelineFailureEvent, dcd.PipelineCancelledEvent, dcd.PipelineAbandonedEvent:
+		return true
+	}
+	return false
+}
@@ -1,12 +1,22 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"flag"
 	"fmt"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 
 	dcd "github.com/progsoftware/dcd/internal/dcd"
 )
 
+// exitCodeCancelled is the exit code of dcd run when the pipeline is
+// cancelled, as for a process stopped by SIGINT.
+const exitCodeCancelled = 130
+
 func main() {
 	if len(os.Args) == 2 && os.Args[1] == "image-usage-message" {
 		fmt.Println("This image should be used as a base image, not run directly - see README.md for more information.")
@@ -14,45 +24,115 @@ func main() {
 	}
 	if len(os.Args) < 2 {
 		fmt.Fprintln(os.Stderr, "Usage: dcd <command> [args...]")
-		os.Exit(1)
-	}
-	pipeline := dcd.NewPipeline()
-	if err := pipeline.LoadMetadata(); err != nil {
-		fmt.Fprintln(os.Stderr, err)
+		fmt.Fprintln(os.Stderr, "Commands: run, history, logs, sync, reap, prune, backend")
 		os.Exit(1)
 	}
 	command := os.Args[1]
 	switch command {
 	case "run":
-		runPipeline(pipeline, os.Args[2:])
+		runPipeline(os.Args[2:])
+	case "history":
+		history(os.Args[2:])
+	case "logs":
+		logs(os.Args[2:])
+	case "sync":
+		syncOutbox(os.Args[2:])
+	case "reap":
+		reap(os.Args[2:])
+	case "prune":
+		prune(os.Args[2:])
+	case "backend":
+		backendCommand(os.Args[2:])
 	default:
 		fmt.Fprintf(os.Stderr, "Unknown command: %s\n", command)
 		os.Exit(1)
 	}
 }
 
-func runPipeline(pipeline *dcd.Pipeline, args []string) {
-	if len(args) != 1 {
-		fmt.Fprintln(os.Stderr, "Usage: dcd run <pipeline-file>")
+func runPipeline(args []string) {
+	flags := flag.NewFlagSet("run", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: dcd run [flags] <pipeline-file>")
+		flags.PrintDefaults()
+	}
+	config := addConfigFlags(flags)
+	params := map[string]string{}
+	flags.Func("param", "parameter of the pipeline for when expressions, as name=value (can be repeated)", func(value string) error {
+		name, value, ok := strings.Cut(value, "=")
+		if !ok || name == "" {
+			return fmt.Errorf("expected name=value")
+		}
+		params[name] = value
+		return nil
+	})
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(1)
+	}
+	filename := flags.Arg(0)
+	// The backend is checked first so that bad configuration fails fast.
+	cfg, err := config.loadConfig()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	outbox := cfg.Outbox.NewOutbox()
+	backend, err := dcd.NewBackend(context.Background(), &cfg.Backend)
+	var unreachable *dcd.BackendUnreachableError
+	if errors.As(err, &unreachable) && outbox != nil {
+		fmt.Fprintf(os.Stderr, "Warning: %v\nThe build will be recorded in %s, run dcd sync to upload it later.\n", err, outbox.Dir())
+	} else if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	archive, err := cfg.Backend.Archive.NewArchive(context.Background())
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	pipeline := dcd.NewPipeline()
+	pipeline.SetBackend(backend)
+	pipeline.SetOutbox(outbox)
+	pipeline.SetArchive(archive)
+	pipeline.SetParameters(params)
+	if err := pipeline.LoadMetadata(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
 		os.Exit(1)
 	}
-	filename := args[0]
 	if err := pipeline.LoadPipelineDefinition(filename); err != nil {
 		fmt.Fprintln(os.Stderr, err)
 		os.Exit(1)
 	}
+	// The first Ctrl-C cancels the pipeline, which still records the build
+	// before dcd exits. A second kills the running steps and exits straight
+	// away.
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		fmt.Fprintf(os.Stderr, "Received %s, cancelling the pipeline (press Ctrl-C again to exit straight away)\n", sig)
+		pipeline.Cancel(fmt.Sprintf("received %s", sig))
+		<-signals
+		pipeline.Kill()
+		os.Exit(exitCodeCancelled)
+	}()
 	eventsChan, err := pipeline.Run()
 	if err != nil {
 		fmt.Fprintln(os.Stderr, err)
 		os.Exit(1)
 	}
+	// The channel is closed once the build history has been written, so keep
+	// reading after the final event rather than exiting straight away.
+	exitCode := 1
 	for event := range eventsChan {
-		fmt.Println(event.LogMessage())
-		if _, ok := event.(dcd.PipelineSuccessEvent); ok {
-			os.Exit(0)
-		}
-		if _, ok := event.(dcd.PipelineFailureEvent); ok {
-			os.Exit(1)
+		printEvent(event, false)
+		switch event.(type) {
+		case dcd.PipelineSuccessEvent:
+			exitCode = 0
+		case dcd.PipelineCancelledEvent:
+			exitCode = exitCodeCancelled
 		}
 	}
+	os.Exit(exitCode)
 }
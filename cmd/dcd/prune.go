@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	dcd "github.com/progsoftware/dcd/internal/dcd"
+)
+
+func prune(args []string) {
+	flags := flag.NewFlagSet("prune", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: dcd prune [flags]")
+		fmt.Fprintln(os.Stderr, "Deletes the step output of builds older than the retention period, keeping their status and step results.")
+		flags.PrintDefaults()
+	}
+	config := addConfigFlags(flags)
+	component := flags.String("component", "", "component to prune (default from the git remote)")
+	olderThan := flags.Duration("older-than", 0, "prune builds started longer ago than this (default from backend.retention)")
+	flags.Parse(args)
+	if flags.NArg() != 0 {
+		flags.Usage()
+		os.Exit(1)
+	}
+
+	cfg, err := config.loadConfig()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if *component == "" {
+		metadata, err := dcd.ReadMetadata()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		*component = metadata.Component
+	}
+	retention := *olderThan
+	if retention == 0 {
+		retention = cfg.Backend.Retention.OutputRetention(*component)
+	}
+	if retention <= 0 {
+		fmt.Printf("the output of %s is kept forever, set backend.retention.output-days or --older-than to prune it\n", *component)
+		return
+	}
+
+	ctx := context.Background()
+	backend, err := dcd.NewBackend(ctx, &cfg.Backend)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	pruner, ok := backend.(dcd.OutputPruner)
+	if !ok {
+		fmt.Fprintln(os.Stderr, "this backend cannot prune output")
+		os.Exit(1)
+	}
+	before := time.Now().Add(-retention)
+	deleted, err := pruner.PruneOutput(ctx, *component, before, cfg.Backend.Retention.KeepDeployments)
+	fmt.Printf("deleted %d output events of %s builds started before %s\n", deleted, *component, before.Local().Format(time.DateTime))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
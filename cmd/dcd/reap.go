@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	dcd "github.com/progsoftware/dcd/internal/dcd"
+)
+
+func reap(args []string) {
+	flags := flag.NewFlagSet("reap", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: dcd reap [flags]")
+		fmt.Fprintln(os.Stderr, "Marks builds that have stopped sending heartbeats as abandoned.")
+		flags.PrintDefaults()
+	}
+	config := addConfigFlags(flags)
+	component := flags.String("component", "", "component to check (default from the git remote)")
+	timeout := flags.Duration("timeout", dcd.DefaultAbandonTimeout, "how long a build can go without a heartbeat")
+	flags.Parse(args)
+	if flags.NArg() != 0 {
+		flags.Usage()
+		os.Exit(1)
+	}
+	if *timeout < 2*dcd.HeartbeatInterval {
+		fmt.Fprintf(os.Stderr, "the timeout must be at least %s\n", 2*dcd.HeartbeatInterval)
+		os.Exit(1)
+	}
+
+	ctx := context.Background()
+	backend, err := config.newBackend(ctx)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if *component == "" {
+		metadata, err := dcd.ReadMetadata()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		*component = metadata.Component
+	}
+	abandoned, err := dcd.MarkAbandonedBuilds(ctx, backend, *component, *timeout)
+	for _, build := range abandoned {
+		fmt.Printf("marked build %d of %s abandoned (last heartbeat %s)\n", build.BuildID, build.Component, build.EndTime.Local().Format(time.DateTime))
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if len(abandoned) == 0 {
+		fmt.Println("no abandoned builds")
+	}
+}
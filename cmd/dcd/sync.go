@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+
+	dcd "github.com/progsoftware/dcd/internal/dcd"
+)
+
+func syncOutbox(args []string) {
+	flags := flag.NewFlagSet("sync", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: dcd sync [flags]")
+		fmt.Fprintln(os.Stderr, "Uploads builds recorded locally while the backend was unreachable.")
+		flags.PrintDefaults()
+	}
+	config := addConfigFlags(flags)
+	all := flags.Bool("all", false, "also upload builds that have not finished, e.g. because dcd was killed")
+	flags.Parse(args)
+	if flags.NArg() != 0 {
+		flags.Usage()
+		os.Exit(1)
+	}
+
+	outbox, err := config.newOutbox()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if outbox == nil {
+		fmt.Fprintln(os.Stderr, "the outbox is disabled")
+		os.Exit(1)
+	}
+	ctx := context.Background()
+	backend, err := config.newBackend(ctx)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	synced, err := outbox.Sync(ctx, backend, *all)
+	for _, build := range synced {
+		if build.ProvisionalID != 0 {
+			fmt.Printf("synced build %s of %s as build %d (%d events)\n", dcd.ProvisionalBuildIDString(build.ProvisionalID), build.Component, build.BuildID, build.Events)
+		} else {
+			fmt.Printf("synced build %d of %s (%d events)\n", build.BuildID, build.Component, build.Events)
+		}
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if len(synced) == 0 {
+		fmt.Println("nothing to sync")
+	}
+}
@@ -0,0 +1,72 @@
+package dcd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+const (
+	// HeartbeatInterval is how often a running build records that it is
+	// still running.
+	HeartbeatInterval = 30 * time.Second
+	// DefaultAbandonTimeout is how long a build can go without a heartbeat
+	// before it is considered abandoned.
+	DefaultAbandonTimeout = 5 * time.Minute
+)
+
+// MarkAbandonedBuilds marks the pending and running builds of a component
+// that have not had a heartbeat for the timeout as abandoned, and returns
+// them. The end time of an abandoned build is its last heartbeat.
+func MarkAbandonedBuilds(ctx context.Context, backend Backend, component string, timeout time.Duration) ([]PipelineState, error) {
+	now := time.Now()
+	var abandoned []PipelineState
+	for _, status := range []string{StatusPending, StatusRunning} {
+		query := &BuildQuery{
+			Component:  component,
+			Status:     status,
+			SeenBefore: now.Add(-timeout),
+		}
+		for {
+			page, err := backend.ListBuilds(ctx, query)
+			if err != nil {
+				return abandoned, err
+			}
+			for _, state := range page.Builds {
+				err := markAbandoned(ctx, backend, &state, now)
+				// The build changed after it was listed, so it is not abandoned.
+				var conflict *StateConflictError
+				if errors.As(err, &conflict) {
+					continue
+				}
+				if err != nil {
+					return abandoned, err
+				}
+				abandoned = append(abandoned, state)
+			}
+			if page.NextPageToken == "" {
+				break
+			}
+			query.PageToken = page.NextPageToken
+		}
+	}
+	return abandoned, nil
+}
+
+func markAbandoned(ctx context.Context, backend Backend, state *PipelineState, now time.Time) error {
+	lastSeen := state.LastSeen()
+	state.Status = StatusAbandoned
+	state.EndTime = lastSeen
+	if err := backend.PutPipeline(ctx, state); err != nil {
+		return fmt.Errorf("failed to mark build %d of %s abandoned: %w", state.BuildID, state.Component, err)
+	}
+	event := PipelineAbandonedEvent{
+		BaseEvent: BaseEvent{EventTime: now},
+		Reason:    fmt.Sprintf("no heartbeat since %s", lastSeen.UTC().Format(time.RFC3339)),
+	}
+	if err := backend.PutPipelineEvent(ctx, state.Component, state.BuildID, event); err != nil {
+		return fmt.Errorf("failed to record build %d of %s as abandoned: %w", state.BuildID, state.Component, err)
+	}
+	return nil
+}
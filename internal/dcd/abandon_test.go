@@ -0,0 +1,75 @@
+package dcd_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/progsoftware/dcd/internal/dcd"
+)
+
+func TestMarkAbandonedBuilds(t *testing.T) {
+	// Given
+	ctx := context.Background()
+	backend := dcd.NewMemoryBackend()
+	now := time.Now()
+	lastSeen := now.Add(-10 * time.Minute)
+	for _, build := range []struct {
+		status    string
+		heartbeat time.Time
+	}{
+		{dcd.StatusRunning, lastSeen},
+		{dcd.StatusRunning, now},
+		{dcd.StatusPending, time.Time{}},
+		{dcd.StatusFailed, lastSeen},
+	} {
+		buildID, err := backend.GetBuildID(ctx, "test-component")
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		state := &dcd.PipelineState{
+			BuildID:   buildID,
+			Component: "test-component",
+			Status:    build.status,
+			StartTime: now.Add(-time.Hour),
+			Heartbeat: build.heartbeat,
+		}
+		if err := backend.StartPipeline(ctx, state); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+
+	// When
+	abandoned, err := dcd.MarkAbandonedBuilds(ctx, backend, "test-component", dcd.DefaultAbandonTimeout)
+
+	// Then
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(abandoned) != 2 || abandoned[0].BuildID != 3 || abandoned[1].BuildID != 1 {
+		t.Fatalf("Expected builds 3 and 1 to be abandoned, got %+v", abandoned)
+	}
+	for buildID, expected := range map[int64]string{1: dcd.StatusAbandoned, 2: dcd.StatusRunning, 3: dcd.StatusAbandoned, 4: dcd.StatusFailed} {
+		state, err := backend.GetPipeline(ctx, "test-component", buildID)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if state.Status != expected {
+			t.Errorf("Expected build %d to be %s, got %s", buildID, expected, state.Status)
+		}
+	}
+	state, _ := backend.GetPipeline(ctx, "test-component", 1)
+	if !state.EndTime.Equal(lastSeen) {
+		t.Errorf("Expected the build to end at its last heartbeat %v, got %v", lastSeen, state.EndTime)
+	}
+	page, err := backend.ListPipelineEvents(ctx, "test-component", 1, "", 0)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(page.Events) != 1 {
+		t.Fatalf("Expected 1 event, got %d", len(page.Events))
+	}
+	if _, ok := page.Events[0].(dcd.PipelineAbandonedEvent); !ok {
+		t.Errorf("Expected a PipelineAbandonedEvent, got %#v", page.Events[0])
+	}
+}
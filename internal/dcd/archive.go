@@ -0,0 +1,167 @@
+package dcd
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// archiveTailSize is how much of the end of an archived log is kept in the
+// backend. Output no longer than this is not archived.
+const archiveTailSize = 4 * 1024
+
+// LogArchive stores the output of steps outside the backend, e.g. in S3.
+type LogArchive interface {
+	// PutLog stores a compressed log under key and returns its location.
+	PutLog(ctx context.Context, key string, data []byte) (string, error)
+	// GetLog returns the compressed log stored at a location returned by PutLog.
+	GetLog(ctx context.Context, location string) ([]byte, error)
+}
+
+// stepLog is the output of a step, compressed into a temporary file as it is
+// written so that it is not held in memory until the step finishes.
+type stepLog struct {
+	start time.Time
+	file  *os.File
+	gzip  *gzip.Writer
+	size  int
+	tail  []byte // the end of the output, as much as logTail needs
+}
+
+func newStepLog(start time.Time) (*stepLog, error) {
+	file, err := os.CreateTemp("", "dcd-output-*.log.gz")
+	if err != nil {
+		return nil, err
+	}
+	return &stepLog{start: start, file: file, gzip: gzip.NewWriter(file)}, nil
+}
+
+func (l *stepLog) write(output string) error {
+	l.size += len(output)
+	l.tail = append(l.tail, output...)
+	if len(l.tail) > archiveTailSize+1 {
+		l.tail = append(l.tail[:0], l.tail[len(l.tail)-archiveTailSize-1:]...)
+	}
+	_, err := l.gzip.Write([]byte(output))
+	return err
+}
+
+// compressed returns the whole log, compressed.
+func (l *stepLog) compressed() ([]byte, error) {
+	if err := l.gzip.Close(); err != nil {
+		return nil, err
+	}
+	return os.ReadFile(l.file.Name())
+}
+
+func (l *stepLog) remove() {
+	l.file.Close()
+	os.Remove(l.file.Name())
+}
+
+// archiveKey is where the output of a step is archived, which is unique as a
+// step cannot start twice at the same time.
+func archiveKey(component string, buildID int64, step string, start time.Time) string {
+	return fmt.Sprintf("%s/%d/%s-%d.log.gz", url.PathEscape(component), buildID, url.PathEscape(step), start.UnixNano())
+}
+
+func decompressLog(data []byte) (string, error) {
+	reader, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return "", err
+	}
+	defer reader.Close()
+	output, err := io.ReadAll(reader)
+	if err != nil {
+		return "", err
+	}
+	return string(output), nil
+}
+
+// logTail returns the end of the output, starting at a line if possible.
+func logTail(output string) string {
+	if len(output) <= archiveTailSize {
+		return output
+	}
+	tail := output[len(output)-archiveTailSize:]
+	if i := strings.IndexByte(tail, '\n'); i != -1 && i < len(tail)-1 {
+		return tail[i+1:]
+	}
+	for len(tail) > 0 && !utf8.RuneStart(tail[0]) {
+		tail = tail[1:]
+	}
+	return tail
+}
+
+// splitOutput turns the output of a step back into output events no bigger
+// than the writer would have combined them into.
+func splitOutput(step string, eventTime time.Time, output string) []Event {
+	var events []Event
+	for len(output) > 0 {
+		n := len(output)
+		if n > maxCoalescedOutput {
+			n = maxCoalescedOutput
+			for n > 0 && !utf8.RuneStart(output[n]) {
+				n--
+			}
+			if n == 0 {
+				n = maxCoalescedOutput
+			}
+		}
+		events = append(events, StepOutputEvent{BaseEvent{EventTime: eventTime}, step, output[:n]})
+		output = output[n:]
+	}
+	return events
+}
+
+// ArchivedLogBackend is a Backend that lists archived step output as the
+// output events it replaced, fetching it from the archive, so that readers of
+// the history do not need to know about the archive.
+type ArchivedLogBackend struct {
+	Backend
+	archive LogArchive
+}
+
+// NewArchivedLogBackend wraps a backend to fetch archived output from archive.
+func NewArchivedLogBackend(backend Backend, archive LogArchive) *ArchivedLogBackend {
+	return &ArchivedLogBackend{Backend: backend, archive: archive}
+}
+
+// ListPipelineEvents replaces each StepOutputArchivedEvent with the archived
+// output, so a page can have more events than the limit.
+func (b *ArchivedLogBackend) ListPipelineEvents(ctx context.Context, component string, buildID int64, cursor string, limit int) (*EventPage, error) {
+	page, err := b.Backend.ListPipelineEvents(ctx, component, buildID, cursor, limit)
+	if err != nil {
+		return nil, err
+	}
+	events := make([]Event, 0, len(page.Events))
+	for _, event := range page.Events {
+		archived, ok := event.(StepOutputArchivedEvent)
+		if !ok {
+			events = append(events, event)
+			continue
+		}
+		data, err := b.archive.GetLog(ctx, archived.Location)
+		if err != nil {
+			return nil, fmt.Errorf("failed to fetch the output of step %s from %s: %w", archived.StepName, archived.Location, err)
+		}
+		output, err := decompressLog(data)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read the output of step %s from %s: %w", archived.StepName, archived.Location, err)
+		}
+		start := archived.OutputStart
+		// Archived before the start of the output was recorded.
+		if start.IsZero() {
+			start = archived.EventTime
+		}
+		events = append(events, splitOutput(archived.StepName, start, output)...)
+	}
+	return &EventPage{Events: events, Cursor: page.Cursor}, nil
+}
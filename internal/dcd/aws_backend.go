@@ -2,17 +2,86 @@ package dcd
 
 import (
 	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"reflect"
 	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
 )
 
+// The table uses a single-table design keyed on PK (hash) and SK (range):
+//
+//	PK="BUILD_ID#<component>"      SK="COUNTER"              the build ID sequence of a component
+//	PK="BUILD#<component>#<id>"    SK="STATE"                the PipelineState of a build
+//	PK="BUILD#<component>#<id>"    SK="EVENT#<time>#<seq>"   the events of a build, ordered by time
+//
+// Build items also carry GSI1PK="COMPONENT#<component>" and GSI1SK="BUILD#<id>"
+// (zero padded), which are the keys of the GSI1 index used to list the builds
+// of a component, newest first.
+//
+// Before build IDs were allocated per component there was a single counter
+// with PK="BUILD_ID" and builds were stored under PK="BUILD#<id>", see
+// MigrateBuildIDs.
+const (
+	buildIDCounterPKPrefix = "BUILD_ID#"
+	buildIDCounterSK       = "COUNTER"
+	buildPKPrefix          = "BUILD#"
+	buildStateSK           = "STATE"
+	eventSKPrefix          = "EVENT#"
+	componentIndex         = "GSI1"
+	batchWriteSize         = 25
+)
+
+// eventTimeLayout is a fixed width layout so that event sort keys order by time.
+const eventTimeLayout = "2006-01-02T15:04:05.000000000Z"
+
+var (
+	_ Backend            = (*AWSBackend)(nil)
+	_ BatchEventWriter   = (*AWSBackend)(nil)
+	_ BuildIDMigrator    = (*AWSBackend)(nil)
+	_ BackendInitializer = (*AWSBackend)(nil)
+	_ OutputPruner       = (*AWSBackend)(nil)
+)
+
 type AWSBackend struct {
 	tableName string
 	dynamodb  *dynamodb.Client
+	retention *RetentionConfig
+
+	mu       sync.Mutex
+	eventSeq int64
+}
+
+// buildItem is the DynamoDB representation of a PipelineState.
+type buildItem struct {
+	PK     string
+	SK     string
+	GSI1PK string
+	GSI1SK string
+	PipelineState
+}
+
+// eventItem is the DynamoDB representation of an Event. Data holds the event
+// in the MarshalEvent wire format, the other attributes are for convenience
+// when querying the table directly. ExpiresAt is when DynamoDB deletes the
+// item with TTL (in Unix seconds), if it has a retention period.
+type eventItem struct {
+	PK        string
+	SK        string
+	Type      string
+	Time      time.Time
+	Message   string
+	Data      string
+	ExpiresAt int64 `dynamodbav:",omitempty"`
 }
 
 func NewAWSBackend(dynamodb *dynamodb.Client, tableName string) *AWSBackend {
@@ -22,9 +91,29 @@ func NewAWSBackend(dynamodb *dynamodb.Client, tableName string) *AWSBackend {
 	}
 }
 
-func (b *AWSBackend) GetBuildID(ctx context.Context) (int64, error) {
+// SetRetention sets the retention policy. Step output written from then on
+// expires with TTL once it is older than the component's retention period,
+// which dcd backend init enables on the table.
+func (b *AWSBackend) SetRetention(retention *RetentionConfig) {
+	b.retention = retention
+}
+
+func buildPK(component string, buildID int64) string {
+	return fmt.Sprintf("%s%s#%d", buildPKPrefix, component, buildID)
+}
+
+func componentPK(component string) string {
+	return "COMPONENT#" + component
+}
+
+func componentBuildSK(buildID int64) string {
+	return fmt.Sprintf("BUILD#%020d", buildID)
+}
+
+func (b *AWSBackend) GetBuildID(ctx context.Context, component string) (int64, error) {
 	key := map[string]types.AttributeValue{
-		"PK": &types.AttributeValueMemberS{Value: "BUILD_ID"},
+		"PK": &types.AttributeValueMemberS{Value: buildIDCounterPKPrefix + component},
+		"SK": &types.AttributeValueMemberS{Value: buildIDCounterSK},
 	}
 
 	update := &dynamodb.UpdateItemInput{
@@ -59,14 +148,543 @@ func (b *AWSBackend) GetBuildID(ctx context.Context) (int64, error) {
 	return id, nil
 }
 
-func (b *AWSBackend) StartPipeline(ctx context.Context, buildID string) error {
-	panic("TODO")
+// StartPipeline records a new build, failing if a build with the same ID already exists.
+func (b *AWSBackend) StartPipeline(ctx context.Context, state *PipelineState) error {
+	started := *state
+	started.Version = 1
+	item, err := b.marshalBuild(&started)
+	if err != nil {
+		return err
+	}
+	_, err = b.dynamodb.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName:           aws.String(b.tableName),
+		Item:                item,
+		ConditionExpression: aws.String("attribute_not_exists(PK)"),
+	})
+	var conditionFailed *types.ConditionalCheckFailedException
+	if errors.As(err, &conditionFailed) {
+		return &BuildExistsError{Component: state.Component, BuildID: state.BuildID}
+	}
+	if err != nil {
+		return err
+	}
+	state.Version = 1
+	return nil
 }
 
+// PutPipeline replaces the state of a build with a conditional write, so that
+// it only succeeds against the current version and a status the build can
+// change from. States written before versions were added have no Version.
 func (b *AWSBackend) PutPipeline(ctx context.Context, state *PipelineState) error {
-	panic("TODO")
+	// The output of a build that deployed is kept once it has finished, which
+	// is done first so that a failure can be retried.
+	if state.Deployed && !validTransition(state.Status, StatusRunning) && b.retention != nil && b.retention.KeepDeployments {
+		if err := b.keepOutput(ctx, state.Component, state.BuildID); err != nil {
+			return fmt.Errorf("failed to keep the output of a deployment: %w", err)
+		}
+	}
+	next := *state
+	next.Version++
+	item, err := b.marshalBuild(&next)
+	if err != nil {
+		return err
+	}
+	values := map[string]types.AttributeValue{
+		":version": &types.AttributeValueMemberN{Value: strconv.FormatInt(state.Version, 10)},
+	}
+	var statuses []string
+	for i, status := range allowedPreviousStatuses(state.Status) {
+		name := fmt.Sprintf(":from%d", i)
+		statuses = append(statuses, name)
+		values[name] = &types.AttributeValueMemberS{Value: status}
+	}
+	condition := "attribute_exists(PK) AND #version = :version"
+	if state.Version == 0 {
+		condition = "attribute_exists(PK) AND (attribute_not_exists(#version) OR #version = :version)"
+	}
+	condition += fmt.Sprintf(" AND #status IN (%s)", strings.Join(statuses, ", "))
+	_, err = b.dynamodb.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName:           aws.String(b.tableName),
+		Item:                item,
+		ConditionExpression: aws.String(condition),
+		ExpressionAttributeNames: map[string]string{
+			"#version": "Version",
+			"#status":  "Status",
+		},
+		ExpressionAttributeValues:           values,
+		ReturnValuesOnConditionCheckFailure: types.ReturnValuesOnConditionCheckFailureAllOld,
+	})
+	var conditionFailed *types.ConditionalCheckFailedException
+	if errors.As(err, &conditionFailed) {
+		if conditionFailed.Item == nil {
+			return &BuildNotFoundError{Component: state.Component, BuildID: state.BuildID}
+		}
+		current, err := unmarshalBuild(conditionFailed.Item)
+		if err != nil {
+			return err
+		}
+		if err := checkStateWrite(current, state); err != nil {
+			return err
+		}
+		return conditionFailed
+	}
+	if err != nil {
+		return err
+	}
+	state.Version = next.Version
+	return nil
+}
+
+// PutPipelineEvent stores an event under its build, ordered by the event time.
+func (b *AWSBackend) PutPipelineEvent(ctx context.Context, component string, buildID int64, event Event) error {
+	item, err := b.marshalEvent(component, buildID, event)
+	if err != nil {
+		return err
+	}
+	_, err = b.dynamodb.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(b.tableName),
+		Item:      item,
+	})
+	return err
+}
+
+// PutPipelineEvents stores events with BatchWriteItem, retrying any the table
+// is too busy to process.
+func (b *AWSBackend) PutPipelineEvents(ctx context.Context, component string, buildID int64, events []Event) error {
+	requests := make([]types.WriteRequest, 0, len(events))
+	for _, event := range events {
+		item, err := b.marshalEvent(component, buildID, event)
+		if err != nil {
+			return err
+		}
+		requests = append(requests, types.WriteRequest{PutRequest: &types.PutRequest{Item: item}})
+	}
+	return b.batchWrite(ctx, requests)
+}
+
+func (b *AWSBackend) marshalEvent(component string, buildID int64, event Event) (map[string]types.AttributeValue, error) {
+	name, err := EventTypeName(event)
+	if err != nil {
+		return nil, err
+	}
+	data, err := MarshalEvent(event)
+	if err != nil {
+		return nil, err
+	}
+	b.mu.Lock()
+	b.eventSeq++
+	seq := b.eventSeq
+	b.mu.Unlock()
+	item := eventItem{
+		PK:      buildPK(component, buildID),
+		SK:      fmt.Sprintf("%s%s#%08d", eventSKPrefix, event.Timestamp().UTC().Format(eventTimeLayout), seq),
+		Type:    name,
+		Time:    event.Timestamp(),
+		Message: event.LogMessage(),
+		Data:    string(data),
+	}
+	if _, ok := event.(StepOutputEvent); ok && b.retention != nil {
+		if retention := b.retention.OutputRetention(component); retention > 0 {
+			item.ExpiresAt = event.Timestamp().Add(retention).Unix()
+		}
+	}
+	marshalled, err := attributevalue.MarshalMap(item)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal event: %w", err)
+	}
+	return marshalled, nil
+}
+
+func (b *AWSBackend) marshalBuild(state *PipelineState) (map[string]types.AttributeValue, error) {
+	item, err := attributevalue.MarshalMap(buildItem{
+		PK:            buildPK(state.Component, state.BuildID),
+		SK:            buildStateSK,
+		GSI1PK:        componentPK(state.Component),
+		GSI1SK:        componentBuildSK(state.BuildID),
+		PipelineState: *state,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal pipeline state: %w", err)
+	}
+	return item, nil
+}
+
+func (b *AWSBackend) GetPipeline(ctx context.Context, component string, buildID int64) (*PipelineState, error) {
+	output, err := b.dynamodb.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(b.tableName),
+		Key: map[string]types.AttributeValue{
+			"PK": &types.AttributeValueMemberS{Value: buildPK(component, buildID)},
+			"SK": &types.AttributeValueMemberS{Value: buildStateSK},
+		},
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if output.Item == nil {
+		return nil, &BuildNotFoundError{Component: component, BuildID: buildID}
+	}
+	return unmarshalBuild(output.Item)
+}
+
+// ListBuilds queries the component index newest first, applying the status
+// and git SHA filters in DynamoDB and the start time filters as the results
+// are read. The page token encodes the last evaluated key.
+func (b *AWSBackend) ListBuilds(ctx context.Context, query *BuildQuery) (*BuildPage, error) {
+	if err := query.validate(); err != nil {
+		return nil, err
+	}
+	startKey, err := decodePageToken(query.PageToken)
+	if err != nil {
+		return nil, err
+	}
+	input := &dynamodb.QueryInput{
+		TableName:              aws.String(b.tableName),
+		IndexName:              aws.String(componentIndex),
+		KeyConditionExpression: aws.String("GSI1PK = :component"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":component": &types.AttributeValueMemberS{Value: componentPK(query.Component)},
+		},
+		ScanIndexForward: aws.Bool(false),
+	}
+	var filters []string
+	if query.Status != "" {
+		filters = append(filters, "#status = :status")
+		input.ExpressionAttributeNames = map[string]string{"#status": "Status"}
+		input.ExpressionAttributeValues[":status"] = &types.AttributeValueMemberS{Value: query.Status}
+	}
+	if query.GitSHA != "" {
+		filters = append(filters, "begins_with(GitSHA, :sha)")
+		input.ExpressionAttributeValues[":sha"] = &types.AttributeValueMemberS{Value: query.GitSHA}
+	}
+	if len(filters) > 0 {
+		input.FilterExpression = aws.String(strings.Join(filters, " AND "))
+	}
+
+	// Filters are applied after the limit, so keep querying until the page is
+	// full, never evaluating more items than could still fit on the page.
+	page := &BuildPage{}
+	for {
+		input.ExclusiveStartKey = startKey
+		input.Limit = aws.Int32(int32(query.limit() - len(page.Builds)))
+		output, err := b.dynamodb.Query(ctx, input)
+		if err != nil {
+			return nil, err
+		}
+		for _, item := range output.Items {
+			state, err := unmarshalBuild(item)
+			if err != nil {
+				return nil, err
+			}
+			if query.matches(state) {
+				page.Builds = append(page.Builds, *state)
+			}
+		}
+		startKey = output.LastEvaluatedKey
+		if startKey == nil || len(page.Builds) == query.limit() {
+			break
+		}
+	}
+	if page.NextPageToken, err = encodePageToken(startKey); err != nil {
+		return nil, err
+	}
+	return page, nil
+}
+
+// ListPipelineEvents queries the events of a build in sort key order, the
+// cursor being the sort key of the last event returned.
+func (b *AWSBackend) ListPipelineEvents(ctx context.Context, component string, buildID int64, cursor string, limit int) (*EventPage, error) {
+	if limit <= 0 {
+		limit = DefaultEventPageSize
+	}
+	if cursor == "" {
+		cursor = eventSKPrefix
+	}
+	page := &EventPage{Cursor: cursor}
+	paginator := dynamodb.NewQueryPaginator(b.dynamodb, &dynamodb.QueryInput{
+		TableName:              aws.String(b.tableName),
+		KeyConditionExpression: aws.String("PK = :pk AND SK > :cursor"),
+		FilterExpression:       aws.String("begins_with(SK, :prefix)"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":pk":     &types.AttributeValueMemberS{Value: buildPK(component, buildID)},
+			":cursor": &types.AttributeValueMemberS{Value: cursor},
+			":prefix": &types.AttributeValueMemberS{Value: eventSKPrefix},
+		},
+		ConsistentRead: aws.Bool(true),
+		Limit:          aws.Int32(int32(limit)),
+	})
+	for paginator.HasMorePages() && len(page.Events) < limit {
+		output, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, item := range output.Items {
+			var stored eventItem
+			if err := attributevalue.UnmarshalMap(item, &stored); err != nil {
+				return nil, fmt.Errorf("failed to unmarshal event: %w", err)
+			}
+			event, err := UnmarshalEvent([]byte(stored.Data))
+			if err != nil {
+				return nil, fmt.Errorf("failed to read event %s of build %d: %w", stored.SK, buildID, err)
+			}
+			page.Events = append(page.Events, event)
+			page.Cursor = stored.SK
+			if len(page.Events) == limit {
+				break
+			}
+		}
+	}
+	return page, nil
+}
+
+// MigrateBuildIDs moves builds stored under PK="BUILD#<id>" to their
+// component and starts each component's sequence after its highest build ID.
+// Items are copied before the originals are deleted, so an interrupted
+// migration can be run again.
+func (b *AWSBackend) MigrateBuildIDs(ctx context.Context) (int, error) {
+	highest := map[string]int64{}
+	var legacy []*buildItem
+	paginator := dynamodb.NewScanPaginator(b.dynamodb, &dynamodb.ScanInput{
+		TableName:        aws.String(b.tableName),
+		FilterExpression: aws.String("SK = :state"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":state": &types.AttributeValueMemberS{Value: buildStateSK},
+		},
+		ConsistentRead: aws.Bool(true),
+	})
+	for paginator.HasMorePages() {
+		output, err := paginator.NextPage(ctx)
+		if err != nil {
+			return 0, err
+		}
+		for _, item := range output.Items {
+			var stored buildItem
+			if err := attributevalue.UnmarshalMap(item, &stored); err != nil {
+				return 0, fmt.Errorf("failed to unmarshal pipeline state: %w", err)
+			}
+			if stored.BuildID > highest[stored.Component] {
+				highest[stored.Component] = stored.BuildID
+			}
+			if stored.PK == fmt.Sprintf("%s%d", buildPKPrefix, stored.BuildID) {
+				legacy = append(legacy, &stored)
+			}
+		}
+	}
+
+	for i, stored := range legacy {
+		if err := b.migrateBuild(ctx, stored); err != nil {
+			return i, err
+		}
+	}
+
+	for component, id := range highest {
+		_, err := b.dynamodb.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+			TableName: aws.String(b.tableName),
+			Key: map[string]types.AttributeValue{
+				"PK": &types.AttributeValueMemberS{Value: buildIDCounterPKPrefix + component},
+				"SK": &types.AttributeValueMemberS{Value: buildIDCounterSK},
+			},
+			UpdateExpression:    aws.String("SET #id = :id"),
+			ConditionExpression: aws.String("attribute_not_exists(#id) OR #id < :id"),
+			ExpressionAttributeNames: map[string]string{
+				"#id": "ID",
+			},
+			ExpressionAttributeValues: map[string]types.AttributeValue{
+				":id": &types.AttributeValueMemberN{Value: strconv.FormatInt(id, 10)},
+			},
+		})
+		var conditionFailed *types.ConditionalCheckFailedException
+		if err != nil && !errors.As(err, &conditionFailed) {
+			return len(legacy), err
+		}
+	}
+	return len(legacy), nil
+}
+
+// migrateBuild copies the state and events of a build stored under its
+// legacy key to its per-component key, then deletes the originals.
+func (b *AWSBackend) migrateBuild(ctx context.Context, stored *buildItem) error {
+	newPK := buildPK(stored.Component, stored.BuildID)
+	existing, err := b.GetPipeline(ctx, stored.Component, stored.BuildID)
+	var notFound *BuildNotFoundError
+	if err != nil && !errors.As(err, &notFound) {
+		return err
+	}
+	// The same build is already there if a previous migration was interrupted.
+	if existing != nil && !reflect.DeepEqual(*existing, stored.PipelineState) {
+		return &BuildExistsError{Component: stored.Component, BuildID: stored.BuildID}
+	}
+
+	var puts, deletes []types.WriteRequest
+	paginator := dynamodb.NewQueryPaginator(b.dynamodb, &dynamodb.QueryInput{
+		TableName:              aws.String(b.tableName),
+		KeyConditionExpression: aws.String("PK = :pk"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":pk": &types.AttributeValueMemberS{Value: stored.PK},
+		},
+		ConsistentRead: aws.Bool(true),
+	})
+	for paginator.HasMorePages() {
+		output, err := paginator.NextPage(ctx)
+		if err != nil {
+			return err
+		}
+		for _, item := range output.Items {
+			copied := make(map[string]types.AttributeValue, len(item))
+			for name, value := range item {
+				copied[name] = value
+			}
+			copied["PK"] = &types.AttributeValueMemberS{Value: newPK}
+			puts = append(puts, types.WriteRequest{PutRequest: &types.PutRequest{Item: copied}})
+			deletes = append(deletes, types.WriteRequest{DeleteRequest: &types.DeleteRequest{
+				Key: map[string]types.AttributeValue{"PK": item["PK"], "SK": item["SK"]},
+			}})
+		}
+	}
+	if err := b.batchWrite(ctx, puts); err != nil {
+		return fmt.Errorf("failed to copy build %d of %s: %w", stored.BuildID, stored.Component, err)
+	}
+	if err := b.batchWrite(ctx, deletes); err != nil {
+		return fmt.Errorf("failed to delete build %d of %s after copying: %w", stored.BuildID, stored.Component, err)
+	}
+	return nil
+}
+
+// PruneOutput deletes the step output of old builds, e.g. output written before
+// a retention period was set.
+func (b *AWSBackend) PruneOutput(ctx context.Context, component string, before time.Time, keepDeployments bool) (int, error) {
+	return pruneOutput(ctx, b, component, before, keepDeployments, func(state *PipelineState) (int, error) {
+		outputType, err := EventTypeName(StepOutputEvent{})
+		if err != nil {
+			return 0, err
+		}
+		var deletes []types.WriteRequest
+		err = b.queryEvents(ctx, state.Component, state.BuildID, "#type = :type", map[string]string{
+			"#type": "Type",
+		}, map[string]types.AttributeValue{
+			":type": &types.AttributeValueMemberS{Value: outputType},
+		}, func(key map[string]types.AttributeValue) error {
+			deletes = append(deletes, types.WriteRequest{DeleteRequest: &types.DeleteRequest{Key: key}})
+			return nil
+		})
+		if err != nil {
+			return 0, err
+		}
+		return len(deletes), b.batchWrite(ctx, deletes)
+	})
+}
+
+// keepOutput removes the expiry time from the events of a build.
+func (b *AWSBackend) keepOutput(ctx context.Context, component string, buildID int64) error {
+	return b.queryEvents(ctx, component, buildID, "attribute_exists(ExpiresAt)", nil, nil, func(key map[string]types.AttributeValue) error {
+		_, err := b.dynamodb.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+			TableName:        aws.String(b.tableName),
+			Key:              key,
+			UpdateExpression: aws.String("REMOVE ExpiresAt"),
+		})
+		return err
+	})
+}
+
+// queryEvents calls fn with the key of each event of a build matching the
+// filter expression, which can use the given attribute names and values.
+func (b *AWSBackend) queryEvents(ctx context.Context, component string, buildID int64, filter string, names map[string]string, values map[string]types.AttributeValue, fn func(key map[string]types.AttributeValue) error) error {
+	expressionValues := map[string]types.AttributeValue{
+		":pk":     &types.AttributeValueMemberS{Value: buildPK(component, buildID)},
+		":prefix": &types.AttributeValueMemberS{Value: eventSKPrefix},
+	}
+	for name, value := range values {
+		expressionValues[name] = value
+	}
+	input := &dynamodb.QueryInput{
+		TableName:                 aws.String(b.tableName),
+		KeyConditionExpression:    aws.String("PK = :pk AND begins_with(SK, :prefix)"),
+		FilterExpression:          aws.String(filter),
+		ProjectionExpression:      aws.String("PK, SK"),
+		ExpressionAttributeNames:  names,
+		ExpressionAttributeValues: expressionValues,
+		ConsistentRead:            aws.Bool(true),
+	}
+	paginator := dynamodb.NewQueryPaginator(b.dynamodb, input)
+	for paginator.HasMorePages() {
+		output, err := paginator.NextPage(ctx)
+		if err != nil {
+			return err
+		}
+		for _, item := range output.Items {
+			if err := fn(item); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
 }
 
-func (b *AWSBackend) PutPipelineEvent(ctx context.Context, event Event) error {
-	panic("TODO")
+// batchWrite writes requests in batches, retrying any unprocessed items.
+func (b *AWSBackend) batchWrite(ctx context.Context, requests []types.WriteRequest) error {
+	for len(requests) > 0 {
+		n := batchWriteSize
+		if n > len(requests) {
+			n = len(requests)
+		}
+		batch := requests[:n]
+		requests = requests[n:]
+		for attempt := 0; len(batch) > 0; attempt++ {
+			if attempt > 0 {
+				select {
+				case <-ctx.Done():
+					return ctx.Err()
+				case <-time.After(retryDelay(attempt)):
+				}
+			}
+			output, err := b.dynamodb.BatchWriteItem(ctx, &dynamodb.BatchWriteItemInput{
+				RequestItems: map[string][]types.WriteRequest{b.tableName: batch},
+			})
+			if err != nil {
+				return err
+			}
+			batch = output.UnprocessedItems[b.tableName]
+		}
+	}
+	return nil
+}
+
+func unmarshalBuild(item map[string]types.AttributeValue) (*PipelineState, error) {
+	var stored buildItem
+	if err := attributevalue.UnmarshalMap(item, &stored); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal pipeline state: %w", err)
+	}
+	return &stored.PipelineState, nil
+}
+
+// encodePageToken encodes a DynamoDB key, which only has string attributes in
+// this table, as an opaque page token.
+func encodePageToken(key map[string]types.AttributeValue) (string, error) {
+	if key == nil {
+		return "", nil
+	}
+	values := map[string]string{}
+	if err := attributevalue.UnmarshalMap(key, &values); err != nil {
+		return "", fmt.Errorf("failed to encode page token: %w", err)
+	}
+	data, err := json.Marshal(values)
+	if err != nil {
+		return "", fmt.Errorf("failed to encode page token: %w", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+func decodePageToken(token string) (map[string]types.AttributeValue, error) {
+	if token == "" {
+		return nil, nil
+	}
+	data, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return nil, fmt.Errorf("invalid page token %q", token)
+	}
+	var values map[string]string
+	if err := json.Unmarshal(data, &values); err != nil {
+		return nil, fmt.Errorf("invalid page token %q", token)
+	}
+	return attributevalue.MarshalMap(values)
 }
@@ -2,14 +2,20 @@ package dcd_test
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"log"
 	"os"
+	"reflect"
 	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
 	"github.com/aws/smithy-go"
@@ -17,9 +23,11 @@ import (
 	"github.com/testcontainers/testcontainers-go/wait"
 
 	"github.com/progsoftware/dcd/internal/dcd"
+	"github.com/progsoftware/dcd/internal/dcd/dcdtest"
 )
 
 var dbClient *dynamodb.Client
+var dbEndpoint string
 
 func TestMain(m *testing.M) {
 	ctx := context.Background()
@@ -57,10 +65,12 @@ func TestMain(m *testing.M) {
 		log.Fatalf("Failed to get the container's host: %s", err)
 	}
 
+	dbEndpoint = "http://" + host + ":" + mappedPort.Port()
+
 	awsConfig, err := config.LoadDefaultConfig(ctx, config.WithEndpointResolverWithOptions(aws.EndpointResolverWithOptionsFunc(
 		func(service, region string, options ...interface{}) (aws.Endpoint, error) {
 			return aws.Endpoint{
-				URL: "http://" + host + ":" + mappedPort.Port(),
+				URL: dbEndpoint,
 				//SigningRegion: "us-west-2",
 			}, nil
 		},
@@ -74,30 +84,85 @@ func TestMain(m *testing.M) {
 	dbClient = dynamodb.NewFromConfig(awsConfig)
 
 	// Create the test table
+	if err := createTestTable(ctx, "test-table"); err != nil {
+		log.Fatalf("Failed to create table: %s", err)
+	}
+
+	// Run the tests
+	code := m.Run()
+
+	os.Exit(code)
+}
+
+func createTestTable(ctx context.Context, tableName string) error {
 	createTableInput := &dynamodb.CreateTableInput{
-		TableName: aws.String("test-table"),
+		TableName: aws.String(tableName),
 		AttributeDefinitions: []types.AttributeDefinition{
 			{
 				AttributeName: aws.String("PK"),
 				AttributeType: types.ScalarAttributeTypeS,
 			},
+			{
+				AttributeName: aws.String("SK"),
+				AttributeType: types.ScalarAttributeTypeS,
+			},
+			{
+				AttributeName: aws.String("GSI1PK"),
+				AttributeType: types.ScalarAttributeTypeS,
+			},
+			{
+				AttributeName: aws.String("GSI1SK"),
+				AttributeType: types.ScalarAttributeTypeS,
+			},
 		},
 		KeySchema: []types.KeySchemaElement{
 			{
 				AttributeName: aws.String("PK"),
 				KeyType:       types.KeyTypeHash,
 			},
+			{
+				AttributeName: aws.String("SK"),
+				KeyType:       types.KeyTypeRange,
+			},
+		},
+		GlobalSecondaryIndexes: []types.GlobalSecondaryIndex{
+			{
+				IndexName: aws.String("GSI1"),
+				KeySchema: []types.KeySchemaElement{
+					{
+						AttributeName: aws.String("GSI1PK"),
+						KeyType:       types.KeyTypeHash,
+					},
+					{
+						AttributeName: aws.String("GSI1SK"),
+						KeyType:       types.KeyTypeRange,
+					},
+				},
+				Projection: &types.Projection{
+					ProjectionType: types.ProjectionTypeAll,
+				},
+			},
 		},
 		BillingMode: "PAY_PER_REQUEST",
 	}
-	if _, err := dbClient.CreateTable(ctx, createTableInput); err != nil {
-		log.Fatalf("Failed to create table: %s", err)
-	}
+	_, err := dbClient.CreateTable(ctx, createTableInput)
+	return err
+}
 
-	// Run the tests
-	code := m.Run()
+var testTableCount int64
 
-	os.Exit(code)
+// newTestAWSBackend returns a backend on a new, empty table.
+func newTestAWSBackend(t *testing.T) dcd.Backend {
+	t.Helper()
+	tableName := fmt.Sprintf("test-table-%d", atomic.AddInt64(&testTableCount, 1))
+	if err := createTestTable(context.Background(), tableName); err != nil {
+		t.Fatalf("Failed to create table: %v", err)
+	}
+	return dcd.NewAWSBackend(dbClient, tableName)
+}
+
+func TestAWSBackendBehaviour(t *testing.T) {
+	dcdtest.TestBackend(t, newTestAWSBackend)
 }
 
 func TestMissingTableError(t *testing.T) {
@@ -105,7 +170,7 @@ func TestMissingTableError(t *testing.T) {
 
 	awsBackend := dcd.NewAWSBackend(dbClient, "missing-table")
 
-	_, err := awsBackend.GetBuildID(ctx)
+	_, err := awsBackend.GetBuildID(ctx, "test-component")
 	if err == nil {
 		t.Fatalf("Expected error, got nil")
 	}
@@ -125,7 +190,7 @@ func TestIncrementBuildID(t *testing.T) {
 	awsBackend := dcd.NewAWSBackend(dbClient, "test-table")
 
 	// First call, item does not exist
-	id, err := awsBackend.GetBuildID(ctx)
+	id, err := awsBackend.GetBuildID(ctx, "test-component")
 	if err != nil {
 		t.Fatalf("Unexpected error: %v", err)
 	}
@@ -134,7 +199,7 @@ func TestIncrementBuildID(t *testing.T) {
 	}
 
 	// Second call, item exists
-	id, err = awsBackend.GetBuildID(ctx)
+	id, err = awsBackend.GetBuildID(ctx, "test-component")
 	if err != nil {
 		t.Fatalf("Unexpected error: %v", err)
 	}
@@ -153,6 +218,7 @@ func TestStartPipeline(t *testing.T) {
 	pipeline.SetDefinition(&dcd.PipelineDefinition{
 		Steps: []dcd.Step{},
 	})
+	pipeline.SetBackend(dcd.NewAWSBackend(dbClient, "test-table"))
 
 	// When
 	eventsChan, err := pipeline.Run()
@@ -169,3 +235,529 @@ func TestStartPipeline(t *testing.T) {
 	//buildID := events[0].(dcd.PipelineStartEvent).BuildID
 
 }
+
+func getBuildItem(t *testing.T, buildID int64) map[string]types.AttributeValue {
+	t.Helper()
+	output, err := dbClient.GetItem(context.Background(), &dynamodb.GetItemInput{
+		TableName: aws.String("test-table"),
+		Key: map[string]types.AttributeValue{
+			"PK": &types.AttributeValueMemberS{Value: fmt.Sprintf("BUILD#test-component#%d", buildID)},
+			"SK": &types.AttributeValueMemberS{Value: "STATE"},
+		},
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if output.Item == nil {
+		t.Fatalf("Expected build %d to be stored", buildID)
+	}
+	return output.Item
+}
+
+func stringAttribute(item map[string]types.AttributeValue, name string) string {
+	if value, ok := item[name].(*types.AttributeValueMemberS); ok {
+		return value.Value
+	}
+	return ""
+}
+
+func TestAWSBackendStartPipeline(t *testing.T) {
+	ctx := context.Background()
+
+	awsBackend := dcd.NewAWSBackend(dbClient, "test-table")
+	state := &dcd.PipelineState{
+		BuildID:   1001,
+		Component: "test-component",
+		GitSHA:    "test-git-sha",
+		Status:    "pending",
+		StartTime: time.Now(),
+	}
+
+	if err := awsBackend.StartPipeline(ctx, state); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	item := getBuildItem(t, 1001)
+	if status := stringAttribute(item, "Status"); status != "pending" {
+		t.Errorf("Expected status to be pending, got %q", status)
+	}
+	if component := stringAttribute(item, "Component"); component != "test-component" {
+		t.Errorf("Expected component to be test-component, got %q", component)
+	}
+	if gsi1PK := stringAttribute(item, "GSI1PK"); gsi1PK != "COMPONENT#test-component" {
+		t.Errorf("Expected GSI1PK to be COMPONENT#test-component, got %q", gsi1PK)
+	}
+
+	err := awsBackend.StartPipeline(ctx, state)
+	if _, ok := err.(*dcd.BuildExistsError); !ok {
+		t.Fatalf("Expected *dcd.BuildExistsError, got %T: %v", err, err)
+	}
+}
+
+func TestAWSBackendPutPipeline(t *testing.T) {
+	ctx := context.Background()
+
+	awsBackend := dcd.NewAWSBackend(dbClient, "test-table")
+	state := &dcd.PipelineState{
+		BuildID:   1002,
+		Component: "test-component",
+		GitSHA:    "test-git-sha",
+		Status:    "pending",
+		StartTime: time.Now(),
+	}
+	if err := awsBackend.StartPipeline(ctx, state); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	state.Status = "succeeded"
+	state.EndTime = time.Now()
+	if err := awsBackend.PutPipeline(ctx, state); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	item := getBuildItem(t, 1002)
+	if status := stringAttribute(item, "Status"); status != "succeeded" {
+		t.Errorf("Expected status to be succeeded, got %q", status)
+	}
+}
+
+func TestAWSBackendPutPipelineEvent(t *testing.T) {
+	ctx := context.Background()
+
+	awsBackend := dcd.NewAWSBackend(dbClient, "test-table")
+	start := time.Now()
+	events := []dcd.Event{
+		dcd.PipelineStartEvent{BaseEvent: dcd.BaseEvent{EventTime: start}, BuildID: 1003},
+		dcd.StepStartEvent{BaseEvent: dcd.BaseEvent{EventTime: start.Add(time.Millisecond)}, StepName: "step"},
+		dcd.StepOutputEvent{BaseEvent: dcd.BaseEvent{EventTime: start.Add(2 * time.Millisecond)}, StepName: "step", Output: "line 1\n"},
+		// Events with the same timestamp keep the order they were written in.
+		dcd.StepOutputEvent{BaseEvent: dcd.BaseEvent{EventTime: start.Add(2 * time.Millisecond)}, StepName: "step", Output: "line 2\n"},
+		dcd.StepSuccessEvent{BaseEvent: dcd.BaseEvent{EventTime: start.Add(3 * time.Millisecond)}, StepName: "step"},
+		dcd.PipelineSuccessEvent{BaseEvent: dcd.BaseEvent{EventTime: start.Add(4 * time.Millisecond)}},
+	}
+	for _, event := range events {
+		if err := awsBackend.PutPipelineEvent(ctx, "test-component", 1003, event); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+
+	output, err := dbClient.Query(ctx, &dynamodb.QueryInput{
+		TableName:              aws.String("test-table"),
+		KeyConditionExpression: aws.String("PK = :pk AND begins_with(SK, :sk)"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":pk": &types.AttributeValueMemberS{Value: "BUILD#test-component#1003"},
+			":sk": &types.AttributeValueMemberS{Value: "EVENT#"},
+		},
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(output.Items) != len(events) {
+		t.Fatalf("Expected %d events, got %d", len(events), len(output.Items))
+	}
+	for i, item := range output.Items {
+		if message := stringAttribute(item, "Message"); message != events[i].LogMessage() {
+			t.Errorf("Expected event %d to be %q, got %q", i, events[i].LogMessage(), message)
+		}
+	}
+}
+
+// legacyBuildItem is a build as stored before build IDs were allocated per component.
+type legacyBuildItem struct {
+	PK     string
+	SK     string
+	GSI1PK string
+	GSI1SK string
+	dcd.PipelineState
+}
+
+func TestAWSBackendMigrateBuildIDs(t *testing.T) {
+	// Given builds stored by a version of dcd with a single build ID counter
+	ctx := context.Background()
+	tableName := "test-table-migrate"
+	if err := createTestTable(ctx, tableName); err != nil {
+		t.Fatalf("Failed to create table: %v", err)
+	}
+	awsBackend := dcd.NewAWSBackend(dbClient, tableName)
+	for id, component := range map[int64]string{1: "first-component", 2: "second-component", 3: "first-component"} {
+		item, err := attributevalue.MarshalMap(&legacyBuildItem{
+			PK:     fmt.Sprintf("BUILD#%d", id),
+			SK:     "STATE",
+			GSI1PK: "COMPONENT#" + component,
+			GSI1SK: fmt.Sprintf("BUILD#%020d", id),
+			PipelineState: dcd.PipelineState{
+				BuildID:   id,
+				Component: component,
+				GitSHA:    fmt.Sprintf("sha-%d", id),
+				Status:    "succeeded",
+				StartTime: time.Now(),
+			},
+		})
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if _, err := dbClient.PutItem(ctx, &dynamodb.PutItemInput{TableName: aws.String(tableName), Item: item}); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		data, err := dcd.MarshalEvent(dcd.PipelineStartEvent{BaseEvent: dcd.BaseEvent{EventTime: time.Now()}, BuildID: id})
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if _, err := dbClient.PutItem(ctx, &dynamodb.PutItemInput{
+			TableName: aws.String(tableName),
+			Item: map[string]types.AttributeValue{
+				"PK":   &types.AttributeValueMemberS{Value: fmt.Sprintf("BUILD#%d", id)},
+				"SK":   &types.AttributeValueMemberS{Value: "EVENT#1"},
+				"Data": &types.AttributeValueMemberS{Value: string(data)},
+			},
+		}); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+
+	// When
+	moved, err := awsBackend.MigrateBuildIDs(ctx)
+
+	// Then
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if moved != 3 {
+		t.Errorf("Expected 3 builds to be moved, got %d", moved)
+	}
+	state, err := awsBackend.GetPipeline(ctx, "first-component", 3)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if state.GitSHA != "sha-3" {
+		t.Errorf("Expected build 3 of first-component to have git SHA sha-3, got %s", state.GitSHA)
+	}
+	page, err := awsBackend.ListPipelineEvents(ctx, "first-component", 3, "", 0)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(page.Events) != 1 {
+		t.Errorf("Expected the event of build 3 to be moved, got %d events", len(page.Events))
+	}
+	for component, expected := range map[string]int64{"first-component": 4, "second-component": 3} {
+		id, err := awsBackend.GetBuildID(ctx, component)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if id != expected {
+			t.Errorf("Expected next build ID of %s to be %d, got %d", component, expected, id)
+		}
+	}
+
+	// Running it again has nothing left to move.
+	moved, err = awsBackend.MigrateBuildIDs(ctx)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if moved != 0 {
+		t.Errorf("Expected no builds to be moved, got %d", moved)
+	}
+}
+
+func setTestAWSCredentials(t *testing.T) {
+	t.Setenv("AWS_ACCESS_KEY_ID", "test")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "test")
+	t.Setenv("AWS_SESSION_TOKEN", "test")
+}
+
+func TestAWSNewBackendFromConfig(t *testing.T) {
+	setTestAWSCredentials(t)
+
+	backend, err := dcd.NewBackend(context.Background(), &dcd.BackendConfig{
+		Type: "dynamodb",
+		DynamoDB: dcd.DynamoDBConfig{
+			Table:    "test-table",
+			Region:   "us-east-1",
+			Endpoint: dbEndpoint,
+		},
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if _, ok := backend.(*dcd.AWSBackend); !ok {
+		t.Errorf("Expected *dcd.AWSBackend, got %T", backend)
+	}
+}
+
+func TestAWSNewBackendFromConfigMissingTable(t *testing.T) {
+	setTestAWSCredentials(t)
+
+	_, err := dcd.NewBackend(context.Background(), &dcd.BackendConfig{
+		Type: "dynamodb",
+		DynamoDB: dcd.DynamoDBConfig{
+			Table:    "missing-table",
+			Region:   "us-east-1",
+			Endpoint: dbEndpoint,
+		},
+	})
+	if err == nil || !strings.Contains(err.Error(), "dynamodb backend is not reachable") {
+		t.Fatalf("Expected unreachable backend error, got %v", err)
+	}
+}
+
+func TestAWSNewBackendFromConfigUnusableTable(t *testing.T) {
+	// Given a table keyed on PK alone and one without the component index
+	ctx := context.Background()
+	setTestAWSCredentials(t)
+	for tableName, keys := range map[string][]string{
+		"test-table-new-backend-pk-only":  {"PK"},
+		"test-table-new-backend-no-index": {"PK", "SK"},
+	} {
+		input := &dynamodb.CreateTableInput{
+			TableName:   aws.String(tableName),
+			BillingMode: types.BillingModePayPerRequest,
+		}
+		for i, key := range keys {
+			keyType := types.KeyTypeHash
+			if i > 0 {
+				keyType = types.KeyTypeRange
+			}
+			input.AttributeDefinitions = append(input.AttributeDefinitions, types.AttributeDefinition{AttributeName: aws.String(key), AttributeType: types.ScalarAttributeTypeS})
+			input.KeySchema = append(input.KeySchema, types.KeySchemaElement{AttributeName: aws.String(key), KeyType: keyType})
+		}
+		if _, err := dbClient.CreateTable(ctx, input); err != nil {
+			t.Fatalf("Failed to create table: %v", err)
+		}
+
+		// When
+		_, err := dcd.NewBackend(ctx, &dcd.BackendConfig{
+			Type: "dynamodb",
+			DynamoDB: dcd.DynamoDBConfig{
+				Table:    tableName,
+				Region:   "us-east-1",
+				Endpoint: dbEndpoint,
+			},
+		})
+
+		// Then it is a configuration error, not an unreachable backend
+		var schemaErr *dcd.TableSchemaError
+		if !errors.As(err, &schemaErr) {
+			t.Errorf("Expected *dcd.TableSchemaError for %s, got %T: %v", tableName, err, err)
+		}
+	}
+}
+
+func initTestTable(t *testing.T, tableName string) []string {
+	t.Helper()
+	setTestAWSCredentials(t)
+	changes, err := dcd.InitBackend(context.Background(), &dcd.BackendConfig{
+		Type: "dynamodb",
+		DynamoDB: dcd.DynamoDBConfig{
+			Table:    tableName,
+			Region:   "us-east-1",
+			Endpoint: dbEndpoint,
+		},
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	return changes
+}
+
+func TestAWSBackendInit(t *testing.T) {
+	// Given
+	ctx := context.Background()
+	tableName := "test-table-init"
+
+	// When
+	changes := initTestTable(t, tableName)
+
+	// Then
+	expected := []string{"created table test-table-init", "enabled TTL on ExpiresAt", "upgraded schema from version 1 to 2"}
+	if !reflect.DeepEqual(changes, expected) {
+		t.Errorf("Expected changes %q, got %q", expected, changes)
+	}
+	ttl, err := dbClient.DescribeTimeToLive(ctx, &dynamodb.DescribeTimeToLiveInput{TableName: aws.String(tableName)})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if ttl.TimeToLiveDescription.TimeToLiveStatus != types.TimeToLiveStatusEnabled {
+		t.Errorf("Expected TTL to be enabled, got %s", ttl.TimeToLiveDescription.TimeToLiveStatus)
+	}
+	awsBackend := dcd.NewAWSBackend(dbClient, tableName)
+	state := &dcd.PipelineState{BuildID: 1, Component: "test-component", Status: "pending", StartTime: time.Now()}
+	if err := awsBackend.StartPipeline(ctx, state); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	page, err := awsBackend.ListBuilds(ctx, &dcd.BuildQuery{Component: "test-component"})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(page.Builds) != 1 {
+		t.Errorf("Expected the build to be listed, got %+v", page.Builds)
+	}
+	if changes := initTestTable(t, tableName); len(changes) != 0 {
+		t.Errorf("Expected an initialised table to be left alone, got %q", changes)
+	}
+}
+
+func TestAWSBackendInitUpgrade(t *testing.T) {
+	// Given a table without the component index holding a legacy build
+	ctx := context.Background()
+	tableName := "test-table-init-upgrade"
+	_, err := dbClient.CreateTable(ctx, &dynamodb.CreateTableInput{
+		TableName: aws.String(tableName),
+		AttributeDefinitions: []types.AttributeDefinition{
+			{AttributeName: aws.String("PK"), AttributeType: types.ScalarAttributeTypeS},
+			{AttributeName: aws.String("SK"), AttributeType: types.ScalarAttributeTypeS},
+		},
+		KeySchema: []types.KeySchemaElement{
+			{AttributeName: aws.String("PK"), KeyType: types.KeyTypeHash},
+			{AttributeName: aws.String("SK"), KeyType: types.KeyTypeRange},
+		},
+		BillingMode: types.BillingModePayPerRequest,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create table: %v", err)
+	}
+	item, err := attributevalue.MarshalMap(&legacyBuildItem{
+		PK:     "BUILD#7",
+		SK:     "STATE",
+		GSI1PK: "COMPONENT#test-component",
+		GSI1SK: fmt.Sprintf("BUILD#%020d", 7),
+		PipelineState: dcd.PipelineState{
+			BuildID:   7,
+			Component: "test-component",
+			Status:    "succeeded",
+			StartTime: time.Now(),
+		},
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if _, err := dbClient.PutItem(ctx, &dynamodb.PutItemInput{TableName: aws.String(tableName), Item: item}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	// When
+	changes := initTestTable(t, tableName)
+
+	// Then
+	expected := []string{"added index GSI1", "enabled TTL on ExpiresAt", "moved 1 builds to per-component build IDs", "upgraded schema from version 1 to 2"}
+	if !reflect.DeepEqual(changes, expected) {
+		t.Errorf("Expected changes %q, got %q", expected, changes)
+	}
+	awsBackend := dcd.NewAWSBackend(dbClient, tableName)
+	page, err := awsBackend.ListBuilds(ctx, &dcd.BuildQuery{Component: "test-component"})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(page.Builds) != 1 || page.Builds[0].BuildID != 7 {
+		t.Errorf("Expected build 7 to be listed, got %+v", page.Builds)
+	}
+}
+
+func TestAWSBackendInitIncompatibleTable(t *testing.T) {
+	// Given a table keyed on PK alone, holding the build ID counter of the
+	// first versions of dcd
+	ctx := context.Background()
+	setTestAWSCredentials(t)
+	_, err := dbClient.CreateTable(ctx, &dynamodb.CreateTableInput{
+		TableName: aws.String("test-table-init-pk-only"),
+		AttributeDefinitions: []types.AttributeDefinition{
+			{AttributeName: aws.String("PK"), AttributeType: types.ScalarAttributeTypeS},
+		},
+		KeySchema: []types.KeySchemaElement{
+			{AttributeName: aws.String("PK"), KeyType: types.KeyTypeHash},
+		},
+		BillingMode: types.BillingModePayPerRequest,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create table: %v", err)
+	}
+	_, err = dbClient.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String("test-table-init-pk-only"),
+		Item: map[string]types.AttributeValue{
+			"PK": &types.AttributeValueMemberS{Value: "BUILD_ID"},
+			"ID": &types.AttributeValueMemberN{Value: "41"},
+		},
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	// When
+	_, err = dcd.NewAWSBackend(dbClient, "test-table-init-pk-only").Init(ctx)
+
+	// Then the error says to create a table under a new name
+	schemaErr, ok := err.(*dcd.TableSchemaError)
+	if !ok {
+		t.Fatalf("Expected *dcd.TableSchemaError, got %T: %v", err, err)
+	}
+	for _, expected := range []string{"Set backend.dynamodb.table to a new name", "numbered builds up to 41"} {
+		if !strings.Contains(schemaErr.Problem, expected) {
+			t.Errorf("Expected the problem to contain %q, got %q", expected, schemaErr.Problem)
+		}
+	}
+}
+
+// eventExpiries returns the ExpiresAt attribute of the events of a build by type.
+func eventExpiries(t *testing.T, tableName, component string, buildID int64) map[string]string {
+	t.Helper()
+	output, err := dbClient.Query(context.Background(), &dynamodb.QueryInput{
+		TableName:              aws.String(tableName),
+		KeyConditionExpression: aws.String("PK = :pk AND begins_with(SK, :prefix)"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":pk":     &types.AttributeValueMemberS{Value: fmt.Sprintf("BUILD#%s#%d", component, buildID)},
+			":prefix": &types.AttributeValueMemberS{Value: "EVENT#"},
+		},
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	expiries := map[string]string{}
+	for _, item := range output.Items {
+		expiry := ""
+		if value, ok := item["ExpiresAt"].(*types.AttributeValueMemberN); ok {
+			expiry = value.Value
+		}
+		expiries[stringAttribute(item, "Type")] = expiry
+	}
+	return expiries
+}
+
+func TestAWSBackendOutputExpires(t *testing.T) {
+	// Given
+	ctx := context.Background()
+	tableName := "test-table-retention"
+	if err := createTestTable(ctx, tableName); err != nil {
+		t.Fatalf("Failed to create table: %v", err)
+	}
+	awsBackend := dcd.NewAWSBackend(dbClient, tableName)
+	awsBackend.SetRetention(&dcd.RetentionConfig{OutputDays: 30, KeepDeployments: true})
+	state := &dcd.PipelineState{BuildID: 1, Component: "test-component", Status: "running", StartTime: time.Now()}
+	if err := awsBackend.StartPipeline(ctx, state); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	// When
+	start := time.Now()
+	if err := awsBackend.PutPipelineEvents(ctx, "test-component", 1, []dcd.Event{
+		dcd.StepStartEvent{BaseEvent: dcd.BaseEvent{EventTime: start}, StepName: "deploy"},
+		dcd.StepOutputEvent{BaseEvent: dcd.BaseEvent{EventTime: start}, StepName: "deploy", Output: "deploying\n"},
+	}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	// Then only the output expires
+	expected := map[string]string{"step-start": "", "step-output": fmt.Sprint(start.Add(30 * 24 * time.Hour).Unix())}
+	if expiries := eventExpiries(t, tableName, "test-component", 1); !reflect.DeepEqual(expiries, expected) {
+		t.Errorf("Expected expiries %v, got %v", expected, expiries)
+	}
+
+	// And the output is kept once the build has deployed
+	state.Status = "succeeded"
+	state.Deployed = true
+	if err := awsBackend.PutPipeline(ctx, state); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	expected = map[string]string{"step-start": "", "step-output": ""}
+	if expiries := eventExpiries(t, tableName, "test-component", 1); !reflect.DeepEqual(expiries, expected) {
+		t.Errorf("Expected expiries %v, got %v", expected, expiries)
+	}
+}
@@ -0,0 +1,314 @@
+package dcd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// SchemaVersion is the version of the table layout written by this version
+// of dcd, which is recorded in the table by Init:
+//
+//	1   builds numbered from a single counter (PK="BUILD_ID") and stored
+//	    under PK="BUILD#<id>"
+//	2   per-component build IDs, see MigrateBuildIDs
+//
+// Tables without a schema version item are treated as version 1.
+const SchemaVersion = 2
+
+const (
+	schemaPK         = "SCHEMA"
+	schemaSK         = "VERSION"
+	ttlAttribute     = "ExpiresAt"
+	tableWaitTimeout = 5 * time.Minute
+	indexPollDelay   = 2 * time.Second
+)
+
+// Init creates the table if it does not exist, adds any missing index and the
+// TTL setting, and upgrades the data in it to SchemaVersion. It returns a
+// description of each change made, so running it on an up to date table
+// returns nothing.
+func (b *AWSBackend) Init(ctx context.Context) ([]string, error) {
+	var changes []string
+	created := false
+	output, err := b.dynamodb.DescribeTable(ctx, &dynamodb.DescribeTableInput{TableName: aws.String(b.tableName)})
+	var notFound *types.ResourceNotFoundException
+	switch {
+	case errors.As(err, &notFound):
+		if err := b.createTable(ctx); err != nil {
+			return nil, err
+		}
+		created = true
+		changes = append(changes, fmt.Sprintf("created table %s", b.tableName))
+	case err != nil:
+		return nil, err
+	default:
+		indexChanges, err := b.checkTable(ctx, output.Table)
+		if err != nil {
+			return nil, err
+		}
+		changes = append(changes, indexChanges...)
+	}
+
+	ttlChanges, err := b.enableTTL(ctx)
+	if err != nil {
+		return changes, err
+	}
+	changes = append(changes, ttlChanges...)
+
+	version, err := b.schemaVersion(ctx)
+	if err != nil {
+		return changes, err
+	}
+	if version > SchemaVersion {
+		return changes, &TableSchemaError{Table: b.tableName, Problem: fmt.Sprintf("schema version %d is newer than this version of dcd supports (%d), upgrade dcd", version, SchemaVersion)}
+	}
+	if version == SchemaVersion {
+		return changes, nil
+	}
+	// A table that was just created has no data to upgrade.
+	if version == 1 && !created {
+		moved, err := b.MigrateBuildIDs(ctx)
+		if err != nil {
+			return changes, fmt.Errorf("failed to migrate build IDs after moving %d builds: %w", moved, err)
+		}
+		changes = append(changes, fmt.Sprintf("moved %d builds to per-component build IDs", moved))
+	}
+	if err := b.putSchemaVersion(ctx); err != nil {
+		return changes, err
+	}
+	return append(changes, fmt.Sprintf("upgraded schema from version %d to %d", version, SchemaVersion)), nil
+}
+
+func (b *AWSBackend) createTable(ctx context.Context) error {
+	_, err := b.dynamodb.CreateTable(ctx, &dynamodb.CreateTableInput{
+		TableName: aws.String(b.tableName),
+		AttributeDefinitions: append(keyAttributeDefinitions("PK", "SK"),
+			keyAttributeDefinitions("GSI1PK", "GSI1SK")...),
+		KeySchema: keySchema("PK", "SK"),
+		GlobalSecondaryIndexes: []types.GlobalSecondaryIndex{
+			{
+				IndexName:  aws.String(componentIndex),
+				KeySchema:  keySchema("GSI1PK", "GSI1SK"),
+				Projection: &types.Projection{ProjectionType: types.ProjectionTypeAll},
+			},
+		},
+		BillingMode: types.BillingModePayPerRequest,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create table %s: %w", b.tableName, err)
+	}
+	waiter := dynamodb.NewTableExistsWaiter(b.dynamodb)
+	return waiter.Wait(ctx, &dynamodb.DescribeTableInput{TableName: aws.String(b.tableName)}, tableWaitTimeout)
+}
+
+// checkTable checks the keys of an existing table, which cannot be changed,
+// and adds the component index if it is missing.
+func (b *AWSBackend) checkTable(ctx context.Context, table *types.TableDescription) ([]string, error) {
+	hasIndex, err := b.checkKeys(ctx, table)
+	if err != nil || hasIndex {
+		return nil, err
+	}
+	_, err = b.dynamodb.UpdateTable(ctx, &dynamodb.UpdateTableInput{
+		TableName:            aws.String(b.tableName),
+		AttributeDefinitions: keyAttributeDefinitions("GSI1PK", "GSI1SK"),
+		GlobalSecondaryIndexUpdates: []types.GlobalSecondaryIndexUpdate{
+			{
+				Create: &types.CreateGlobalSecondaryIndexAction{
+					IndexName:  aws.String(componentIndex),
+					KeySchema:  keySchema("GSI1PK", "GSI1SK"),
+					Projection: &types.Projection{ProjectionType: types.ProjectionTypeAll},
+				},
+			},
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to add index %s: %w", componentIndex, err)
+	}
+	if err := b.waitForIndex(ctx); err != nil {
+		return nil, err
+	}
+	return []string{fmt.Sprintf("added index %s", componentIndex)}, nil
+}
+
+// checkSchema checks that an existing table can be used as it is, without
+// changing it.
+func (b *AWSBackend) checkSchema(ctx context.Context, table *types.TableDescription) error {
+	hasIndex, err := b.checkKeys(ctx, table)
+	if err != nil {
+		return err
+	}
+	if !hasIndex {
+		return &TableSchemaError{Table: b.tableName, Problem: fmt.Sprintf("index %s is missing, run dcd backend init to add it", componentIndex)}
+	}
+	return nil
+}
+
+// checkKeys checks the keys of a table and of its component index, returning
+// whether it has the index.
+func (b *AWSBackend) checkKeys(ctx context.Context, table *types.TableDescription) (bool, error) {
+	if len(table.KeySchema) == 1 && aws.ToString(table.KeySchema[0].AttributeName) == "PK" {
+		return false, b.pkOnlyTableError(ctx)
+	}
+	if !hasKeySchema(table.KeySchema, "PK", "SK") {
+		return false, &TableSchemaError{Table: b.tableName, Problem: "the key must be PK (string, hash) and SK (string, range), set backend.dynamodb.table to a new name and run dcd backend init to create a table with it"}
+	}
+	for _, index := range table.GlobalSecondaryIndexes {
+		if aws.ToString(index.IndexName) == componentIndex {
+			if !hasKeySchema(index.KeySchema, "GSI1PK", "GSI1SK") {
+				return false, &TableSchemaError{Table: b.tableName, Problem: fmt.Sprintf("the key of index %s must be GSI1PK (hash) and GSI1SK (range)", componentIndex)}
+			}
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// pkOnlyTableError explains how to replace a table keyed on PK alone, as made
+// for the first versions of dcd, which only ever stored the single build ID
+// counter in it as they did not record builds.
+func (b *AWSBackend) pkOnlyTableError(ctx context.Context) error {
+	problem := "it is keyed on PK alone, as for earlier versions of dcd, and the key of a table cannot be changed. " +
+		"Set backend.dynamodb.table to a new name and run dcd backend init to create a table with it, then delete this one, which holds no builds"
+	output, err := b.dynamodb.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(b.tableName),
+		Key: map[string]types.AttributeValue{
+			"PK": &types.AttributeValueMemberS{Value: "BUILD_ID"},
+		},
+		ConsistentRead: aws.Bool(true),
+	})
+	if err == nil {
+		if id, ok := output.Item["ID"].(*types.AttributeValueMemberN); ok {
+			problem += fmt.Sprintf(". Build IDs start again from 1 in the new table, while this one numbered builds up to %s", id.Value)
+		}
+	}
+	return &TableSchemaError{Table: b.tableName, Problem: problem}
+}
+
+// waitForIndex waits for the component index to finish building.
+func (b *AWSBackend) waitForIndex(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, tableWaitTimeout)
+	defer cancel()
+	for {
+		output, err := b.dynamodb.DescribeTable(ctx, &dynamodb.DescribeTableInput{TableName: aws.String(b.tableName)})
+		if err != nil {
+			return err
+		}
+		for _, index := range output.Table.GlobalSecondaryIndexes {
+			if aws.ToString(index.IndexName) == componentIndex && index.IndexStatus == types.IndexStatusActive {
+				return nil
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("timed out waiting for index %s: %w", componentIndex, ctx.Err())
+		case <-time.After(indexPollDelay):
+		}
+	}
+}
+
+// enableTTL has DynamoDB delete items once the time in their ExpiresAt
+// attribute has passed.
+func (b *AWSBackend) enableTTL(ctx context.Context) ([]string, error) {
+	output, err := b.dynamodb.DescribeTimeToLive(ctx, &dynamodb.DescribeTimeToLiveInput{TableName: aws.String(b.tableName)})
+	if err != nil {
+		return nil, err
+	}
+	if ttl := output.TimeToLiveDescription; ttl != nil {
+		switch ttl.TimeToLiveStatus {
+		case types.TimeToLiveStatusEnabled, types.TimeToLiveStatusEnabling:
+			if name := aws.ToString(ttl.AttributeName); name != ttlAttribute {
+				return nil, &TableSchemaError{Table: b.tableName, Problem: fmt.Sprintf("TTL is enabled on attribute %s rather than %s", name, ttlAttribute)}
+			}
+			return nil, nil
+		}
+	}
+	_, err = b.dynamodb.UpdateTimeToLive(ctx, &dynamodb.UpdateTimeToLiveInput{
+		TableName: aws.String(b.tableName),
+		TimeToLiveSpecification: &types.TimeToLiveSpecification{
+			AttributeName: aws.String(ttlAttribute),
+			Enabled:       aws.Bool(true),
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to enable TTL: %w", err)
+	}
+	return []string{fmt.Sprintf("enabled TTL on %s", ttlAttribute)}, nil
+}
+
+// schemaVersion returns the schema version recorded in the table.
+func (b *AWSBackend) schemaVersion(ctx context.Context) (int, error) {
+	output, err := b.dynamodb.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName:      aws.String(b.tableName),
+		Key:            schemaKey(),
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return 0, err
+	}
+	value, ok := output.Item["Version"].(*types.AttributeValueMemberN)
+	if !ok {
+		return 1, nil
+	}
+	version, err := strconv.Atoi(value.Value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid schema version %q: %w", value.Value, err)
+	}
+	return version, nil
+}
+
+// putSchemaVersion records SchemaVersion in the table, unless a newer version
+// of dcd has recorded a later one.
+func (b *AWSBackend) putSchemaVersion(ctx context.Context) error {
+	item := schemaKey()
+	item["Version"] = &types.AttributeValueMemberN{Value: strconv.Itoa(SchemaVersion)}
+	_, err := b.dynamodb.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName:           aws.String(b.tableName),
+		Item:                item,
+		ConditionExpression: aws.String("attribute_not_exists(#version) OR #version <= :version"),
+		ExpressionAttributeNames: map[string]string{
+			"#version": "Version",
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":version": item["Version"],
+		},
+	})
+	var conditionFailed *types.ConditionalCheckFailedException
+	if errors.As(err, &conditionFailed) {
+		return &TableSchemaError{Table: b.tableName, Problem: "the schema was upgraded by a newer version of dcd, upgrade dcd"}
+	}
+	return err
+}
+
+func schemaKey() map[string]types.AttributeValue {
+	return map[string]types.AttributeValue{
+		"PK": &types.AttributeValueMemberS{Value: schemaPK},
+		"SK": &types.AttributeValueMemberS{Value: schemaSK},
+	}
+}
+
+func keyAttributeDefinitions(hash, sort string) []types.AttributeDefinition {
+	return []types.AttributeDefinition{
+		{AttributeName: aws.String(hash), AttributeType: types.ScalarAttributeTypeS},
+		{AttributeName: aws.String(sort), AttributeType: types.ScalarAttributeTypeS},
+	}
+}
+
+func keySchema(hash, sort string) []types.KeySchemaElement {
+	return []types.KeySchemaElement{
+		{AttributeName: aws.String(hash), KeyType: types.KeyTypeHash},
+		{AttributeName: aws.String(sort), KeyType: types.KeyTypeRange},
+	}
+}
+
+func hasKeySchema(schema []types.KeySchemaElement, hash, sort string) bool {
+	return len(schema) == 2 &&
+		aws.ToString(schema[0].AttributeName) == hash && schema[0].KeyType == types.KeyTypeHash &&
+		aws.ToString(schema[1].AttributeName) == sort && schema[1].KeyType == types.KeyTypeRange
+}
@@ -0,0 +1,112 @@
+package dcd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+)
+
+// SecretsManagerProvider resolves the ID of an AWS Secrets Manager secret to
+// its value, or "id#key" to the value of key in a secret holding JSON.
+type SecretsManagerProvider struct {
+	mu     sync.Mutex
+	client *secretsmanager.Client
+}
+
+// NewSecretsManagerProvider creates a provider using client, or a client
+// from the default AWS configuration if it is nil.
+func NewSecretsManagerProvider(client *secretsmanager.Client) *SecretsManagerProvider {
+	return &SecretsManagerProvider{client: client}
+}
+
+func (p *SecretsManagerProvider) Resolve(ctx context.Context, ref string) (string, error) {
+	p.mu.Lock()
+	if p.client == nil {
+		awsConfig, err := loadSecretsAWSConfig(ctx)
+		if err != nil {
+			p.mu.Unlock()
+			return "", err
+		}
+		p.client = secretsmanager.NewFromConfig(awsConfig)
+	}
+	client := p.client
+	p.mu.Unlock()
+
+	id, key, hasKey := strings.Cut(ref, "#")
+	output, err := client.GetSecretValue(ctx, &secretsmanager.GetSecretValueInput{SecretId: aws.String(id)})
+	if err != nil {
+		return "", err
+	}
+	if output.SecretString == nil {
+		return "", fmt.Errorf("secret %s is binary, only string secrets are supported", id)
+	}
+	if !hasKey {
+		return *output.SecretString, nil
+	}
+	var values map[string]any
+	if err := json.Unmarshal([]byte(*output.SecretString), &values); err != nil {
+		return "", fmt.Errorf("secret %s is not a JSON object: %w", id, err)
+	}
+	value, ok := values[key]
+	if !ok {
+		return "", fmt.Errorf("secret %s has no key %q", id, key)
+	}
+	if s, ok := value.(string); ok {
+		return s, nil
+	}
+	return fmt.Sprint(value), nil
+}
+
+// SSMProvider resolves the name of an AWS Systems Manager parameter to its
+// value, decrypting SecureString parameters.
+type SSMProvider struct {
+	mu     sync.Mutex
+	client *ssm.Client
+}
+
+// NewSSMProvider creates a provider using client, or a client from the
+// default AWS configuration if it is nil.
+func NewSSMProvider(client *ssm.Client) *SSMProvider {
+	return &SSMProvider{client: client}
+}
+
+func (p *SSMProvider) Resolve(ctx context.Context, ref string) (string, error) {
+	p.mu.Lock()
+	if p.client == nil {
+		awsConfig, err := loadSecretsAWSConfig(ctx)
+		if err != nil {
+			p.mu.Unlock()
+			return "", err
+		}
+		p.client = ssm.NewFromConfig(awsConfig)
+	}
+	client := p.client
+	p.mu.Unlock()
+
+	output, err := client.GetParameter(ctx, &ssm.GetParameterInput{
+		Name:           aws.String(ref),
+		WithDecryption: aws.Bool(true),
+	})
+	if err != nil {
+		return "", err
+	}
+	return aws.ToString(output.Parameter.Value), nil
+}
+
+func loadSecretsAWSConfig(ctx context.Context) (aws.Config, error) {
+	awsConfig, err := config.LoadDefaultConfig(ctx)
+	if err != nil {
+		return aws.Config{}, fmt.Errorf("failed to load AWS config: %w", err)
+	}
+	if awsConfig.Region == "" {
+		return aws.Config{}, fmt.Errorf("no AWS region configured for secrets (AWS_REGION)")
+	}
+	return awsConfig, nil
+}
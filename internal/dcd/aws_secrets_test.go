@@ -0,0 +1,105 @@
+package dcd_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	ssmtypes "github.com/aws/aws-sdk-go-v2/service/ssm/types"
+	"github.com/testcontainers/testcontainers-go"
+	"github.com/testcontainers/testcontainers-go/wait"
+
+	"github.com/progsoftware/dcd/internal/dcd"
+)
+
+// startLocalStack starts LocalStack as a stand-in for Secrets Manager and
+// SSM, returning its endpoint.
+func startLocalStack(t *testing.T) string {
+	ctx := context.Background()
+	container, err := testcontainers.GenericContainer(ctx, testcontainers.GenericContainerRequest{
+		ContainerRequest: testcontainers.ContainerRequest{
+			Image:        "localstack/localstack:3",
+			ExposedPorts: []string{"4566/tcp"},
+			Env:          map[string]string{"SERVICES": "secretsmanager,ssm"},
+			WaitingFor:   wait.ForHTTP("/_localstack/health").WithPort("4566/tcp"),
+		},
+		Started: true,
+	})
+	if err != nil {
+		t.Fatalf("Failed to start the LocalStack container: %v", err)
+	}
+	t.Cleanup(func() {
+		if err := container.Terminate(ctx); err != nil {
+			t.Errorf("Could not stop the LocalStack container: %v", err)
+		}
+	})
+	endpoint, err := container.PortEndpoint(ctx, "4566/tcp", "http")
+	if err != nil {
+		t.Fatalf("Failed to get the LocalStack endpoint: %v", err)
+	}
+	return endpoint
+}
+
+func TestAWSSecretProviders(t *testing.T) {
+	// Given
+	ctx := context.Background()
+	endpoint := startLocalStack(t)
+	credentialsProvider := credentials.NewStaticCredentialsProvider("test", "test", "")
+	secretsClient := secretsmanager.New(secretsmanager.Options{
+		Region:       "us-east-1",
+		BaseEndpoint: aws.String(endpoint),
+		Credentials:  credentialsProvider,
+	})
+	ssmClient := ssm.New(ssm.Options{
+		Region:       "us-east-1",
+		BaseEndpoint: aws.String(endpoint),
+		Credentials:  credentialsProvider,
+	})
+	if _, err := secretsClient.CreateSecret(ctx, &secretsmanager.CreateSecretInput{
+		Name:         aws.String("test/plain"),
+		SecretString: aws.String("plain-value"),
+	}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if _, err := secretsClient.CreateSecret(ctx, &secretsmanager.CreateSecretInput{
+		Name:         aws.String("test/json"),
+		SecretString: aws.String(`{"username":"dcd","password":"json-value"}`),
+	}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if _, err := ssmClient.PutParameter(ctx, &ssm.PutParameterInput{
+		Name:  aws.String("/test/parameter"),
+		Value: aws.String("parameter-value"),
+		Type:  ssmtypes.ParameterTypeSecureString,
+	}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	testCases := []struct {
+		provider dcd.SecretProvider
+		ref      string
+		expected string
+	}{
+		{dcd.NewSecretsManagerProvider(secretsClient), "test/plain", "plain-value"},
+		{dcd.NewSecretsManagerProvider(secretsClient), "test/json#password", "json-value"},
+		{dcd.NewSSMProvider(ssmClient), "/test/parameter", "parameter-value"},
+	}
+
+	for _, tc := range testCases {
+		// When
+		value, err := tc.provider.Resolve(ctx, tc.ref)
+
+		// Then
+		if err != nil {
+			t.Errorf("Unexpected error resolving %s: %v", tc.ref, err)
+		} else if value != tc.expected {
+			t.Errorf("Expected %s to resolve to %q, got %q", tc.ref, tc.expected, value)
+		}
+	}
+	if _, err := dcd.NewSecretsManagerProvider(secretsClient).Resolve(ctx, "test/json#missing"); err == nil {
+		t.Errorf("Expected an error for a missing key")
+	}
+}
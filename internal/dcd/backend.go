@@ -1,10 +1,213 @@
 package dcd
 
-import "context"
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+)
 
+const (
+	// DefaultBuildPageSize is the number of builds ListBuilds returns when no limit is given.
+	DefaultBuildPageSize = 20
+	// DefaultEventPageSize is the number of events ListPipelineEvents returns when no limit is given.
+	DefaultEventPageSize = 500
+)
+
+// Backend stores the build history. Builds are identified by their component
+// and a build ID from the component's own sequence.
 type Backend interface {
-	GetBuildID(ctx context.Context) (int64, error)
-	StartPipeline(ctx context.Context, buildID int64) error
+	// GetBuildID allocates the next build ID in the component's sequence.
+	GetBuildID(ctx context.Context, component string) (int64, error)
+	// StartPipeline records a new build, returning a *BuildExistsError if it is
+	// already recorded. The state's Version is set to 1.
+	StartPipeline(ctx context.Context, state *PipelineState) error
+	// PutPipeline replaces the state of a build, returning a
+	// *StateConflictError if the build has changed since the state's Version
+	// or the status cannot change to the new one, and a *BuildNotFoundError if
+	// the build was never started. The state's Version is incremented.
 	PutPipeline(ctx context.Context, state *PipelineState) error
-	PutPipelineEvent(ctx context.Context, event Event) error
+	// PutPipelineEvent stores an event of a build.
+	PutPipelineEvent(ctx context.Context, component string, buildID int64, event Event) error
+
+	// GetPipeline returns the state of a build, or a *BuildNotFoundError.
+	GetPipeline(ctx context.Context, component string, buildID int64) (*PipelineState, error)
+	// ListBuilds returns a page of the builds of a component, newest first.
+	ListBuilds(ctx context.Context, query *BuildQuery) (*BuildPage, error)
+	// ListPipelineEvents returns a page of the events of a build in order,
+	// starting after the cursor (or from the first event if the cursor is empty).
+	ListPipelineEvents(ctx context.Context, component string, buildID int64, cursor string, limit int) (*EventPage, error)
+}
+
+// OutputPruner is implemented by backends that can delete the step output of
+// old builds to save space.
+type OutputPruner interface {
+	// PruneOutput deletes the StepOutputEvents of the finished builds of a
+	// component started before the cutoff, except for builds that deployed if
+	// keepDeployments is set, and returns the number of events deleted.
+	PruneOutput(ctx context.Context, component string, before time.Time, keepDeployments bool) (int, error)
+}
+
+// BackendInitializer is implemented by backends that need to be set up before
+// use, e.g. by creating a table.
+type BackendInitializer interface {
+	// Init sets up the backend, or upgrades an existing one, returning a
+	// description of each change made.
+	Init(ctx context.Context) ([]string, error)
+}
+
+// validTransition reports whether a build can go from one status to another.
+// Finished builds cannot change status, and running builds cannot go back to
+// pending. A running build can stay running, e.g. to record a heartbeat. An
+// abandoned build can still finish, since its runner may only have been out of
+// touch, e.g. with its events in the outbox until dcd sync.
+func validTransition(from, to string) bool {
+	switch from {
+	case StatusPending:
+		return true
+	case StatusRunning:
+		return to != StatusPending
+	case StatusAbandoned:
+		return to == StatusSucceeded || to == StatusFailed || to == StatusCancelled
+	}
+	return false
+}
+
+// allowedPreviousStatuses returns the statuses a build can change to the given one from.
+func allowedPreviousStatuses(to string) []string {
+	var from []string
+	for _, status := range []string{StatusPending, StatusRunning, StatusSucceeded, StatusFailed, StatusAbandoned, StatusCancelled} {
+		if validTransition(status, to) {
+			from = append(from, status)
+		}
+	}
+	return from
+}
+
+// checkStateWrite returns a *StateConflictError if a state cannot replace the
+// current state of the build.
+func checkStateWrite(current, next *PipelineState) error {
+	if current.Version == next.Version && validTransition(current.Status, next.Status) {
+		return nil
+	}
+	return &StateConflictError{
+		Component:      next.Component,
+		BuildID:        next.BuildID,
+		Status:         next.Status,
+		Version:        next.Version,
+		CurrentStatus:  current.Status,
+		CurrentVersion: current.Version,
+	}
+}
+
+// BatchEventWriter is implemented by backends that can store several events of
+// a build more efficiently than one at a time.
+type BatchEventWriter interface {
+	// PutPipelineEvents stores events of a build, in order.
+	PutPipelineEvents(ctx context.Context, component string, buildID int64, events []Event) error
+}
+
+// PutPipelineEvents stores events of a build in a batch if the backend
+// supports it, otherwise one at a time.
+func PutPipelineEvents(ctx context.Context, backend Backend, component string, buildID int64, events []Event) error {
+	if writer, ok := backend.(BatchEventWriter); ok {
+		return writer.PutPipelineEvents(ctx, component, buildID, events)
+	}
+	for _, event := range events {
+		if err := backend.PutPipelineEvent(ctx, component, buildID, event); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// BuildIDMigrator is implemented by backends that can move history recorded
+// with a single global build ID counter to per-component sequences.
+type BuildIDMigrator interface {
+	// MigrateBuildIDs moves builds recorded under the global counter to their
+	// component and starts each component's sequence after its highest
+	// existing build ID, returning the number of builds moved. It is safe to
+	// run more than once.
+	MigrateBuildIDs(ctx context.Context) (int, error)
+}
+
+// BuildQuery selects the builds returned by ListBuilds.
+type BuildQuery struct {
+	Component string // required
+	Status    string // only builds with this status, if set
+	GitSHA    string // only builds whose git SHA starts with this, if set
+
+	StartedAfter  time.Time // only builds started at or after this, if set
+	StartedBefore time.Time // only builds started before this, if set
+
+	SeenBefore time.Time // only builds whose runner was last seen before this, if set (see PipelineState.LastSeen)
+
+	Limit     int    // the maximum number of builds to return, DefaultBuildPageSize if zero
+	PageToken string // the NextPageToken of the previous page, if any
+}
+
+// BuildPage is a page of builds, newest first.
+type BuildPage struct {
+	Builds        []PipelineState
+	NextPageToken string // empty if there are no more builds
+}
+
+// EventPage is a page of the events of a build.
+type EventPage struct {
+	Events []Event
+	Cursor string // pass to ListPipelineEvents to get the events after this page
+}
+
+// StreamPipelineEvents calls fn with every event of a build in order.
+func StreamPipelineEvents(ctx context.Context, backend Backend, component string, buildID int64, fn func(Event) error) error {
+	cursor := ""
+	for {
+		page, err := backend.ListPipelineEvents(ctx, component, buildID, cursor, DefaultEventPageSize)
+		if err != nil {
+			return err
+		}
+		for _, event := range page.Events {
+			if err := fn(event); err != nil {
+				return err
+			}
+		}
+		if len(page.Events) == 0 {
+			return nil
+		}
+		cursor = page.Cursor
+	}
+}
+
+func (q *BuildQuery) validate() error {
+	if q.Component == "" {
+		return fmt.Errorf("a component is required to list builds")
+	}
+	return nil
+}
+
+func (q *BuildQuery) limit() int {
+	if q.Limit <= 0 {
+		return DefaultBuildPageSize
+	}
+	return q.Limit
+}
+
+// matches reports whether a build satisfies the query's filters.
+func (q *BuildQuery) matches(state *PipelineState) bool {
+	if state.Component != q.Component {
+		return false
+	}
+	if q.Status != "" && state.Status != q.Status {
+		return false
+	}
+	if !q.StartedAfter.IsZero() && state.StartTime.Before(q.StartedAfter) {
+		return false
+	}
+	if !q.StartedBefore.IsZero() && !state.StartTime.Before(q.StartedBefore) {
+		return false
+	}
+	if !q.SeenBefore.IsZero() && !state.LastSeen().Before(q.SeenBefore) {
+		return false
+	}
+	return strings.HasPrefix(state.GitSHA, q.GitSHA)
 }
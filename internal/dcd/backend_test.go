@@ -0,0 +1,21 @@
+package dcd_test
+
+import (
+	"testing"
+
+	"github.com/progsoftware/dcd/internal/dcd"
+	"github.com/progsoftware/dcd/internal/dcd/dcdtest"
+)
+
+func TestMemoryBackendBehaviour(t *testing.T) {
+	dcdtest.TestBackend(t, func(t *testing.T) dcd.Backend {
+		return dcd.NewMemoryBackend()
+	})
+}
+
+func TestMockBackendBehaviour(t *testing.T) {
+	// The pipeline tests rely on MockBackend behaving like a real backend.
+	dcdtest.TestBackend(t, func(t *testing.T) dcd.Backend {
+		return &MockBackend{}
+	})
+}
@@ -0,0 +1,333 @@
+package dcd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	// ConfigFileName is the name of the configuration file in the repo root.
+	ConfigFileName = ".dcd.yaml"
+
+	BackendTypeDynamoDB = "dynamodb"
+	BackendTypeFile     = "file"
+
+	backendCheckTimeout = 10 * time.Second
+)
+
+// DefaultHistoryPath returns where the file backend stores history when no
+// path is configured.
+func DefaultHistoryPath() string {
+	return defaultDataPath("history")
+}
+
+// DefaultOutboxPath returns where builds are recorded when the backend cannot
+// be written to and no path is configured.
+func DefaultOutboxPath() string {
+	return defaultDataPath("outbox")
+}
+
+// defaultDataPath returns dcd/<name> in the git directory of the repo, which
+// is shared by its worktrees, so that it is outside the working tree, which
+// must be clean to run a pipeline. Outside a repo it is .dcd/<name>.
+func defaultDataPath(name string) string {
+	output, err := exec.Command("git", "rev-parse", "--git-common-dir").Output()
+	if err != nil {
+		return filepath.Join(".dcd", name)
+	}
+	dir, err := filepath.Abs(strings.TrimSpace(string(output)))
+	if err != nil {
+		return filepath.Join(".dcd", name)
+	}
+	return filepath.Join(dir, "dcd", name)
+}
+
+// Config is the runner configuration, read from .dcd.yaml and overridden by
+// DCD_* environment variables and then command line flags.
+type Config struct {
+	Backend BackendConfig `yaml:"backend"`
+	Outbox  OutboxConfig  `yaml:"outbox"`
+}
+
+// BackendConfig selects and configures the backend storing the build history.
+type BackendConfig struct {
+	Type      string          `yaml:"type"`
+	DynamoDB  DynamoDBConfig  `yaml:"dynamodb"`
+	File      FileConfig      `yaml:"file"`
+	Retention RetentionConfig `yaml:"retention"`
+	Archive   ArchiveConfig   `yaml:"archive"`
+}
+
+// DynamoDBConfig configures the dynamodb backend.
+type DynamoDBConfig struct {
+	Table    string `yaml:"table"`
+	Region   string `yaml:"region"`
+	Endpoint string `yaml:"endpoint"` // e.g. http://localhost:8000 for dynamodb-local
+}
+
+// FileConfig configures the file backend.
+type FileConfig struct {
+	Path string `yaml:"path"`
+}
+
+// RetentionConfig sets how long the step output of builds is kept. The state
+// and the other events of a build are kept indefinitely.
+type RetentionConfig struct {
+	OutputDays      int            `yaml:"output-days"`      // 0 keeps output forever
+	Components      map[string]int `yaml:"components"`       // output-days of particular components
+	KeepDeployments bool           `yaml:"keep-deployments"` // keep the output of builds that deployed
+}
+
+// OutputRetention returns how long the step output of a component is kept,
+// or 0 if it is kept forever.
+func (c *RetentionConfig) OutputRetention(component string) time.Duration {
+	days, ok := c.Components[component]
+	if !ok {
+		days = c.OutputDays
+	}
+	return time.Duration(days) * 24 * time.Hour
+}
+
+// Validate checks the retention periods are not negative.
+func (c *RetentionConfig) Validate() error {
+	if c.OutputDays < 0 {
+		return fmt.Errorf("invalid retention configuration: output-days cannot be negative")
+	}
+	for component, days := range c.Components {
+		if days < 0 {
+			return fmt.Errorf("invalid retention configuration: output-days of %s cannot be negative", component)
+		}
+	}
+	return nil
+}
+
+// ArchiveConfig configures archiving step output to S3, or to storage with an
+// S3 compatible API, instead of storing it in the backend.
+type ArchiveConfig struct {
+	Bucket   string `yaml:"bucket"` // archiving is off without a bucket
+	Prefix   string `yaml:"prefix"`
+	Region   string `yaml:"region"`
+	Endpoint string `yaml:"endpoint"` // e.g. http://localhost:9000 for MinIO
+}
+
+// NewArchive returns the configured archive, or nil if no bucket is configured.
+func (c *ArchiveConfig) NewArchive(ctx context.Context) (LogArchive, error) {
+	if c.Bucket == "" {
+		return nil, nil
+	}
+	var opts []func(*config.LoadOptions) error
+	if c.Region != "" {
+		opts = append(opts, config.WithRegion(c.Region))
+	}
+	awsConfig, err := config.LoadDefaultConfig(ctx, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load AWS config: %w", err)
+	}
+	if awsConfig.Region == "" {
+		// S3 compatible storage usually ignores the region.
+		if c.Endpoint == "" {
+			return nil, fmt.Errorf("invalid archive configuration: no AWS region configured (backend.archive.region or AWS_REGION)")
+		}
+		awsConfig.Region = "us-east-1"
+	}
+	client := s3.NewFromConfig(awsConfig, func(o *s3.Options) {
+		if c.Endpoint != "" {
+			o.BaseEndpoint = aws.String(c.Endpoint)
+			o.UsePathStyle = true
+		}
+	})
+	return NewS3Archive(client, c.Bucket, c.Prefix), nil
+}
+
+// OutboxConfig configures where builds are recorded while the backend is unreachable.
+type OutboxConfig struct {
+	Path     string `yaml:"path"`
+	Disabled bool   `yaml:"disabled"` // fail builds instead when the backend is unreachable
+}
+
+// NewOutbox returns the configured outbox, or nil if it is disabled.
+func (c *OutboxConfig) NewOutbox() *Outbox {
+	if c.Disabled {
+		return nil
+	}
+	if c.Path == "" {
+		return NewOutbox(DefaultOutboxPath())
+	}
+	return NewOutbox(c.Path)
+}
+
+// DefaultConfigPath returns the path of .dcd.yaml in the root of the current
+// git repository, or in the current directory if not in a repository.
+func DefaultConfigPath() string {
+	output, err := exec.Command("git", "rev-parse", "--show-toplevel").Output()
+	if err != nil {
+		return ConfigFileName
+	}
+	return filepath.Join(strings.TrimSpace(string(output)), ConfigFileName)
+}
+
+// LoadConfig reads the configuration file. A missing file gives an empty configuration.
+func LoadConfig(path string) (*Config, error) {
+	var cfg Config
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return &cfg, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := yaml.UnmarshalStrict(data, &cfg); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+	return &cfg, nil
+}
+
+// ApplyEnv overrides the configuration with any DCD_* environment variables that are set.
+func (c *Config) ApplyEnv() {
+	setFromEnv(&c.Backend.Type, "DCD_BACKEND")
+	setFromEnv(&c.Backend.DynamoDB.Table, "DCD_DYNAMODB_TABLE")
+	setFromEnv(&c.Backend.DynamoDB.Region, "DCD_DYNAMODB_REGION")
+	setFromEnv(&c.Backend.DynamoDB.Endpoint, "DCD_DYNAMODB_ENDPOINT")
+	setFromEnv(&c.Backend.File.Path, "DCD_HISTORY_PATH")
+	setFromEnv(&c.Backend.Archive.Bucket, "DCD_ARCHIVE_BUCKET")
+	setFromEnv(&c.Backend.Archive.Endpoint, "DCD_ARCHIVE_ENDPOINT")
+	setFromEnv(&c.Outbox.Path, "DCD_OUTBOX_PATH")
+}
+
+func setFromEnv(field *string, name string) {
+	if value := os.Getenv(name); value != "" {
+		*field = value
+	}
+}
+
+// Validate checks the backend configuration is complete.
+func (c *BackendConfig) Validate() error {
+	if err := c.Retention.Validate(); err != nil {
+		return err
+	}
+	switch c.Type {
+	case BackendTypeDynamoDB:
+		if c.DynamoDB.Table == "" {
+			return fmt.Errorf("invalid backend configuration: the dynamodb backend requires a table (backend.dynamodb.table, DCD_DYNAMODB_TABLE or --dynamodb-table)")
+		}
+	case BackendTypeFile:
+	case "":
+		return fmt.Errorf("no backend configured: set backend.type in %s, DCD_BACKEND or --backend to %q or %q", ConfigFileName, BackendTypeDynamoDB, BackendTypeFile)
+	default:
+		return fmt.Errorf("invalid backend configuration: unknown backend type %q (expected %q or %q)", c.Type, BackendTypeDynamoDB, BackendTypeFile)
+	}
+	return nil
+}
+
+// NewBackend creates the configured backend and checks that it is reachable
+// and, for DynamoDB, that the table can be used as it is. A backend that is configured correctly but cannot be reached is returned
+// with a *BackendUnreachableError, so that the caller can carry on offline.
+func NewBackend(ctx context.Context, c *BackendConfig) (Backend, error) {
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, backendCheckTimeout)
+	defer cancel()
+	switch c.Type {
+	case BackendTypeDynamoDB:
+		client, err := newDynamoDBClient(ctx, &c.DynamoDB)
+		if err != nil {
+			return nil, err
+		}
+		backend := NewAWSBackend(client, c.DynamoDB.Table)
+		backend.SetRetention(&c.Retention)
+		output, err := client.DescribeTable(ctx, &dynamodb.DescribeTableInput{TableName: aws.String(c.DynamoDB.Table)})
+		if err != nil {
+			// A missing table is a configuration problem, not a connectivity one.
+			var notFound *types.ResourceNotFoundException
+			if errors.As(err, &notFound) {
+				return nil, fmt.Errorf("dynamodb backend is not reachable: table %q does not exist, create it with dcd backend init: %w", c.DynamoDB.Table, err)
+			}
+			return backend, &BackendUnreachableError{Type: BackendTypeDynamoDB, Err: fmt.Errorf("table %q: %w", c.DynamoDB.Table, err)}
+		}
+		// So is a table that cannot be used, which would otherwise only show
+		// when the build is written, sending it to the outbox.
+		if err := backend.checkSchema(ctx, output.Table); err != nil {
+			return nil, fmt.Errorf("dynamodb backend is not usable: %w", err)
+		}
+		return backend, nil
+	default:
+		path := c.File.Path
+		if path == "" {
+			path = DefaultHistoryPath()
+		}
+		if err := checkWritableDir(path); err != nil {
+			return nil, fmt.Errorf("file backend is not usable: %w", err)
+		}
+		return NewFileBackend(path), nil
+	}
+}
+
+// InitBackend sets up the configured backend, e.g. creating or upgrading the
+// DynamoDB table, and returns a description of each change made.
+func InitBackend(ctx context.Context, c *BackendConfig) ([]string, error) {
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	var backend BackendInitializer
+	switch c.Type {
+	case BackendTypeDynamoDB:
+		client, err := newDynamoDBClient(ctx, &c.DynamoDB)
+		if err != nil {
+			return nil, err
+		}
+		backend = NewAWSBackend(client, c.DynamoDB.Table)
+	default:
+		path := c.File.Path
+		if path == "" {
+			path = DefaultHistoryPath()
+		}
+		backend = NewFileBackend(path)
+	}
+	return backend.Init(ctx)
+}
+
+func newDynamoDBClient(ctx context.Context, c *DynamoDBConfig) (*dynamodb.Client, error) {
+	var opts []func(*config.LoadOptions) error
+	if c.Region != "" {
+		opts = append(opts, config.WithRegion(c.Region))
+	}
+	awsConfig, err := config.LoadDefaultConfig(ctx, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load AWS config: %w", err)
+	}
+	if awsConfig.Region == "" {
+		return nil, fmt.Errorf("invalid backend configuration: no AWS region configured (backend.dynamodb.region, DCD_DYNAMODB_REGION, --dynamodb-region or AWS_REGION)")
+	}
+	return dynamodb.NewFromConfig(awsConfig, func(o *dynamodb.Options) {
+		if c.Endpoint != "" {
+			o.BaseEndpoint = aws.String(c.Endpoint)
+		}
+	}), nil
+}
+
+// checkWritableDir creates dir if needed and checks a file can be written in it.
+func checkWritableDir(dir string) error {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	file, err := os.CreateTemp(dir, ".write-check*")
+	if err != nil {
+		return err
+	}
+	file.Close()
+	return os.Remove(file.Name())
+}
@@ -0,0 +1,207 @@
+package dcd_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/progsoftware/dcd/internal/dcd"
+)
+
+func writeConfigFile(t *testing.T, contents string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), ".dcd.yaml")
+	if err := os.WriteFile(path, []byte(contents), 0o644); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	return path
+}
+
+func TestLoadConfig(t *testing.T) {
+	path := writeConfigFile(t, `
+backend:
+  type: dynamodb
+  dynamodb:
+    table: dcd-history
+    region: eu-west-2
+    endpoint: http://localhost:8000
+`)
+
+	cfg, err := dcd.LoadConfig(path)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	expected := dcd.BackendConfig{
+		Type: "dynamodb",
+		DynamoDB: dcd.DynamoDBConfig{
+			Table:    "dcd-history",
+			Region:   "eu-west-2",
+			Endpoint: "http://localhost:8000",
+		},
+	}
+	if !reflect.DeepEqual(cfg.Backend, expected) {
+		t.Errorf("Expected backend config %+v, got %+v", expected, cfg.Backend)
+	}
+}
+
+func TestRetentionConfig(t *testing.T) {
+	path := writeConfigFile(t, `
+backend:
+  type: file
+  retention:
+    output-days: 30
+    keep-deployments: true
+    components:
+      payments: 365
+      scratch: 0
+`)
+
+	cfg, err := dcd.LoadConfig(path)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	for component, expected := range map[string]time.Duration{
+		"web":      30 * 24 * time.Hour,
+		"payments": 365 * 24 * time.Hour,
+		"scratch":  0,
+	} {
+		if got := cfg.Backend.Retention.OutputRetention(component); got != expected {
+			t.Errorf("Expected %s output to be kept for %v, got %v", component, expected, got)
+		}
+	}
+	if !cfg.Backend.Retention.KeepDeployments {
+		t.Errorf("Expected deployments to be kept")
+	}
+	cfg.Backend.Retention.OutputDays = -1
+	if err := cfg.Backend.Validate(); err == nil {
+		t.Errorf("Expected a negative retention to be invalid")
+	}
+}
+
+func TestLoadConfigMissingFile(t *testing.T) {
+	cfg, err := dcd.LoadConfig(filepath.Join(t.TempDir(), ".dcd.yaml"))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(cfg.Backend, dcd.BackendConfig{}) {
+		t.Errorf("Expected empty backend config, got %+v", cfg.Backend)
+	}
+}
+
+func TestLoadConfigUnknownField(t *testing.T) {
+	path := writeConfigFile(t, "backend:\n  typo: file\n")
+
+	if _, err := dcd.LoadConfig(path); err == nil {
+		t.Fatalf("Expected error, got nil")
+	}
+}
+
+func TestConfigApplyEnv(t *testing.T) {
+	path := writeConfigFile(t, "backend:\n  type: dynamodb\n  dynamodb:\n    table: from-file\n")
+	t.Setenv("DCD_BACKEND", "file")
+	t.Setenv("DCD_HISTORY_PATH", "/shared/history")
+	t.Setenv("DCD_DYNAMODB_TABLE", "")
+
+	cfg, err := dcd.LoadConfig(path)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	cfg.ApplyEnv()
+
+	if cfg.Backend.Type != "file" {
+		t.Errorf("Expected type to be file, got %q", cfg.Backend.Type)
+	}
+	if cfg.Backend.File.Path != "/shared/history" {
+		t.Errorf("Expected path to be /shared/history, got %q", cfg.Backend.File.Path)
+	}
+	if cfg.Backend.DynamoDB.Table != "from-file" {
+		t.Errorf("Expected unset env var not to override table, got %q", cfg.Backend.DynamoDB.Table)
+	}
+}
+
+func TestBackendConfigValidate(t *testing.T) {
+	testCases := []struct {
+		name        string
+		config      dcd.BackendConfig
+		errContains string // empty if no error is expected
+	}{
+		{"file", dcd.BackendConfig{Type: "file"}, ""},
+		{"dynamodb", dcd.BackendConfig{Type: "dynamodb", DynamoDB: dcd.DynamoDBConfig{Table: "t"}}, ""},
+		{"dynamodb without table", dcd.BackendConfig{Type: "dynamodb"}, "requires a table"},
+		{"unset", dcd.BackendConfig{}, "no backend configured"},
+		{"unknown", dcd.BackendConfig{Type: "postgres"}, "unknown backend type"},
+	}
+
+	for _, tc := range testCases {
+		err := tc.config.Validate()
+		if tc.errContains == "" {
+			if err != nil {
+				t.Errorf("%s: unexpected error: %v", tc.name, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), tc.errContains) {
+			t.Errorf("%s: expected error containing %q, got %v", tc.name, tc.errContains, err)
+		}
+	}
+}
+
+func TestNewBackendFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history")
+
+	backend, err := dcd.NewBackend(context.Background(), &dcd.BackendConfig{
+		Type: "file",
+		File: dcd.FileConfig{Path: path},
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if _, ok := backend.(*dcd.FileBackend); !ok {
+		t.Errorf("Expected *dcd.FileBackend, got %T", backend)
+	}
+	if info, err := os.Stat(path); err != nil || !info.IsDir() {
+		t.Errorf("Expected history directory to be created, got %v", err)
+	}
+}
+
+func TestNewBackendFileNotWritable(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "not-a-directory")
+	if err := os.WriteFile(file, nil, 0o644); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	_, err := dcd.NewBackend(context.Background(), &dcd.BackendConfig{
+		Type: "file",
+		File: dcd.FileConfig{Path: filepath.Join(file, "history")},
+	})
+	if err == nil || !strings.Contains(err.Error(), "file backend is not usable") {
+		t.Fatalf("Expected file backend error, got %v", err)
+	}
+}
+
+func TestOutboxConfig(t *testing.T) {
+	path := writeConfigFile(t, "outbox:\n  path: /from/file\n")
+	t.Setenv("DCD_OUTBOX_PATH", "/from/env")
+
+	cfg, err := dcd.LoadConfig(path)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	cfg.ApplyEnv()
+
+	if outbox := cfg.Outbox.NewOutbox(); outbox == nil || outbox.Dir() != "/from/env" {
+		t.Errorf("Expected outbox in /from/env, got %+v", outbox)
+	}
+	if outbox := (&dcd.OutboxConfig{}).NewOutbox(); outbox.Dir() != dcd.DefaultOutboxPath() {
+		t.Errorf("Expected outbox in %s by default, got %s", dcd.DefaultOutboxPath(), outbox.Dir())
+	}
+	if outbox := (&dcd.OutboxConfig{Disabled: true}).NewOutbox(); outbox != nil {
+		t.Errorf("Expected no outbox when disabled, got %+v", outbox)
+	}
+}
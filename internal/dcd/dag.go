@@ -0,0 +1,378 @@
+package dcd
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+	"strings"
+	"time"
+)
+
+const (
+	// OnFailureWait lets steps that are running when another fails finish.
+	OnFailureWait = "wait"
+	// OnFailureCancel cancels steps that are running when another fails.
+	OnFailureCancel = "cancel"
+)
+
+// DefaultGracePeriod is how long a step that is stopped has to exit after
+// SIGTERM before it is sent SIGKILL.
+const DefaultGracePeriod = 10 * time.Second
+
+func (p *Pipeline) gracePeriod() time.Duration {
+	if p.definition.GracePeriod > 0 {
+		return p.definition.GracePeriod
+	}
+	return DefaultGracePeriod
+}
+
+// stepDependencies returns the names of the steps each step depends on. If no
+// step has depends-on, each depends on the one before it, so that the steps
+// run in order.
+func stepDependencies(steps []Step) map[string][]string {
+	graph := false
+	for _, step := range steps {
+		if len(step.DependsOn) > 0 {
+			graph = true
+		}
+	}
+	dependencies := map[string][]string{}
+	for i, step := range steps {
+		switch {
+		case graph:
+			dependencies[step.Name] = step.DependsOn
+		case i > 0:
+			dependencies[step.Name] = []string{steps[i-1].Name}
+		}
+	}
+	return dependencies
+}
+
+// splitCleanupSteps separates the cleanup steps, which run once the others
+// have finished, from the others.
+func splitCleanupSteps(steps []Step) ([]Step, []Step) {
+	var main, cleanup []Step
+	for _, step := range steps {
+		if step.Cleanup {
+			cleanup = append(cleanup, step)
+		} else {
+			main = append(main, step)
+		}
+	}
+	return main, cleanup
+}
+
+// validateSteps checks step names are unique and that the steps they depend
+// on exist and do not depend on them in turn.
+func validateSteps(definition *PipelineDefinition) error {
+	if definition.MaxParallel < 0 {
+		return fmt.Errorf("invalid max-parallel %d: must be at least 1", definition.MaxParallel)
+	}
+	switch definition.OnFailure {
+	case "", OnFailureWait, OnFailureCancel:
+	default:
+		return fmt.Errorf("invalid on-failure %q: expected %q or %q", definition.OnFailure, OnFailureWait, OnFailureCancel)
+	}
+	if definition.Timeout < 0 {
+		return fmt.Errorf("invalid timeout %s: must not be negative", definition.Timeout)
+	}
+	if definition.GracePeriod < 0 {
+		return fmt.Errorf("invalid grace-period %s: must not be negative", definition.GracePeriod)
+	}
+	names := map[string]bool{}
+	cleanupNames := map[string]bool{}
+	for _, step := range definition.Steps {
+		if step.Cleanup {
+			if len(step.DependsOn) > 0 {
+				return fmt.Errorf("invalid pipeline: cleanup step %q cannot depend on other steps", step.Name)
+			}
+			cleanupNames[step.Name] = true
+		}
+		if step.Timeout < 0 {
+			return fmt.Errorf("invalid timeout %s for step %q: must not be negative", step.Timeout, step.Name)
+		}
+		if err := step.Retry.validate(step.Name); err != nil {
+			return err
+		}
+		if names[step.Name] {
+			return fmt.Errorf("invalid pipeline: more than one step is named %q", step.Name)
+		}
+		names[step.Name] = true
+	}
+	steps, _ := splitCleanupSteps(definition.Steps)
+	dependencies := stepDependencies(steps)
+	for _, step := range steps {
+		for _, dependency := range dependencies[step.Name] {
+			if cleanupNames[dependency] {
+				return fmt.Errorf("invalid pipeline: step %q depends on cleanup step %q", step.Name, dependency)
+			}
+			if !names[dependency] {
+				return fmt.Errorf("invalid pipeline: step %q depends on unknown step %q", step.Name, dependency)
+			}
+		}
+	}
+	// Depth first search, where a step seen again before it is finished is
+	// part of a cycle.
+	const (
+		visiting = 1
+		visited  = 2
+	)
+	marks := map[string]int{}
+	var path []string
+	var visit func(name string) error
+	visit = func(name string) error {
+		switch marks[name] {
+		case visited:
+			return nil
+		case visiting:
+			for i, step := range path {
+				if step == name {
+					return fmt.Errorf("invalid pipeline: steps depend on each other: %s", strings.Join(append(path[i:], name), " -> "))
+				}
+			}
+		}
+		marks[name] = visiting
+		path = append(path, name)
+		for _, dependency := range dependencies[name] {
+			if err := visit(dependency); err != nil {
+				return err
+			}
+		}
+		path = path[:len(path)-1]
+		marks[name] = visited
+		return nil
+	}
+	for _, step := range steps {
+		if err := visit(step.Name); err != nil {
+			return err
+		}
+	}
+	return validateWhen(definition.Steps, dependencies)
+}
+
+// validateWhen checks when expressions only refer to the results of steps
+// that have finished by the time they are evaluated: the steps a step depends
+// on, directly or not, or for a cleanup step, the other steps and the cleanup
+// steps before it. Only cleanup steps can refer to failures, as no other steps
+// start once a step has failed.
+func validateWhen(steps []Step, dependencies map[string][]string) error {
+	cleanup := map[string]int{}
+	for i, step := range steps {
+		if step.Cleanup {
+			cleanup[step.Name] = i
+		}
+	}
+	for i, step := range steps {
+		if step.When == "" {
+			continue
+		}
+		_, refs, err := parseWhen(step.When)
+		if err != nil {
+			return fmt.Errorf("invalid when for step %q: %w", step.Name, err)
+		}
+		if refs.failures && !step.Cleanup {
+			return fmt.Errorf("invalid when for step %q: failed() is only valid on cleanup steps, as no other steps start once a step has failed", step.Name)
+		}
+		before := map[string]bool{}
+		var visit func(name string)
+		visit = func(name string) {
+			for _, dependency := range dependencies[name] {
+				if !before[dependency] {
+					before[dependency] = true
+					visit(dependency)
+				}
+			}
+		}
+		visit(step.Name)
+		for _, ref := range refs.steps {
+			index, isCleanup := cleanup[ref]
+			switch {
+			case !stepNamed(steps, ref):
+				return fmt.Errorf("invalid when for step %q: unknown step %q", step.Name, ref)
+			case step.Cleanup && (!isCleanup || index < i):
+			case !step.Cleanup && before[ref]:
+			default:
+				return fmt.Errorf("invalid when for step %q: step %q has not finished when it runs", step.Name, ref)
+			}
+		}
+	}
+	return nil
+}
+
+func stepNamed(steps []Step, name string) bool {
+	for _, step := range steps {
+		if step.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+type stepResult struct {
+	step     Step
+	err      error
+	timedOut bool
+	attempts int
+}
+
+// runSteps runs each step, apart from the cleanup steps, once the steps it
+// depends on have succeeded, with up to max-parallel at once. Once a step
+// fails no more are started, and the running ones are cancelled if on-failure
+// is "cancel". Steps that fail are first retried as far as their retry allows.
+// Steps that run for longer than their timeout, or than the timeout of the
+// pipeline, are stopped and fail, as are all running steps if the pipeline is
+// cancelled. Steps whose when expression is false are skipped, which the
+// steps that depend on them count as finished. It returns why the pipeline
+// failed, or "" if the steps all succeeded.
+func (p *Pipeline) runSteps(env []string, masker *secretMasker, recorder *recorder, conditions *conditions) string {
+	steps, _ := splitCleanupSteps(p.definition.Steps)
+	maxParallel := p.definition.MaxParallel
+	if maxParallel == 0 {
+		maxParallel = runtime.NumCPU()
+	}
+	waiting := map[string]int{}
+	dependents := map[string][]string{}
+	for name, dependencies := range stepDependencies(steps) {
+		waiting[name] = len(dependencies)
+		for _, dependency := range dependencies {
+			dependents[dependency] = append(dependents[dependency], name)
+		}
+	}
+	started := map[string]bool{}
+	// ready returns the steps that can start, in the order they are defined.
+	ready := func() []Step {
+		var ready []Step
+		for _, step := range steps {
+			if !started[step.Name] && waiting[step.Name] == 0 {
+				ready = append(ready, step)
+			}
+		}
+		return ready
+	}
+
+	ctx, cancel := context.WithCancel(p.cancelled)
+	if p.definition.Timeout > 0 {
+		ctx, cancel = context.WithTimeout(p.cancelled, p.definition.Timeout)
+	}
+	defer cancel()
+	results := make(chan stepResult)
+	running := 0
+	failed := ""
+	for {
+		// Skipping a step can make the steps that depend on it ready.
+		for failed == "" {
+			skipped := false
+			for _, step := range ready() {
+				if running == maxParallel {
+					break
+				}
+				started[step.Name] = true
+				if !conditions.runs(step) {
+					skipStep(step, recorder, conditions)
+					for _, dependent := range dependents[step.Name] {
+						waiting[dependent]--
+					}
+					skipped = true
+					continue
+				}
+				running++
+				recorder.emit(StepStartEvent{BaseEvent{EventTime: time.Now()}, step.Name})
+				go func(step Step) {
+					results <- p.runAttempts(ctx, env, step, masker, recorder)
+				}(step)
+			}
+			if !skipped {
+				break
+			}
+		}
+		if running == 0 {
+			return failed
+		}
+		result := <-results
+		running--
+		if result.err != nil {
+			name := result.step.Name
+			now := time.Now()
+			reason := fmt.Sprintf("step '%s' failed", name)
+			switch {
+			case p.cancelled.Err() != nil:
+				recorder.emit(StepFailureEvent{BaseEvent{EventTime: now}, name, fmt.Sprintf("cancelled: %s", context.Cause(p.cancelled))})
+				reason = "cancelled"
+			case ctx.Err() == context.DeadlineExceeded:
+				recorder.emit(StepTimeoutEvent{BaseEvent{EventTime: now}, name, p.definition.Timeout, true})
+				reason = fmt.Sprintf("timed out after %s", p.definition.Timeout)
+			case result.timedOut:
+				recorder.emit(StepTimeoutEvent{BaseEvent{EventTime: now}, name, result.step.Timeout, false})
+				reason = fmt.Sprintf("step '%s' timed out after %s", name, result.step.Timeout)
+			case failed != "" && ctx.Err() != nil:
+				recorder.emit(StepFailureEvent{BaseEvent{EventTime: now}, name, fmt.Sprintf("cancelled after %s", failed)})
+			default:
+				recorder.emit(StepFailureEvent{BaseEvent{EventTime: now}, name, failureReason(result)})
+			}
+			conditions.results[name] = StatusFailed
+			if failed == "" {
+				failed = reason
+				if p.definition.OnFailure == OnFailureCancel {
+					cancel()
+				}
+			}
+			continue
+		}
+		recorder.emit(StepSuccessEvent{BaseEvent{EventTime: time.Now()}, result.step.Name})
+		recorder.stepSucceeded(result)
+		conditions.results[result.step.Name] = StatusSucceeded
+		for _, dependent := range dependents[result.step.Name] {
+			waiting[dependent]--
+		}
+	}
+}
+
+// skipStep records that a step does not run because of its when expression.
+func skipStep(step Step, recorder *recorder, conditions *conditions) {
+	recorder.emit(StepSkippedEvent{BaseEvent{EventTime: time.Now()}, step.Name, step.When})
+	conditions.results[step.Name] = statusSkipped
+}
+
+// failureReason returns why a step failed, and how many attempts it made if
+// it was retried.
+func failureReason(result stepResult) string {
+	if result.attempts > 1 {
+		return fmt.Sprintf("%s (after %d attempts)", result.err, result.attempts)
+	}
+	return result.err.Error()
+}
+
+// runCleanupSteps runs the cleanup steps one after another, each whether or
+// not the steps before it succeeded, unless its when expression is false.
+// They are not cancelled along with the pipeline, but are stopped if they run
+// for longer than their timeout. It returns why the first to fail failed, or
+// "" if they all succeeded.
+func (p *Pipeline) runCleanupSteps(env []string, masker *secretMasker, recorder *recorder, conditions *conditions) string {
+	_, steps := splitCleanupSteps(p.definition.Steps)
+	failed := ""
+	for _, step := range steps {
+		if !conditions.runs(step) {
+			skipStep(step, recorder, conditions)
+			continue
+		}
+		recorder.emit(StepStartEvent{BaseEvent{EventTime: time.Now()}, step.Name})
+		result := p.runAttempts(context.Background(), env, step, masker, recorder)
+		now := time.Now()
+		switch {
+		case result.err == nil:
+			recorder.emit(StepSuccessEvent{BaseEvent{EventTime: now}, step.Name})
+			recorder.stepSucceeded(result)
+			conditions.results[step.Name] = StatusSucceeded
+			continue
+		case result.timedOut:
+			recorder.emit(StepTimeoutEvent{BaseEvent{EventTime: now}, step.Name, step.Timeout, false})
+		default:
+			recorder.emit(StepFailureEvent{BaseEvent{EventTime: now}, step.Name, failureReason(result)})
+		}
+		conditions.results[step.Name] = StatusFailed
+		if failed == "" {
+			failed = fmt.Sprintf("step '%s' failed", step.Name)
+		}
+	}
+	return failed
+}
@@ -0,0 +1,75 @@
+package dcd
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestStepDependencies(t *testing.T) {
+	testCases := []struct {
+		steps    []Step
+		expected map[string][]string
+	}{
+		{
+			[]Step{{Name: "a"}, {Name: "b"}, {Name: "c"}},
+			map[string][]string{"b": {"a"}, "c": {"b"}},
+		},
+		{
+			[]Step{{Name: "a"}, {Name: "b"}, {Name: "c", DependsOn: []string{"a", "b"}}},
+			map[string][]string{"a": nil, "b": nil, "c": {"a", "b"}},
+		},
+	}
+
+	for _, tc := range testCases {
+		if got := stepDependencies(tc.steps); !reflect.DeepEqual(got, tc.expected) {
+			t.Errorf("Expected dependencies %v, got %v", tc.expected, got)
+		}
+	}
+}
+
+func TestValidateSteps(t *testing.T) {
+	testCases := []struct {
+		definition PipelineDefinition
+		expected   string
+	}{
+		{PipelineDefinition{Steps: []Step{{Name: "a"}, {Name: "b", DependsOn: []string{"a"}}}}, ""},
+		{PipelineDefinition{Steps: []Step{{Name: "a"}, {Name: "a"}}}, `invalid pipeline: more than one step is named "a"`},
+		{PipelineDefinition{Steps: []Step{{Name: "a", DependsOn: []string{"missing"}}}}, `invalid pipeline: step "a" depends on unknown step "missing"`},
+		{PipelineDefinition{Steps: []Step{{Name: "a", DependsOn: []string{"a"}}}}, "invalid pipeline: steps depend on each other: a -> a"},
+		{
+			PipelineDefinition{Steps: []Step{
+				{Name: "a", DependsOn: []string{"c"}},
+				{Name: "b", DependsOn: []string{"a"}},
+				{Name: "c", DependsOn: []string{"b"}},
+				{Name: "d"},
+			}},
+			"invalid pipeline: steps depend on each other: a -> c -> b -> a",
+		},
+		{PipelineDefinition{MaxParallel: -1}, "invalid max-parallel -1: must be at least 1"},
+		{PipelineDefinition{OnFailure: "ignore"}, `invalid on-failure "ignore": expected "wait" or "cancel"`},
+		{PipelineDefinition{Steps: []Step{{Name: "a"}, {Name: "b", Cleanup: true, DependsOn: []string{"a"}}}}, `invalid pipeline: cleanup step "b" cannot depend on other steps`},
+		{PipelineDefinition{Steps: []Step{{Name: "a", Cleanup: true}, {Name: "b", DependsOn: []string{"a"}}}}, `invalid pipeline: step "b" depends on cleanup step "a"`},
+		{PipelineDefinition{Steps: []Step{{Name: "a", Retry: RetryConfig{MaxAttempts: -1}}}}, `invalid retry for step "a": max-attempts must not be negative`},
+		{PipelineDefinition{Steps: []Step{{Name: "a"}, {Name: "b", When: `succeeded("a")`}}}, ""},
+		{PipelineDefinition{Steps: []Step{{Name: "a"}, {Name: "x"}, {Name: "b", DependsOn: []string{"x"}, When: `succeeded("a")`}}}, `invalid when for step "b": step "a" has not finished when it runs`},
+		{PipelineDefinition{Steps: []Step{{Name: "a", When: `skipped("c")`}, {Name: "c", Cleanup: true}}}, `invalid when for step "a": step "c" has not finished when it runs`},
+		{PipelineDefinition{Steps: []Step{{Name: "a"}, {Name: "b", DependsOn: []string{"a"}, When: `failed("a")`}}}, `invalid when for step "b": failed() is only valid on cleanup steps, as no other steps start once a step has failed`},
+		{PipelineDefinition{Steps: []Step{{Name: "a", When: `!failed()`}}}, `invalid when for step "a": failed() is only valid on cleanup steps, as no other steps start once a step has failed`},
+		{PipelineDefinition{Steps: []Step{{Name: "a"}, {Name: "c", Cleanup: true, When: `failed("a")`}}}, ""},
+		{PipelineDefinition{Steps: []Step{{Name: "a", Cleanup: true, When: `failed("missing")`}}}, `invalid when for step "a": unknown step "missing"`},
+		{PipelineDefinition{Steps: []Step{{Name: "a", When: `branch =`}}}, `invalid when for step "a": unexpected '='`},
+		{PipelineDefinition{Timeout: -time.Minute}, "invalid timeout -1m0s: must not be negative"},
+		{PipelineDefinition{Steps: []Step{{Name: "a", Timeout: -time.Second}}}, `invalid timeout -1s for step "a": must not be negative`},
+	}
+
+	for _, tc := range testCases {
+		got := ""
+		if err := validateSteps(&tc.definition); err != nil {
+			got = err.Error()
+		}
+		if got != tc.expected {
+			t.Errorf("Expected error %q, got %q", tc.expected, got)
+		}
+	}
+}
@@ -0,0 +1,730 @@
+// Package dcdtest has tests that any dcd.Backend is expected to pass.
+package dcdtest
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/progsoftware/dcd/internal/dcd"
+)
+
+// largeOutputSize is the size of the step output a backend must be able to
+// store in a single event.
+const largeOutputSize = 64 * 1024
+
+// TestBackend runs the conformance tests for a Backend. newBackend is called
+// for each test and must return a backend with an empty build history.
+func TestBackend(t *testing.T, newBackend func(t *testing.T) dcd.Backend) {
+	t.Run("BuildIDs", func(t *testing.T) { testBuildIDs(t, newBackend) })
+	t.Run("States", func(t *testing.T) { testStates(t, newBackend) })
+	t.Run("Events", func(t *testing.T) { testEvents(t, newBackend) })
+	t.Run("Queries", func(t *testing.T) { testQueries(t, newBackend) })
+	t.Run("Retention", func(t *testing.T) { testRetention(t, newBackend) })
+	t.Run("Errors", func(t *testing.T) { testErrors(t, newBackend) })
+}
+
+func testBuildIDs(t *testing.T, newBackend func(t *testing.T) dcd.Backend) {
+	t.Run("BuildIDsIncrement", func(t *testing.T) {
+		ctx := context.Background()
+		backend := newBackend(t)
+
+		first, err := backend.GetBuildID(ctx, "test-component")
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if first != 1 {
+			t.Errorf("Expected first build ID to be 1, got %d", first)
+		}
+		second, err := backend.GetBuildID(ctx, "test-component")
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if second != first+1 {
+			t.Errorf("Expected second build ID to be %d, got %d", first+1, second)
+		}
+	})
+
+	t.Run("BuildIDsArePerComponent", func(t *testing.T) {
+		ctx := context.Background()
+		backend := newBackend(t)
+
+		var ids []int64
+		for _, component := range []string{"first-component", "second-component", "first-component", "second-component"} {
+			id, err := backend.GetBuildID(ctx, component)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			ids = append(ids, id)
+		}
+		if expected := []int64{1, 1, 2, 2}; !reflect.DeepEqual(ids, expected) {
+			t.Errorf("Expected build IDs %v, got %v", expected, ids)
+		}
+	})
+
+	t.Run("ConcurrentBuildIDsAreUniqueAndIncreasing", func(t *testing.T) {
+		ctx := context.Background()
+		backend := newBackend(t)
+
+		const workers, perWorker = 10, 5
+		ids := make(chan int64, workers*perWorker)
+		var wg sync.WaitGroup
+		for i := 0; i < workers; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				var last int64
+				for j := 0; j < perWorker; j++ {
+					id, err := backend.GetBuildID(ctx, "test-component")
+					if err != nil {
+						t.Errorf("Unexpected error: %v", err)
+						return
+					}
+					if id <= last {
+						t.Errorf("Expected build ID after %d to be greater, got %d", last, id)
+					}
+					last = id
+					ids <- id
+				}
+			}()
+		}
+		wg.Wait()
+		close(ids)
+
+		seen := map[int64]bool{}
+		for id := range ids {
+			if seen[id] {
+				t.Errorf("Build ID %d was allocated twice", id)
+			}
+			seen[id] = true
+		}
+		// The sequence has no gaps.
+		for id := int64(1); id <= workers*perWorker; id++ {
+			if !seen[id] {
+				t.Errorf("Expected build ID %d to be allocated", id)
+			}
+		}
+	})
+}
+
+func testStates(t *testing.T, newBackend func(t *testing.T) dcd.Backend) {
+	t.Run("GetPipeline", func(t *testing.T) {
+		ctx := context.Background()
+		backend := newBackend(t)
+		state := newPipelineState(t, backend)
+		if err := backend.StartPipeline(ctx, state); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		state.Status = "succeeded"
+		state.EndTime = state.StartTime.Add(time.Minute)
+		if err := backend.PutPipeline(ctx, state); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+
+		got, err := backend.GetPipeline(ctx, state.Component, state.BuildID)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if got.BuildID != state.BuildID || got.Component != state.Component || got.GitSHA != state.GitSHA || got.Status != "succeeded" {
+			t.Errorf("Expected %+v, got %+v", state, got)
+		}
+		if !got.StartTime.Equal(state.StartTime) || !got.EndTime.Equal(state.EndTime) {
+			t.Errorf("Expected times %v-%v, got %v-%v", state.StartTime, state.EndTime, got.StartTime, got.EndTime)
+		}
+	})
+
+	t.Run("StatusTransitions", func(t *testing.T) {
+		ctx := context.Background()
+		backend := newBackend(t)
+
+		for _, final := range []string{dcd.StatusSucceeded, dcd.StatusFailed, dcd.StatusCancelled} {
+			state := newPipelineState(t, backend)
+			if err := backend.StartPipeline(ctx, state); err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			assertStatus(t, backend, state, dcd.StatusPending)
+
+			state.Status = dcd.StatusRunning
+			if err := backend.PutPipeline(ctx, state); err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			assertStatus(t, backend, state, dcd.StatusRunning)
+
+			state.Status = final
+			state.EndTime = state.StartTime.Add(time.Second)
+			if err := backend.PutPipeline(ctx, state); err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			assertStatus(t, backend, state, final)
+		}
+	})
+
+	t.Run("AbandonedBuildsCanFinish", func(t *testing.T) {
+		ctx := context.Background()
+		backend := newBackend(t)
+		state := newPipelineState(t, backend)
+		if err := backend.StartPipeline(ctx, state); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		state.Status = dcd.StatusAbandoned
+		if err := backend.PutPipeline(ctx, state); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		// The runner was only out of touch, e.g. with its events in the outbox.
+		state.Status = dcd.StatusSucceeded
+		if err := backend.PutPipeline(ctx, state); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		assertStatus(t, backend, state, dcd.StatusSucceeded)
+	})
+
+	t.Run("BuildsAreIndependent", func(t *testing.T) {
+		ctx := context.Background()
+		backend := newBackend(t)
+		first := newPipelineState(t, backend)
+		second := newPipelineState(t, backend)
+		// The same build ID in another component is a different build.
+		other := *first
+		other.Component = "other-component"
+		for _, state := range []*dcd.PipelineState{first, second, &other} {
+			if err := backend.StartPipeline(ctx, state); err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+		}
+
+		first.Status = dcd.StatusFailed
+		if err := backend.PutPipeline(ctx, first); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		assertStatus(t, backend, first, dcd.StatusFailed)
+		assertStatus(t, backend, second, dcd.StatusPending)
+		assertStatus(t, backend, &other, dcd.StatusPending)
+	})
+
+	t.Run("Versions", func(t *testing.T) {
+		ctx := context.Background()
+		backend := newBackend(t)
+		state := newPipelineState(t, backend)
+		if err := backend.StartPipeline(ctx, state); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if state.Version != 1 {
+			t.Fatalf("Expected a started build to be version 1, got %d", state.Version)
+		}
+		// A stale copy of the state cannot overwrite a later write.
+		stale := *state
+		state.Status = dcd.StatusRunning
+		if err := backend.PutPipeline(ctx, state); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if state.Version != 2 {
+			t.Fatalf("Expected version 2, got %d", state.Version)
+		}
+		stale.Status = dcd.StatusFailed
+		err := backend.PutPipeline(ctx, &stale)
+		conflict, ok := err.(*dcd.StateConflictError)
+		if !ok {
+			t.Fatalf("Expected *dcd.StateConflictError, got %T: %v", err, err)
+		}
+		if conflict.CurrentVersion != 2 || conflict.CurrentStatus != dcd.StatusRunning {
+			t.Errorf("Expected the conflict to be with running version 2, got %+v", conflict)
+		}
+		got, err := backend.GetPipeline(ctx, state.Component, state.BuildID)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if got.Version != 2 || got.Status != dcd.StatusRunning {
+			t.Errorf("Expected running version 2, got %s version %d", got.Status, got.Version)
+		}
+	})
+
+	t.Run("InvalidTransitions", func(t *testing.T) {
+		ctx := context.Background()
+		backend := newBackend(t)
+		for _, tc := range []struct{ from, to string }{
+			{dcd.StatusRunning, dcd.StatusPending},
+			{dcd.StatusSucceeded, dcd.StatusRunning},
+			{dcd.StatusFailed, dcd.StatusSucceeded},
+			{dcd.StatusSucceeded, dcd.StatusSucceeded},
+			{dcd.StatusAbandoned, dcd.StatusRunning},
+		} {
+			state := newPipelineState(t, backend)
+			if err := backend.StartPipeline(ctx, state); err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			state.Status = tc.from
+			if err := backend.PutPipeline(ctx, state); err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			state.Status = tc.to
+			err := backend.PutPipeline(ctx, state)
+			if _, ok := err.(*dcd.StateConflictError); !ok {
+				t.Errorf("Expected %s to %s to be a *dcd.StateConflictError, got %T: %v", tc.from, tc.to, err, err)
+			}
+			assertStatus(t, backend, state, tc.from)
+		}
+	})
+
+	t.Run("ConcurrentWrites", func(t *testing.T) {
+		ctx := context.Background()
+		backend := newBackend(t)
+		state := newPipelineState(t, backend)
+		if err := backend.StartPipeline(ctx, state); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		// Only one of several writers racing from the same version succeeds.
+		const writers = 8
+		var wg sync.WaitGroup
+		errs := make(chan error, writers)
+		for i := 0; i < writers; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				running := *state
+				running.Status = dcd.StatusRunning
+				errs <- backend.PutPipeline(ctx, &running)
+			}()
+		}
+		wg.Wait()
+		close(errs)
+		succeeded := 0
+		for err := range errs {
+			if err == nil {
+				succeeded++
+			} else if _, ok := err.(*dcd.StateConflictError); !ok {
+				t.Errorf("Expected *dcd.StateConflictError, got %T: %v", err, err)
+			}
+		}
+		if succeeded != 1 {
+			t.Errorf("Expected 1 write to succeed, got %d", succeeded)
+		}
+	})
+}
+
+func testEvents(t *testing.T, newBackend func(t *testing.T) dcd.Backend) {
+	t.Run("ListPipelineEvents", func(t *testing.T) {
+		ctx := context.Background()
+		backend := newBackend(t)
+		state := newPipelineState(t, backend)
+		if err := backend.StartPipeline(ctx, state); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		start := time.Now()
+		var events []dcd.Event
+		events = append(events, dcd.PipelineStartEvent{BaseEvent: dcd.BaseEvent{EventTime: start}, BuildID: state.BuildID})
+		for i := 0; i < 5; i++ {
+			events = append(events, dcd.StepOutputEvent{BaseEvent: dcd.BaseEvent{EventTime: start.Add(time.Duration(i) * time.Millisecond)}, StepName: "step", Output: fmt.Sprintf("line %d\n", i)})
+		}
+		events = append(events, dcd.PipelineSuccessEvent{BaseEvent: dcd.BaseEvent{EventTime: start.Add(time.Second)}})
+		for _, event := range events {
+			if err := backend.PutPipelineEvent(ctx, state.Component, state.BuildID, event); err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+		}
+
+		var paged []dcd.Event
+		cursor := ""
+		for {
+			page, err := backend.ListPipelineEvents(ctx, state.Component, state.BuildID, cursor, 3)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if len(page.Events) > 3 {
+				t.Fatalf("Expected at most 3 events per page, got %d", len(page.Events))
+			}
+			if len(page.Events) == 0 {
+				break
+			}
+			paged = append(paged, page.Events...)
+			cursor = page.Cursor
+		}
+		assertEventsEqual(t, events, paged)
+
+		var streamed []dcd.Event
+		if err := dcd.StreamPipelineEvents(ctx, backend, state.Component, state.BuildID, func(event dcd.Event) error {
+			streamed = append(streamed, event)
+			return nil
+		}); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		assertEventsEqual(t, events, streamed)
+
+		// Events written after a page was read are picked up from its cursor.
+		late := dcd.StepOutputEvent{BaseEvent: dcd.BaseEvent{EventTime: start.Add(2 * time.Second)}, StepName: "step", Output: "late\n"}
+		if err := backend.PutPipelineEvent(ctx, state.Component, state.BuildID, late); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		page, err := backend.ListPipelineEvents(ctx, state.Component, state.BuildID, cursor, 0)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		assertEventsEqual(t, []dcd.Event{late}, page.Events)
+	})
+
+	t.Run("EventOrder", func(t *testing.T) {
+		ctx := context.Background()
+		backend := newBackend(t)
+		state := newPipelineState(t, backend)
+		if err := backend.StartPipeline(ctx, state); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		// Events of interleaved steps, several sharing a timestamp, must come
+		// back in the order they were written.
+		start := time.Now()
+		var events []dcd.Event
+		for i := 0; i < 30; i++ {
+			events = append(events, dcd.StepOutputEvent{
+				BaseEvent: dcd.BaseEvent{EventTime: start.Add(time.Duration(i/3) * time.Millisecond)},
+				StepName:  fmt.Sprintf("step-%d", i%2),
+				Output:    fmt.Sprintf("line %d\n", i),
+			})
+		}
+		putEvents(t, backend, state, events)
+
+		assertEventsEqual(t, events, streamEvents(t, backend, state))
+	})
+
+	t.Run("BatchedEvents", func(t *testing.T) {
+		ctx := context.Background()
+		backend := newBackend(t)
+		if _, ok := backend.(dcd.BatchEventWriter); !ok {
+			t.Skip("backend does not write events in batches")
+		}
+		state := newPipelineState(t, backend)
+		if err := backend.StartPipeline(ctx, state); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		start := time.Now()
+		var events []dcd.Event
+		for i := 0; i < 60; i++ {
+			events = append(events, dcd.StepOutputEvent{
+				BaseEvent: dcd.BaseEvent{EventTime: start.Add(time.Duration(i/10) * time.Millisecond)},
+				StepName:  "step",
+				Output:    fmt.Sprintf("line %d\n", i),
+			})
+		}
+		if err := dcd.PutPipelineEvents(ctx, backend, state.Component, state.BuildID, events[:50]); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if err := dcd.PutPipelineEvents(ctx, backend, state.Component, state.BuildID, events[50:]); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+
+		assertEventsEqual(t, events, streamEvents(t, backend, state))
+	})
+
+	t.Run("EventsOfOtherBuilds", func(t *testing.T) {
+		ctx := context.Background()
+		backend := newBackend(t)
+		first := newPipelineState(t, backend)
+		second := newPipelineState(t, backend)
+		for _, state := range []*dcd.PipelineState{first, second} {
+			if err := backend.StartPipeline(ctx, state); err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+		}
+		firstEvents := []dcd.Event{dcd.PipelineStartEvent{BaseEvent: dcd.BaseEvent{EventTime: time.Now()}, BuildID: first.BuildID}}
+		secondEvents := []dcd.Event{dcd.PipelineStartEvent{BaseEvent: dcd.BaseEvent{EventTime: time.Now()}, BuildID: second.BuildID}}
+		putEvents(t, backend, first, firstEvents)
+		putEvents(t, backend, second, secondEvents)
+
+		assertEventsEqual(t, firstEvents, streamEvents(t, backend, first))
+		assertEventsEqual(t, secondEvents, streamEvents(t, backend, second))
+	})
+
+	t.Run("LargeOutput", func(t *testing.T) {
+		ctx := context.Background()
+		backend := newBackend(t)
+		state := newPipelineState(t, backend)
+		if err := backend.StartPipeline(ctx, state); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		output := strings.Repeat("a long line of output from a noisy step\n", largeOutputSize/40)
+		events := []dcd.Event{dcd.StepOutputEvent{BaseEvent: dcd.BaseEvent{EventTime: time.Now()}, StepName: "step", Output: output}}
+		putEvents(t, backend, state, events)
+
+		assertEventsEqual(t, events, streamEvents(t, backend, state))
+	})
+
+	t.Run("ManyEvents", func(t *testing.T) {
+		ctx := context.Background()
+		backend := newBackend(t)
+		state := newPipelineState(t, backend)
+		if err := backend.StartPipeline(ctx, state); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		// More than fit in a page of ListPipelineEvents by default.
+		start := time.Now()
+		var events []dcd.Event
+		for i := 0; i < dcd.DefaultEventPageSize*2+1; i++ {
+			events = append(events, dcd.StepOutputEvent{
+				BaseEvent: dcd.BaseEvent{EventTime: start.Add(time.Duration(i) * time.Microsecond)},
+				StepName:  "step",
+				Output:    fmt.Sprintf("line %d\n", i),
+			})
+		}
+		putEvents(t, backend, state, events)
+
+		assertEventsEqual(t, events, streamEvents(t, backend, state))
+	})
+}
+
+func testQueries(t *testing.T, newBackend func(t *testing.T) dcd.Backend) {
+	t.Run("ListBuilds", func(t *testing.T) {
+		ctx := context.Background()
+		backend := newBackend(t)
+		base := time.Now()
+		for i, build := range []struct{ component, sha, status string }{
+			{"test-component", "aaa111", "succeeded"},
+			{"test-component", "bbb222", "failed"},
+			{"other-component", "ccc333", "succeeded"},
+			{"test-component", "aaa444", "succeeded"},
+			{"test-component", "ddd555", "failed"},
+			{"test-component", "aaa666", "running"},
+		} {
+			state := newPipelineState(t, backend)
+			state.Component = build.component
+			state.GitSHA = build.sha
+			state.Status = build.status
+			state.StartTime = base.Add(time.Duration(i) * time.Second)
+			if build.status == "running" {
+				state.Heartbeat = base.Add(10 * time.Second)
+			}
+			if err := backend.StartPipeline(ctx, state); err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+		}
+
+		testCases := []struct {
+			name     string
+			query    dcd.BuildQuery
+			expected [][]string // git SHAs on each page
+		}{
+			{"all", dcd.BuildQuery{Component: "test-component"}, [][]string{{"aaa666", "ddd555", "aaa444", "bbb222", "aaa111"}}},
+			{"paged", dcd.BuildQuery{Component: "test-component", Limit: 2}, [][]string{{"aaa666", "ddd555"}, {"aaa444", "bbb222"}, {"aaa111"}}},
+			{"status", dcd.BuildQuery{Component: "test-component", Status: "failed"}, [][]string{{"ddd555", "bbb222"}}},
+			{"sha prefix paged", dcd.BuildQuery{Component: "test-component", GitSHA: "aaa", Limit: 2}, [][]string{{"aaa666", "aaa444"}, {"aaa111"}}},
+			{"started after", dcd.BuildQuery{Component: "test-component", StartedAfter: base.Add(3 * time.Second)}, [][]string{{"aaa666", "ddd555", "aaa444"}}},
+			{"started between", dcd.BuildQuery{Component: "test-component", StartedAfter: base.Add(time.Second), StartedBefore: base.Add(4 * time.Second), Limit: 1}, [][]string{{"aaa444"}, {"bbb222"}}},
+			{"seen before", dcd.BuildQuery{Component: "test-component", SeenBefore: base.Add(6 * time.Second)}, [][]string{{"ddd555", "aaa444", "bbb222", "aaa111"}}},
+			{"running with heartbeat", dcd.BuildQuery{Component: "test-component", Status: "running", SeenBefore: base.Add(11 * time.Second)}, [][]string{{"aaa666"}}},
+			{"other component", dcd.BuildQuery{Component: "other-component"}, [][]string{{"ccc333"}}},
+			{"unknown component", dcd.BuildQuery{Component: "unknown-component"}, [][]string{{}}},
+		}
+		for _, tc := range testCases {
+			query := tc.query
+			var pages [][]string
+			for {
+				page, err := backend.ListBuilds(ctx, &query)
+				if err != nil {
+					t.Fatalf("%s: unexpected error: %v", tc.name, err)
+				}
+				shas := []string{}
+				for _, build := range page.Builds {
+					shas = append(shas, build.GitSHA)
+				}
+				// A final empty page is allowed when the previous page was full.
+				if len(shas) > 0 || len(pages) == 0 {
+					pages = append(pages, shas)
+				}
+				if page.NextPageToken == "" {
+					break
+				}
+				query.PageToken = page.NextPageToken
+			}
+			if !reflect.DeepEqual(pages, tc.expected) {
+				t.Errorf("%s: expected pages %v, got %v", tc.name, tc.expected, pages)
+			}
+		}
+	})
+}
+
+func testRetention(t *testing.T, newBackend func(t *testing.T) dcd.Backend) {
+	t.Run("PruneOutput", func(t *testing.T) {
+		ctx := context.Background()
+		backend := newBackend(t)
+		pruner, ok := backend.(dcd.OutputPruner)
+		if !ok {
+			t.Skip("backend does not prune output")
+		}
+		cutoff := time.Now().Add(-24 * time.Hour)
+		builds := map[string]*dcd.PipelineState{}
+		for _, build := range []struct {
+			name     string
+			age      time.Duration
+			status   string
+			deployed bool
+		}{
+			{"old", 48 * time.Hour, dcd.StatusSucceeded, false},
+			{"old deployment", 48 * time.Hour, dcd.StatusSucceeded, true},
+			{"old running", 48 * time.Hour, dcd.StatusRunning, false},
+			{"new", time.Hour, dcd.StatusFailed, false},
+		} {
+			state := newPipelineState(t, backend)
+			state.StartTime = time.Now().Add(-build.age)
+			state.Status = build.status
+			state.Deployed = build.deployed
+			if err := backend.StartPipeline(ctx, state); err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			putEvents(t, backend, state, []dcd.Event{
+				dcd.StepStartEvent{BaseEvent: dcd.BaseEvent{EventTime: state.StartTime}, StepName: "build"},
+				dcd.StepOutputEvent{BaseEvent: dcd.BaseEvent{EventTime: state.StartTime.Add(time.Millisecond)}, StepName: "build", Output: "line 1\n"},
+				dcd.StepOutputEvent{BaseEvent: dcd.BaseEvent{EventTime: state.StartTime.Add(2 * time.Millisecond)}, StepName: "build", Output: "line 2\n"},
+				dcd.StepSuccessEvent{BaseEvent: dcd.BaseEvent{EventTime: state.StartTime.Add(3 * time.Millisecond)}, StepName: "build"},
+			})
+			builds[build.name] = state
+		}
+
+		deleted, err := pruner.PruneOutput(ctx, "test-component", cutoff, true)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if deleted != 2 {
+			t.Errorf("Expected 2 events to be deleted, got %d", deleted)
+		}
+		for name, expected := range map[string]int{"old": 2, "old deployment": 4, "old running": 4, "new": 4} {
+			events := streamEvents(t, backend, builds[name])
+			if len(events) != expected {
+				t.Errorf("Expected %d events of the %s build, got %d", expected, name, len(events))
+			}
+		}
+		assertStatus(t, backend, builds["old"], dcd.StatusSucceeded)
+
+		// Deployments are only kept when asked to.
+		if deleted, err = pruner.PruneOutput(ctx, "test-component", cutoff, false); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if deleted != 2 {
+			t.Errorf("Expected the 2 events of the deployment to be deleted, got %d", deleted)
+		}
+	})
+}
+
+func testErrors(t *testing.T, newBackend func(t *testing.T) dcd.Backend) {
+	t.Run("GetPipelineNotFound", func(t *testing.T) {
+		backend := newBackend(t)
+
+		_, err := backend.GetPipeline(context.Background(), "test-component", 12345)
+		if _, ok := err.(*dcd.BuildNotFoundError); !ok {
+			t.Fatalf("Expected *dcd.BuildNotFoundError, got %T: %v", err, err)
+		}
+	})
+
+	t.Run("PutPipelineNotStarted", func(t *testing.T) {
+		backend := newBackend(t)
+		state := newPipelineState(t, backend)
+
+		err := backend.PutPipeline(context.Background(), state)
+		if _, ok := err.(*dcd.BuildNotFoundError); !ok {
+			t.Fatalf("Expected *dcd.BuildNotFoundError, got %T: %v", err, err)
+		}
+	})
+
+	t.Run("StartPipelineTwice", func(t *testing.T) {
+		ctx := context.Background()
+		backend := newBackend(t)
+		state := newPipelineState(t, backend)
+
+		if err := backend.StartPipeline(ctx, state); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		err := backend.StartPipeline(ctx, state)
+		if _, ok := err.(*dcd.BuildExistsError); !ok {
+			t.Fatalf("Expected *dcd.BuildExistsError, got %T: %v", err, err)
+		}
+	})
+
+	t.Run("ListBuildsRequiresComponent", func(t *testing.T) {
+		backend := newBackend(t)
+
+		if _, err := backend.ListBuilds(context.Background(), &dcd.BuildQuery{}); err == nil {
+			t.Fatalf("Expected error, got nil")
+		}
+	})
+
+	t.Run("NoEventsForUnknownBuild", func(t *testing.T) {
+		backend := newBackend(t)
+
+		page, err := backend.ListPipelineEvents(context.Background(), "test-component", 12345, "", 0)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if len(page.Events) != 0 {
+			t.Errorf("Expected no events, got %d", len(page.Events))
+		}
+	})
+}
+
+func assertStatus(t *testing.T, backend dcd.Backend, state *dcd.PipelineState, expected string) {
+	t.Helper()
+	got, err := backend.GetPipeline(context.Background(), state.Component, state.BuildID)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if got.Status != expected {
+		t.Errorf("Expected build %d of %s to be %s, got %s", state.BuildID, state.Component, expected, got.Status)
+	}
+}
+
+func putEvents(t *testing.T, backend dcd.Backend, state *dcd.PipelineState, events []dcd.Event) {
+	t.Helper()
+	for _, event := range events {
+		if err := backend.PutPipelineEvent(context.Background(), state.Component, state.BuildID, event); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+}
+
+func streamEvents(t *testing.T, backend dcd.Backend, state *dcd.PipelineState) []dcd.Event {
+	t.Helper()
+	var events []dcd.Event
+	if err := dcd.StreamPipelineEvents(context.Background(), backend, state.Component, state.BuildID, func(event dcd.Event) error {
+		events = append(events, event)
+		return nil
+	}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	return events
+}
+
+// assertEventsEqual compares events by their wire format, as events read back
+// from a backend lose the monotonic clock reading of their time.
+func assertEventsEqual(t *testing.T, expected, actual []dcd.Event) {
+	t.Helper()
+	if len(expected) != len(actual) {
+		t.Fatalf("Expected %d events, got %d", len(expected), len(actual))
+	}
+	for i := range expected {
+		expectedData, err := dcd.MarshalEvent(expected[i])
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		actualData, err := dcd.MarshalEvent(actual[i])
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if string(expectedData) != string(actualData) {
+			t.Errorf("Expected event %d to be %s, got %s", i, expectedData, actualData)
+		}
+	}
+}
+
+func newPipelineState(t *testing.T, backend dcd.Backend) *dcd.PipelineState {
+	t.Helper()
+	buildID, err := backend.GetBuildID(context.Background(), "test-component")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	return &dcd.PipelineState{
+		BuildID:   buildID,
+		Component: "test-component",
+		GitSHA:    "test-git-sha",
+		Status:    "pending",
+		StartTime: time.Now(),
+	}
+}
@@ -0,0 +1,97 @@
+package dcd
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+const (
+	// EnvModeInherit gives steps the whole environment of dcd.
+	EnvModeInherit = "inherit"
+	// EnvModeAllowlist gives steps only the variables of the environment of
+	// dcd that are allowed, so that builds do not depend on whatever happens
+	// to be set on the machine running them.
+	EnvModeAllowlist = "allowlist"
+)
+
+// EnvConfig controls which variables of the environment of dcd steps get,
+// on top of global-env, secrets and the variables set by dcd.
+type EnvConfig struct {
+	Mode  string   `yaml:"mode"`  // EnvModeInherit (the default) or EnvModeAllowlist
+	Allow []string `yaml:"allow"` // names, or prefixes ending in *, e.g. AWS_*
+	// RecordNames records the names of the variables in the build as well as
+	// the hash of the environment.
+	RecordNames bool `yaml:"record-names"`
+}
+
+func (c *EnvConfig) validate() error {
+	switch c.Mode {
+	case "", EnvModeInherit:
+		if len(c.Allow) > 0 {
+			return fmt.Errorf("invalid env: allow is only used with mode %q", EnvModeAllowlist)
+		}
+	case EnvModeAllowlist:
+	default:
+		return fmt.Errorf("invalid env: unknown mode %q (expected %q or %q)", c.Mode, EnvModeInherit, EnvModeAllowlist)
+	}
+	return nil
+}
+
+// hostEnv returns the variables of environ, the environment of dcd, that
+// steps get.
+func (c *EnvConfig) hostEnv(environ []string) []string {
+	if c.Mode != EnvModeAllowlist {
+		return environ
+	}
+	var env []string
+	for _, entry := range environ {
+		name, _, _ := strings.Cut(entry, "=")
+		if c.allows(name) {
+			env = append(env, entry)
+		}
+	}
+	return env
+}
+
+func (c *EnvConfig) allows(name string) bool {
+	for _, allowed := range c.Allow {
+		if allowed == name {
+			return true
+		}
+		if prefix, ok := strings.CutSuffix(allowed, "*"); ok && strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// envFingerprint returns a hash of the variables in env, with later entries
+// overriding earlier ones, and their sorted names. The values of the variables
+// named in secrets are left out of the hash so that it cannot be used to guess
+// them.
+func envFingerprint(env []string, secrets []string) (string, []string) {
+	values := map[string]string{}
+	for _, entry := range env {
+		name, value, _ := strings.Cut(entry, "=")
+		values[name] = value
+	}
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range secrets {
+		if _, ok := values[name]; ok {
+			values[name] = secretMask
+		}
+	}
+	hash := sha256.New()
+	for _, name := range names {
+		value := values[name]
+		fmt.Fprintf(hash, "%s=%q\n", name, value)
+	}
+	return hex.EncodeToString(hash.Sum(nil)), names
+}
@@ -0,0 +1,64 @@
+package dcd
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestEnvConfigHostEnv(t *testing.T) {
+	environ := []string{"PATH=/bin", "HOME=/home/dev", "AWS_PROFILE=dev", "AWS_REGION=eu-west-2", "EDITOR=vi"}
+
+	testCases := []struct {
+		config   EnvConfig
+		expected []string
+	}{
+		{EnvConfig{}, environ},
+		{EnvConfig{Mode: EnvModeInherit}, environ},
+		{EnvConfig{Mode: EnvModeAllowlist}, nil},
+		{EnvConfig{Mode: EnvModeAllowlist, Allow: []string{"PATH", "AWS_*"}}, []string{"PATH=/bin", "AWS_PROFILE=dev", "AWS_REGION=eu-west-2"}},
+	}
+
+	for _, tc := range testCases {
+		if got := tc.config.hostEnv(environ); !reflect.DeepEqual(got, tc.expected) {
+			t.Errorf("Expected %+v to give %v, got %v", tc.config, tc.expected, got)
+		}
+	}
+}
+
+func TestEnvConfigValidate(t *testing.T) {
+	testCases := []struct {
+		config      EnvConfig
+		expectError bool
+	}{
+		{EnvConfig{}, false},
+		{EnvConfig{Mode: EnvModeAllowlist, Allow: []string{"PATH"}}, false},
+		{EnvConfig{Allow: []string{"PATH"}}, true},
+		{EnvConfig{Mode: "isolated"}, true},
+	}
+
+	for _, tc := range testCases {
+		if err := tc.config.validate(); (err != nil) != tc.expectError {
+			t.Errorf("Expected an error for %+v: %v, got %v", tc.config, tc.expectError, err)
+		}
+	}
+}
+
+func TestEnvFingerprint(t *testing.T) {
+	// Given
+	secrets := []string{"TOKEN", "PASSWORD"}
+	hash, names := envFingerprint([]string{"B=2", "A=1", "A=override", "TOKEN=one", "PASSWORD=first"}, secrets)
+
+	// Then
+	if expected := []string{"A", "B", "PASSWORD", "TOKEN"}; !reflect.DeepEqual(names, expected) {
+		t.Errorf("Expected names %v, got %v", expected, names)
+	}
+	if reordered, _ := envFingerprint([]string{"PASSWORD=first", "TOKEN=one", "A=override", "B=2"}, secrets); reordered != hash {
+		t.Errorf("Expected the hash not to depend on the order of the environment")
+	}
+	if rotated, _ := envFingerprint([]string{"B=2", "A=override", "TOKEN=two", "PASSWORD=second"}, secrets); rotated != hash {
+		t.Errorf("Expected the hash not to depend on the values of secrets")
+	}
+	if changed, _ := envFingerprint([]string{"B=3", "A=override", "TOKEN=one", "PASSWORD=first"}, secrets); changed == hash {
+		t.Errorf("Expected the hash to change with the value of a variable")
+	}
+}
@@ -0,0 +1,419 @@
+package dcd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+	"time"
+)
+
+const (
+	backendWriteAttempts = 4
+	backendRetryDelay    = 100 * time.Millisecond
+	backendMaxRetryDelay = 5 * time.Second
+
+	// eventBatchSize is the most events written to the backend at once.
+	eventBatchSize = 25
+	// eventBatchInterval is how long the writer waits for more events to
+	// arrive before writing a batch.
+	eventBatchInterval = 100 * time.Millisecond
+	// maxCoalescedOutput is the most step output combined into one event.
+	maxCoalescedOutput = 32 * 1024
+	// eventFlushTimeout is how long closing the writer waits for queued
+	// writes to finish before giving up on them.
+	eventFlushTimeout = 30 * time.Second
+)
+
+// eventWriter writes the events and state of a build to the backend in the
+// background, in the order they were queued. Events are written in batches,
+// with consecutive output of the same step combined into one event.
+//
+// If there is an outbox, the writer goes offline when a write fails and
+// records the rest of the build in the outbox instead.
+//
+// If there is an archive, the output of each step is spooled to a temporary
+// file rather than written to the backend, and archived once the step
+// finishes, with only a reference to it and its tail written to the backend.
+type eventWriter struct {
+	backend     Backend
+	outbox      *Outbox
+	archive     LogArchive
+	logs        map[string]*stepLog // output spooled for the archive, by step
+	provisional bool
+	state       PipelineState // the state last written, to the outbox once offline
+	offline     bool
+	report      func(Event)
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wake   chan struct{}
+	done   chan struct{}
+
+	mu     sync.Mutex
+	queue  []writeItem
+	closed bool
+}
+
+// writeItem is either an event or a snapshot of the build state.
+type writeItem struct {
+	event Event
+	state *PipelineState
+}
+
+// newEventWriter starts a writer for a build, which is offline from the start
+// if offlineReason is set. Failed writes and going offline are passed to report.
+func newEventWriter(ctx context.Context, backend Backend, outbox *Outbox, archive LogArchive, state PipelineState, provisional bool, offlineReason error, report func(Event)) *eventWriter {
+	ctx, cancel := context.WithCancel(ctx)
+	w := &eventWriter{
+		backend:     backend,
+		outbox:      outbox,
+		archive:     archive,
+		logs:        map[string]*stepLog{},
+		provisional: provisional,
+		state:       state,
+		report:      report,
+		ctx:         ctx,
+		cancel:      cancel,
+		wake:        make(chan struct{}, 1),
+		done:        make(chan struct{}),
+	}
+	if offlineReason != nil {
+		w.goOffline(offlineReason)
+	}
+	go w.run()
+	return w
+}
+
+// writeEvent queues an event without waiting for it to be written.
+func (w *eventWriter) writeEvent(event Event) {
+	w.enqueue(writeItem{event: event})
+}
+
+// writeState queues a write of the build state, after any events already queued.
+func (w *eventWriter) writeState(state PipelineState) {
+	w.enqueue(writeItem{state: &state})
+}
+
+func (w *eventWriter) enqueue(item writeItem) {
+	w.mu.Lock()
+	w.queue = append(w.queue, item)
+	w.mu.Unlock()
+	select {
+	case w.wake <- struct{}{}:
+	default:
+	}
+}
+
+// close waits for queued writes to finish, giving up on any left after
+// eventFlushTimeout.
+func (w *eventWriter) close() {
+	w.mu.Lock()
+	w.closed = true
+	w.mu.Unlock()
+	select {
+	case w.wake <- struct{}{}:
+	default:
+	}
+	timer := time.AfterFunc(eventFlushTimeout, w.cancel)
+	defer timer.Stop()
+	<-w.done
+	w.cancel()
+	// Output of steps that never finished is not archived.
+	for _, log := range w.logs {
+		log.remove()
+	}
+}
+
+func (w *eventWriter) run() {
+	defer close(w.done)
+	for {
+		w.mu.Lock()
+		items := w.queue
+		w.queue = nil
+		closed := w.closed
+		w.mu.Unlock()
+
+		if len(items) > 0 {
+			w.write(items)
+			continue
+		}
+		if closed {
+			return
+		}
+		<-w.wake
+		// Let more events arrive so they can be written together, unless
+		// everything is being flushed.
+		w.mu.Lock()
+		closed = w.closed
+		w.mu.Unlock()
+		if !closed {
+			time.Sleep(eventBatchInterval)
+		}
+	}
+}
+
+// write writes queued items in order, events in batches and states on their own.
+func (w *eventWriter) write(items []writeItem) {
+	var batch []Event
+	flush := func() {
+		if len(batch) > 0 {
+			w.writeEvents(batch)
+			batch = nil
+		}
+	}
+	add := func(event Event) {
+		if len(batch) > 0 {
+			if combined, ok := coalesceOutput(batch[len(batch)-1], event); ok {
+				batch[len(batch)-1] = combined
+				return
+			}
+		}
+		if len(batch) == eventBatchSize {
+			flush()
+		}
+		batch = append(batch, event)
+	}
+	for i, item := range items {
+		if w.ctx.Err() != nil {
+			w.reportError(
+				fmt.Sprintf("write %d queued events and states", len(batch)+len(items)-i),
+				fmt.Errorf("gave up flushing the build history: %w", w.ctx.Err()),
+			)
+			return
+		}
+		if item.state != nil {
+			flush()
+			w.writeStateNow(item.state)
+			continue
+		}
+		for _, event := range w.archiveOutput(item.event) {
+			add(event)
+		}
+	}
+	flush()
+}
+
+// archiveOutput holds back the output of steps, returning the events to write
+// in place of the event: a step's output, or a reference to it once archived,
+// goes before the result of the step.
+func (w *eventWriter) archiveOutput(event Event) []Event {
+	// Provisional build IDs are not unique enough to archive under.
+	if w.archive == nil || w.provisional {
+		return []Event{event}
+	}
+	switch e := event.(type) {
+	case StepOutputEvent:
+		return w.spoolOutput(e)
+	case StepSuccessEvent:
+		return append(w.archiveLog(e.StepName), event)
+	case StepFailureEvent:
+		return append(w.archiveLog(e.StepName), event)
+	case StepTimeoutEvent:
+		return append(w.archiveLog(e.StepName), event)
+	case StepRetryEvent:
+		return append(w.archiveLog(e.StepName), event)
+	case PipelineSuccessEvent, PipelineFailureEvent, PipelineCancelledEvent:
+		var events []Event
+		for step := range w.logs {
+			events = append(events, w.archiveLog(step)...)
+		}
+		return append(events, event)
+	}
+	return []Event{event}
+}
+
+// spoolOutput adds output to the log of its step. Output that cannot be
+// spooled is written to the backend instead, with only the tail of what came
+// before it.
+func (w *eventWriter) spoolOutput(event StepOutputEvent) []Event {
+	log, ok := w.logs[event.StepName]
+	if !ok {
+		var err error
+		if log, err = newStepLog(event.EventTime); err != nil {
+			w.reportError(fmt.Sprintf("archive the output of %s", event.StepName), err)
+			return []Event{event}
+		}
+		w.logs[event.StepName] = log
+	}
+	if err := log.write(event.Output); err != nil {
+		w.reportError(fmt.Sprintf("archive the output of %s", event.StepName), err)
+		log.remove()
+		delete(w.logs, event.StepName)
+		return splitOutput(event.StepName, log.start, logTail(string(log.tail)))
+	}
+	return nil
+}
+
+// archiveLog archives the output of a step, returning the event referring to
+// it. Short output, and output that could not be archived, is returned as
+// output events instead.
+func (w *eventWriter) archiveLog(step string) []Event {
+	log, ok := w.logs[step]
+	if !ok {
+		return nil
+	}
+	delete(w.logs, step)
+	defer log.remove()
+	if log.size <= archiveTailSize {
+		return splitOutput(step, log.start, string(log.tail))
+	}
+	data, err := log.compressed()
+	if err != nil {
+		w.reportError(fmt.Sprintf("archive the output of %s", step), err)
+		return splitOutput(step, log.start, logTail(string(log.tail)))
+	}
+	key := archiveKey(w.state.Component, w.state.BuildID, step, log.start)
+	var location string
+	err = retry(w.ctx, func() error {
+		location, err = w.archive.PutLog(w.ctx, key, data)
+		return err
+	})
+	if err != nil {
+		w.reportError(fmt.Sprintf("archive the output of %s", step), err)
+		return w.unarchivedOutput(step, log, data)
+	}
+	// Events are listed in time order, so the reference is stamped with when
+	// it is written, for followers to see it.
+	return []Event{StepOutputArchivedEvent{
+		BaseEvent:   BaseEvent{EventTime: time.Now()},
+		StepName:    step,
+		Location:    location,
+		Size:        log.size,
+		Tail:        logTail(string(log.tail)),
+		OutputStart: log.start,
+	}}
+}
+
+// unarchivedOutput returns the output of a step that could not be archived as
+// output events, so that it is not lost.
+func (w *eventWriter) unarchivedOutput(step string, log *stepLog, data []byte) []Event {
+	output, err := decompressLog(data)
+	if err != nil {
+		w.reportError(fmt.Sprintf("read the spooled output of %s", step), err)
+		return splitOutput(step, log.start, logTail(string(log.tail)))
+	}
+	return splitOutput(step, log.start, output)
+}
+
+func (w *eventWriter) writeEvents(events []Event) {
+	write := func(backend Backend) error {
+		return PutPipelineEvents(w.ctx, backend, w.state.Component, w.state.BuildID, events)
+	}
+	operation := fmt.Sprintf("write %d events", len(events))
+	if len(events) == 1 {
+		operation = fmt.Sprintf("write %s", reflect.TypeOf(events[0]).Name())
+	}
+	w.writeWithOutbox(operation, write)
+}
+
+func (w *eventWriter) writeStateNow(state *PipelineState) {
+	w.writeWithOutbox(fmt.Sprintf("update pipeline status to %s", state.Status), func(backend Backend) error {
+		state.Version = w.state.Version
+		err := backend.PutPipeline(w.ctx, state)
+		// An earlier attempt may have been written without the response
+		// arriving, so try again against the current version as long as the
+		// build can still change to this status.
+		var conflict *StateConflictError
+		if errors.As(err, &conflict) && validTransition(conflict.CurrentStatus, state.Status) {
+			state.Version = conflict.CurrentVersion
+			err = backend.PutPipeline(w.ctx, state)
+		}
+		if err == nil {
+			w.state = *state
+		}
+		return err
+	})
+}
+
+// writeWithOutbox writes to the backend, retrying, or to the outbox once
+// offline. Writes that fail are reported.
+func (w *eventWriter) writeWithOutbox(operation string, write func(Backend) error) {
+	if !w.offline {
+		err := retry(w.ctx, func() error {
+			return write(w.backend)
+		})
+		if err == nil {
+			return
+		}
+		// A conflict means another process changed the build, not that the
+		// backend is unavailable.
+		var conflict *StateConflictError
+		if w.outbox == nil || w.ctx.Err() != nil || errors.As(err, &conflict) {
+			w.reportError(operation, err)
+			return
+		}
+		w.goOffline(err)
+	}
+	if err := write(w.outbox.backend(w.provisional)); err != nil {
+		w.reportError(operation+" to the outbox", err)
+	}
+}
+
+// goOffline records the rest of the build in the outbox, starting with its
+// current state.
+func (w *eventWriter) goOffline(reason error) {
+	w.offline = true
+	w.report(BackendOfflineEvent{
+		BaseEvent: BaseEvent{EventTime: time.Now()},
+		Directory: w.outbox.Dir(),
+		Reason:    reason.Error(),
+	})
+	if err := w.outbox.backend(w.provisional).StartPipeline(w.ctx, &w.state); err != nil {
+		w.reportError("write pipeline state to the outbox", err)
+	}
+}
+
+func (w *eventWriter) reportError(operation string, err error) {
+	w.report(BackendErrorEvent{
+		BaseEvent: BaseEvent{EventTime: time.Now()},
+		Operation: operation,
+		Reason:    err.Error(),
+	})
+}
+
+// coalesceOutput combines consecutive output of the same step into one event,
+// keeping the time of the first.
+func coalesceOutput(previous, next Event) (Event, bool) {
+	first, ok := previous.(StepOutputEvent)
+	if !ok {
+		return nil, false
+	}
+	second, ok := next.(StepOutputEvent)
+	if !ok || first.StepName != second.StepName || len(first.Output)+len(second.Output) > maxCoalescedOutput {
+		return nil, false
+	}
+	first.Output += second.Output
+	return first, true
+}
+
+// retry retries a backend write with exponential backoff, which also backs
+// off from a backend that is throttling writes. Conflicts are not retried.
+func retry(ctx context.Context, fn func() error) error {
+	var err error
+	var conflict *StateConflictError
+	for attempt := 1; attempt <= backendWriteAttempts; attempt++ {
+		if err = fn(); err == nil || ctx.Err() != nil || errors.As(err, &conflict) {
+			return err
+		}
+		if attempt == backendWriteAttempts {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(retryDelay(attempt)):
+		}
+	}
+	return err
+}
+
+// retryDelay is the backoff before retrying after the given attempt.
+func retryDelay(attempt int) time.Duration {
+	delay := backendRetryDelay << (attempt - 1)
+	if delay > backendMaxRetryDelay || delay <= 0 {
+		return backendMaxRetryDelay
+	}
+	return delay
+}
@@ -0,0 +1,359 @@
+package dcd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// batchRecordingBackend records the batches of events and states written to it.
+type batchRecordingBackend struct {
+	MemoryBackend
+	mu      sync.Mutex
+	writes  []string
+	batches [][]Event
+	err     error
+}
+
+func (b *batchRecordingBackend) PutPipeline(ctx context.Context, state *PipelineState) error {
+	b.mu.Lock()
+	b.writes = append(b.writes, "state "+state.Status)
+	b.mu.Unlock()
+	return b.MemoryBackend.PutPipeline(ctx, state)
+}
+
+func (b *batchRecordingBackend) PutPipelineEvents(ctx context.Context, component string, buildID int64, events []Event) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.err != nil {
+		return b.err
+	}
+	b.writes = append(b.writes, fmt.Sprintf("%d events", len(events)))
+	b.batches = append(b.batches, events)
+	return b.MemoryBackend.PutPipelineEvents(ctx, component, buildID, events)
+}
+
+func TestEventWriterBatchesAndCoalesces(t *testing.T) {
+	// Given
+	backend := &batchRecordingBackend{}
+	state := PipelineState{Component: "test-component", BuildID: 1, Status: StatusPending}
+	if err := backend.StartPipeline(context.Background(), &state); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	writer := newEventWriter(context.Background(), backend, nil, nil, state, false, nil, func(event Event) {
+		t.Errorf("Unexpected backend error: %s", event.LogMessage())
+	})
+
+	// When
+	now := time.Now()
+	writer.writeEvent(PipelineStartEvent{BaseEvent: BaseEvent{EventTime: now}, BuildID: 1})
+	writer.writeState(PipelineState{Component: "test-component", BuildID: 1, Status: StatusRunning})
+	for i := 0; i < 30; i++ {
+		writer.writeEvent(StepStartEvent{BaseEvent: BaseEvent{EventTime: now}, StepName: fmt.Sprintf("step-%d", i)})
+		writer.writeEvent(StepOutputEvent{BaseEvent: BaseEvent{EventTime: now}, StepName: fmt.Sprintf("step-%d", i), Output: "line 1\n"})
+		writer.writeEvent(StepOutputEvent{BaseEvent: BaseEvent{EventTime: now}, StepName: fmt.Sprintf("step-%d", i), Output: "line 2\n"})
+	}
+	writer.writeEvent(PipelineSuccessEvent{BaseEvent: BaseEvent{EventTime: now}})
+	writer.writeState(PipelineState{Component: "test-component", BuildID: 1, Status: StatusSucceeded})
+	writer.close()
+
+	// Then
+	expected := "1 events|state running|25 events|25 events|11 events|state succeeded"
+	if got := strings.Join(backend.writes, "|"); got != expected {
+		t.Errorf("Expected writes %q, got %q", expected, got)
+	}
+	output, ok := backend.batches[1][1].(StepOutputEvent)
+	if !ok || output.Output != "line 1\nline 2\n" {
+		t.Errorf("Expected the output of a step to be combined, got %#v", backend.batches[1][1])
+	}
+}
+
+func TestEventWriterReportsFailedWrites(t *testing.T) {
+	// Given
+	backend := &batchRecordingBackend{err: errors.New("throttled")}
+	var reported []Event
+	state := PipelineState{Component: "test-component", BuildID: 1, Status: StatusPending}
+	if err := backend.StartPipeline(context.Background(), &state); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	writer := newEventWriter(context.Background(), backend, nil, nil, state, false, nil, func(event Event) {
+		reported = append(reported, event)
+	})
+
+	// When
+	writer.writeEvent(PipelineStartEvent{BaseEvent: BaseEvent{EventTime: time.Now()}, BuildID: 1})
+	writer.writeState(PipelineState{Component: "test-component", BuildID: 1, Status: StatusRunning})
+	writer.close()
+
+	// Then
+	if len(reported) != 1 {
+		t.Fatalf("Expected 1 reported error, got %d", len(reported))
+	}
+	expected := "Build history error: failed to write PipelineStartEvent: throttled"
+	if got := reported[0].LogMessage(); got != expected {
+		t.Errorf("Expected %q, got %q", expected, got)
+	}
+	if got := strings.Join(backend.writes, "|"); got != "state running" {
+		t.Errorf("Expected the state to still be written, got %q", got)
+	}
+}
+
+func TestEventWriterReportsConflicts(t *testing.T) {
+	// Given a build that another process marks abandoned while it runs
+	ctx := context.Background()
+	backend := &batchRecordingBackend{}
+	state := PipelineState{Component: "test-component", BuildID: 1, Status: StatusPending}
+	if err := backend.StartPipeline(ctx, &state); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	abandoned := state
+	abandoned.Status = StatusAbandoned
+	if err := backend.MemoryBackend.PutPipeline(ctx, &abandoned); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	var reported []Event
+	outbox := NewOutbox(t.TempDir())
+	writer := newEventWriter(ctx, backend, outbox, nil, state, false, nil, func(event Event) {
+		reported = append(reported, event)
+	})
+
+	// When a heartbeat is written, which an abandoned build cannot take
+	writer.writeState(PipelineState{Component: "test-component", BuildID: 1, Status: StatusRunning})
+	writer.close()
+
+	// Then the write is rejected without retrying or going offline
+	if len(reported) != 1 {
+		t.Fatalf("Expected 1 reported error, got %d", len(reported))
+	}
+	expected := "Build history error: failed to update pipeline status to running: build 1 of test-component was changed by another process (version 2, expected 1)"
+	if got := reported[0].LogMessage(); got != expected {
+		t.Errorf("Expected %q, got %q", expected, got)
+	}
+	if got := strings.Join(backend.writes, "|"); got != "state running" {
+		t.Errorf("Expected a single write, got %q", got)
+	}
+	stored, _ := backend.GetPipeline(ctx, "test-component", 1)
+	if stored.Status != StatusAbandoned {
+		t.Errorf("Expected the build to stay abandoned, got %s", stored.Status)
+	}
+}
+
+// memoryArchive is a LogArchive holding logs in memory.
+type memoryArchive struct {
+	mu   sync.Mutex
+	logs map[string][]byte
+	err  error
+}
+
+func (a *memoryArchive) PutLog(ctx context.Context, key string, data []byte) (string, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.err != nil {
+		return "", a.err
+	}
+	if a.logs == nil {
+		a.logs = map[string][]byte{}
+	}
+	a.logs["memory://"+key] = data
+	return "memory://" + key, nil
+}
+
+func (a *memoryArchive) GetLog(ctx context.Context, location string) ([]byte, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	data, ok := a.logs[location]
+	if !ok {
+		return nil, fmt.Errorf("no log at %s", location)
+	}
+	return data, nil
+}
+
+func TestEventWriterArchivesStepOutput(t *testing.T) {
+	// Given
+	ctx := context.Background()
+	backend := &batchRecordingBackend{}
+	archive := &memoryArchive{}
+	state := PipelineState{Component: "test-component", BuildID: 1, Status: StatusPending}
+	if err := backend.StartPipeline(ctx, &state); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	writer := newEventWriter(ctx, backend, nil, archive, state, false, nil, func(event Event) {
+		t.Errorf("Unexpected backend error: %s", event.LogMessage())
+	})
+
+	// When a noisy step, with megabytes of output, and a quiet step run
+	now := time.Now()
+	var expected strings.Builder
+	writer.writeEvent(StepStartEvent{BaseEvent: BaseEvent{EventTime: now}, StepName: "noisy"})
+	for i := 0; i < 100000; i++ {
+		line := fmt.Sprintf("line %d %s\n", i, strings.Repeat("x", 20))
+		expected.WriteString(line)
+		writer.writeEvent(StepOutputEvent{BaseEvent: BaseEvent{EventTime: now.Add(time.Duration(i))}, StepName: "noisy", Output: line})
+	}
+	written := time.Now()
+	writer.writeEvent(StepSuccessEvent{BaseEvent: BaseEvent{EventTime: now.Add(time.Second)}, StepName: "noisy"})
+	writer.writeEvent(StepStartEvent{BaseEvent: BaseEvent{EventTime: now.Add(time.Second)}, StepName: "quiet"})
+	writer.writeEvent(StepOutputEvent{BaseEvent: BaseEvent{EventTime: now.Add(time.Second)}, StepName: "quiet", Output: "done\n"})
+	writer.writeEvent(StepFailureEvent{BaseEvent: BaseEvent{EventTime: now.Add(2 * time.Second)}, StepName: "quiet", Reason: "exit status 1"})
+	writer.close()
+
+	// Then the backend holds no more of the noisy step's output than the tail
+	// next to the reference to it
+	var events []Event
+	if err := StreamPipelineEvents(ctx, backend, "test-component", 1, func(event Event) error {
+		events = append(events, event)
+		return nil
+	}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	var types []string
+	for _, event := range events {
+		types = append(types, fmt.Sprintf("%T", event))
+	}
+	expectedTypes := "dcd.StepStartEvent dcd.StepOutputArchivedEvent dcd.StepSuccessEvent dcd.StepStartEvent dcd.StepOutputEvent dcd.StepFailureEvent"
+	if got := strings.Join(types, " "); got != expectedTypes {
+		t.Fatalf("Expected events %s, got %s", expectedTypes, got)
+	}
+	stored := 0
+	for _, batch := range backend.batches {
+		for _, event := range batch {
+			data, err := MarshalEvent(event)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			stored += len(data)
+		}
+	}
+	if stored > 2*archiveTailSize {
+		t.Errorf("Expected the backend to hold little more than the tail, got %d bytes", stored)
+	}
+	archived := events[1].(StepOutputArchivedEvent)
+	if archived.Size != expected.Len() || !archived.OutputStart.Equal(now) {
+		t.Errorf("Expected %d bytes of output from %s, got %d from %s", expected.Len(), now, archived.Size, archived.OutputStart)
+	}
+	if !archived.EventTime.After(written) {
+		t.Errorf("Expected the reference to be stamped with when it was written, after %s, got %s", written, archived.EventTime)
+	}
+	if !strings.HasPrefix(archived.Tail, "line ") || !strings.HasSuffix(archived.Tail, "line 99999 xxxxxxxxxxxxxxxxxxxx\n") || len(archived.Tail) > archiveTailSize {
+		t.Errorf("Expected the tail to be the last lines of output, got %q", archived.Tail)
+	}
+	if output, ok := events[4].(StepOutputEvent); !ok || output.Output != "done\n" {
+		t.Errorf("Expected short output to be stored in the backend, got %#v", events[4])
+	}
+	data, err := archive.GetLog(ctx, archived.Location)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	output, err := decompressLog(data)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if output != expected.String() {
+		t.Errorf("Expected the archive to hold all the output, got %d bytes", len(output))
+	}
+}
+
+func TestEventWriterStoresOutputThatCannotBeArchived(t *testing.T) {
+	// Given
+	ctx := context.Background()
+	backend := &batchRecordingBackend{}
+	archive := &memoryArchive{err: errors.New("access denied")}
+	state := PipelineState{Component: "test-component", BuildID: 1, Status: StatusPending}
+	if err := backend.StartPipeline(ctx, &state); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	var reported []Event
+	writer := newEventWriter(ctx, backend, nil, archive, state, false, nil, func(event Event) {
+		reported = append(reported, event)
+	})
+
+	// When
+	output := strings.Repeat("x", maxCoalescedOutput) + strings.Repeat("y", 10)
+	writer.writeEvent(StepOutputEvent{BaseEvent: BaseEvent{EventTime: time.Now()}, StepName: "step", Output: output})
+	writer.writeEvent(StepSuccessEvent{BaseEvent: BaseEvent{EventTime: time.Now()}, StepName: "step"})
+	writer.close()
+
+	// Then
+	if len(reported) != 1 || !strings.Contains(reported[0].LogMessage(), "failed to archive the output of step: access denied") {
+		t.Fatalf("Expected the archive error to be reported, got %#v", reported)
+	}
+	page, err := backend.ListPipelineEvents(ctx, "test-component", 1, "", 0)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	var stored string
+	for _, event := range page.Events {
+		if event, ok := event.(StepOutputEvent); ok {
+			stored += event.Output
+		}
+	}
+	if stored != output {
+		t.Errorf("Expected the output to be stored in the backend, got %d bytes", len(stored))
+	}
+}
+
+func TestArchivedLogBackendFetchesOutput(t *testing.T) {
+	// Given
+	ctx := context.Background()
+	backend := NewMemoryBackend()
+	archive := &memoryArchive{}
+	state := PipelineState{Component: "test-component", BuildID: 1, Status: StatusPending}
+	if err := backend.StartPipeline(ctx, &state); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	output := strings.Repeat("line\n", 10000)
+	now := time.Now()
+	log, err := newStepLog(now)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer log.remove()
+	if err := log.write(output); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	data, err := log.compressed()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	location, err := archive.PutLog(ctx, "test-component/1/step.log.gz", data)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if err := PutPipelineEvents(ctx, backend, "test-component", 1, []Event{
+		StepStartEvent{BaseEvent: BaseEvent{EventTime: now}, StepName: "step"},
+		StepOutputArchivedEvent{BaseEvent: BaseEvent{EventTime: now.Add(time.Second)}, StepName: "step", Location: location, Size: len(output), Tail: "line\n", OutputStart: now},
+		StepSuccessEvent{BaseEvent: BaseEvent{EventTime: now.Add(time.Second)}, StepName: "step"},
+	}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	// When
+	var events []Event
+	err = StreamPipelineEvents(ctx, NewArchivedLogBackend(backend, archive), "test-component", 1, func(event Event) error {
+		events = append(events, event)
+		return nil
+	})
+
+	// Then
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	var fetched string
+	for _, event := range events[1 : len(events)-1] {
+		event, ok := event.(StepOutputEvent)
+		if !ok {
+			t.Fatalf("Expected output events in place of the archived output, got %#v", event)
+		}
+		if !event.EventTime.Equal(now) {
+			t.Errorf("Expected the output to be from when it started, %s, got %s", now, event.EventTime)
+		}
+		fetched += event.Output
+	}
+	if fetched != output {
+		t.Errorf("Expected the archived output, got %d bytes", len(fetched))
+	}
+}
@@ -0,0 +1,115 @@
+package dcd
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+)
+
+// EventSchemaVersion is the version of the event wire format written by MarshalEvent.
+const EventSchemaVersion = 1
+
+// eventEnvelope is the wire format of an event: the registered type name,
+// the schema version and the event struct itself.
+type eventEnvelope struct {
+	Type    string          `json:"type"`
+	Version int             `json:"version"`
+	Data    json.RawMessage `json:"data"`
+}
+
+var (
+	eventTypesByName = map[string]reflect.Type{}
+	eventNamesByType = map[reflect.Type]string{}
+)
+
+func init() {
+	RegisterEventType("pipeline-start", PipelineStartEvent{})
+	RegisterEventType("pipeline-success", PipelineSuccessEvent{})
+	RegisterEventType("pipeline-failure", PipelineFailureEvent{})
+	RegisterEventType("pipeline-cancelled", PipelineCancelledEvent{})
+	RegisterEventType("pipeline-abandoned", PipelineAbandonedEvent{})
+	RegisterEventType("step-start", StepStartEvent{})
+	RegisterEventType("step-output", StepOutputEvent{})
+	RegisterEventType("step-output-archived", StepOutputArchivedEvent{})
+	RegisterEventType("step-success", StepSuccessEvent{})
+	RegisterEventType("step-failure", StepFailureEvent{})
+	RegisterEventType("step-timeout", StepTimeoutEvent{})
+	RegisterEventType("step-retry", StepRetryEvent{})
+	RegisterEventType("step-skipped", StepSkippedEvent{})
+	RegisterEventType("backend-error", BackendErrorEvent{})
+	RegisterEventType("backend-offline", BackendOfflineEvent{})
+}
+
+// RegisterEventType registers an event struct type so it can be marshalled
+// and unmarshalled under name. It panics if the name or type is already registered.
+func RegisterEventType(name string, event Event) {
+	t := reflect.TypeOf(event)
+	if _, ok := eventTypesByName[name]; ok {
+		panic(fmt.Sprintf("event type name %q registered twice", name))
+	}
+	if _, ok := eventNamesByType[t]; ok {
+		panic(fmt.Sprintf("event type %s registered twice", t))
+	}
+	eventTypesByName[name] = t
+	eventNamesByType[t] = name
+}
+
+// EventTypeName returns the registered name of the event's type.
+func EventTypeName(event Event) (string, error) {
+	name, ok := eventNamesByType[reflect.TypeOf(event)]
+	if !ok {
+		return "", &UnknownEventTypeError{Type: reflect.TypeOf(event).String()}
+	}
+	return name, nil
+}
+
+// EventStepName returns the name of the step an event belongs to, or "" for
+// events of the pipeline as a whole.
+func EventStepName(event Event) string {
+	value := reflect.ValueOf(event)
+	if value.Kind() != reflect.Struct {
+		return ""
+	}
+	field := value.FieldByName("StepName")
+	if !field.IsValid() || field.Kind() != reflect.String {
+		return ""
+	}
+	return field.String()
+}
+
+// MarshalEvent encodes an event in the versioned wire format.
+func MarshalEvent(event Event) ([]byte, error) {
+	name, err := EventTypeName(event)
+	if err != nil {
+		return nil, err
+	}
+	data, err := json.Marshal(event)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal %s event: %w", name, err)
+	}
+	return json.Marshal(eventEnvelope{
+		Type:    name,
+		Version: EventSchemaVersion,
+		Data:    data,
+	})
+}
+
+// UnmarshalEvent decodes an event written by MarshalEvent back into its typed value.
+func UnmarshalEvent(data []byte) (Event, error) {
+	var envelope eventEnvelope
+	if err := json.Unmarshal(data, &envelope); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal event: %w", err)
+	}
+	if envelope.Version < 1 || envelope.Version > EventSchemaVersion {
+		return nil, &UnsupportedEventVersionError{Type: envelope.Type, Version: envelope.Version}
+	}
+	t, ok := eventTypesByName[envelope.Type]
+	if !ok {
+		return nil, &UnknownEventTypeError{Type: envelope.Type}
+	}
+	value := reflect.New(t)
+	if err := json.Unmarshal(envelope.Data, value.Interface()); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal %s event: %w", envelope.Type, err)
+	}
+	return value.Elem().Interface().(Event), nil
+}
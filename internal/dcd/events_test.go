@@ -0,0 +1,131 @@
+package dcd_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/progsoftware/dcd/internal/dcd"
+)
+
+func TestEventRoundTrip(t *testing.T) {
+	eventTime := time.Date(2024, 1, 2, 3, 4, 5, 6, time.UTC)
+	base := dcd.BaseEvent{EventTime: eventTime}
+	events := []dcd.Event{
+		dcd.PipelineStartEvent{BaseEvent: base, BuildID: 42},
+		dcd.PipelineSuccessEvent{BaseEvent: base},
+		dcd.PipelineFailureEvent{BaseEvent: base, Reason: "step 'build' failed"},
+		dcd.PipelineCancelledEvent{BaseEvent: base, Reason: "received interrupt"},
+		dcd.PipelineAbandonedEvent{BaseEvent: base, Reason: "no heartbeat since 2024-01-02T03:04:05Z"},
+		dcd.StepStartEvent{BaseEvent: base, StepName: "build"},
+		dcd.StepOutputEvent{BaseEvent: base, StepName: "build", Output: "line 1\nline 2\n"},
+		dcd.StepOutputArchivedEvent{BaseEvent: base, StepName: "build", Location: "s3://dcd-logs/web/42/build.log.gz", Size: 10240, Tail: "line 2\n", OutputStart: eventTime.Add(-time.Minute)},
+		dcd.StepSuccessEvent{BaseEvent: base, StepName: "build"},
+		dcd.StepFailureEvent{BaseEvent: base, StepName: "build", Reason: "exit status 1"},
+		dcd.StepTimeoutEvent{BaseEvent: base, StepName: "build", Timeout: 10 * time.Minute, Pipeline: true},
+		dcd.StepRetryEvent{BaseEvent: base, StepName: "build", Attempt: 2, MaxAttempts: 3, Reason: "exit status 1", Delay: 2 * time.Second},
+		dcd.StepSkippedEvent{BaseEvent: base, StepName: "deploy", When: `branch == "main"`},
+		dcd.BackendErrorEvent{BaseEvent: base, Operation: "write StepOutputEvent", Reason: "throttled"},
+		dcd.BackendOfflineEvent{BaseEvent: base, Directory: ".dcd/outbox", Reason: "connection refused"},
+	}
+
+	for _, event := range events {
+		data, err := dcd.MarshalEvent(event)
+		if err != nil {
+			t.Fatalf("Unexpected error marshalling %T: %v", event, err)
+		}
+		decoded, err := dcd.UnmarshalEvent(data)
+		if err != nil {
+			t.Fatalf("Unexpected error unmarshalling %T: %v", event, err)
+		}
+		if decoded != event {
+			t.Errorf("Expected %#v, got %#v", event, decoded)
+		}
+	}
+}
+
+func TestEventWireFormat(t *testing.T) {
+	// The wire format is stored durably, so changes to it must be deliberate.
+	event := dcd.StepOutputEvent{
+		BaseEvent: dcd.BaseEvent{EventTime: time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)},
+		StepName:  "build",
+		Output:    "hello\n",
+	}
+
+	data, err := dcd.MarshalEvent(event)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	expected := `{"type":"step-output","version":1,"data":{"time":"2024-01-02T03:04:05Z","stepName":"build","output":"hello\n"}}`
+	if string(data) != expected {
+		t.Errorf("Expected %s, got %s", expected, data)
+	}
+}
+
+func TestUnmarshalEventErrors(t *testing.T) {
+	testCases := []struct {
+		data     string
+		expected string
+	}{
+		{`{"type":"step-unknown","version":1,"data":{}}`, `unknown event type "step-unknown"`},
+		{`{"type":"step-output","version":99,"data":{}}`, `unsupported schema version 99 for event type "step-output" (supported up to 1)`},
+		{`{"type":"step-output","data":{}}`, `unsupported schema version 0 for event type "step-output" (supported up to 1)`},
+	}
+
+	for _, tc := range testCases {
+		_, err := dcd.UnmarshalEvent([]byte(tc.data))
+		if err == nil {
+			t.Errorf("Expected an error for %s, but got none", tc.data)
+			continue
+		}
+		if err.Error() != tc.expected {
+			t.Errorf("For %s, expected error %q, got %q", tc.data, tc.expected, err.Error())
+		}
+	}
+}
+
+type customEvent struct {
+	dcd.BaseEvent
+	Detail string `json:"detail"`
+}
+
+func (c customEvent) LogMessage() string {
+	return c.Detail
+}
+
+func TestRegisterEventType(t *testing.T) {
+	dcd.RegisterEventType("test-custom", customEvent{})
+	event := customEvent{BaseEvent: dcd.BaseEvent{EventTime: time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)}, Detail: "custom"}
+
+	data, err := dcd.MarshalEvent(event)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	decoded, err := dcd.UnmarshalEvent(data)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if decoded != event {
+		t.Errorf("Expected %#v, got %#v", event, decoded)
+	}
+}
+
+func TestEventStepName(t *testing.T) {
+	base := dcd.BaseEvent{EventTime: time.Now()}
+	testCases := []struct {
+		event    dcd.Event
+		expected string
+	}{
+		{dcd.PipelineStartEvent{BaseEvent: base, BuildID: 1}, ""},
+		{dcd.StepStartEvent{BaseEvent: base, StepName: "build"}, "build"},
+		{dcd.StepOutputEvent{BaseEvent: base, StepName: "test", Output: "ok\n"}, "test"},
+		{dcd.StepFailureEvent{BaseEvent: base, StepName: "deploy", Reason: "exit status 1"}, "deploy"},
+		{dcd.PipelineFailureEvent{BaseEvent: base, Reason: "step 'deploy' failed"}, ""},
+	}
+
+	for _, tc := range testCases {
+		if name := dcd.EventStepName(tc.event); name != tc.expected {
+			t.Errorf("For %T, expected step name %q, got %q", tc.event, tc.expected, name)
+		}
+	}
+}
@@ -0,0 +1,487 @@
+package dcd
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The history directory is laid out as:
+//
+//	build-ids/<component>           the last allocated build ID of a component
+//	build-ids/<component>.lock      held while allocating a build ID
+//	builds/<component>/<id>/state.json
+//	                                the PipelineState of a build
+//	builds/<component>/<id>/state.lock
+//	                                held while the state is replaced
+//	builds/<component>/<id>/events/<time>-<seq>.json
+//	                                an event of a build in the MarshalEvent wire
+//	                                format, ordered by file name
+//
+// Before build IDs were allocated per component there was a single build-id
+// file and builds were stored in builds/<id>, see MigrateBuildIDs.
+const (
+	buildIDsDir      = "build-ids"
+	buildsDir        = "builds"
+	stateFile        = "state.json"
+	stateLockFile    = "state.lock"
+	eventsDir        = "events"
+	eventFileLayout  = "20060102T150405.000000000Z"
+	lockRetryDelay   = 10 * time.Millisecond
+	lockStaleTimeout = 30 * time.Second
+)
+
+var (
+	_ Backend            = (*FileBackend)(nil)
+	_ BatchEventWriter   = (*FileBackend)(nil)
+	_ BuildIDMigrator    = (*FileBackend)(nil)
+	_ BackendInitializer = (*FileBackend)(nil)
+	_ OutputPruner       = (*FileBackend)(nil)
+)
+
+// FileBackend stores the build history in a local (or shared) directory.
+type FileBackend struct {
+	dir string
+
+	mu       sync.Mutex
+	eventSeq int64
+}
+
+func NewFileBackend(dir string) *FileBackend {
+	return &FileBackend{
+		dir: dir,
+	}
+}
+
+func (b *FileBackend) componentDir(component string) (string, error) {
+	if component == "" || strings.ContainsAny(component, `/\`) || strings.HasPrefix(component, ".") {
+		return "", fmt.Errorf("invalid component name %q", component)
+	}
+	return filepath.Join(b.dir, buildsDir, component), nil
+}
+
+func (b *FileBackend) buildDir(component string, buildID int64) (string, error) {
+	dir, err := b.componentDir(component)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, strconv.FormatInt(buildID, 10)), nil
+}
+
+// GetBuildID allocates the next build ID of the component, holding a lock file
+// so that concurrent processes sharing the directory get distinct IDs.
+func (b *FileBackend) GetBuildID(ctx context.Context, component string) (int64, error) {
+	var id int64
+	err := b.updateBuildID(ctx, component, func(last int64) int64 {
+		id = last + 1
+		return id
+	})
+	return id, err
+}
+
+// updateBuildID replaces the last allocated build ID of a component while holding its lock.
+func (b *FileBackend) updateBuildID(ctx context.Context, component string, update func(last int64) int64) error {
+	if _, err := b.componentDir(component); err != nil {
+		return err
+	}
+	dir := filepath.Join(b.dir, buildIDsDir)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	path := filepath.Join(dir, component)
+	unlock, err := lockFile(ctx, path+".lock")
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	var last int64
+	data, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if err == nil {
+		last, err = strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+		if err != nil {
+			return fmt.Errorf("failed to parse build ID from %s: %w", path, err)
+		}
+	}
+	next := update(last)
+	if next == last {
+		return nil
+	}
+	return writeFileAtomic(path, []byte(strconv.FormatInt(next, 10)+"\n"))
+}
+
+// StartPipeline records a new build, failing if a build with the same ID already exists.
+func (b *FileBackend) StartPipeline(ctx context.Context, state *PipelineState) error {
+	dir, err := b.buildDir(state.Component, state.BuildID)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(dir), 0o755); err != nil {
+		return err
+	}
+	if err := os.Mkdir(dir, 0o755); err != nil {
+		if errors.Is(err, os.ErrExist) {
+			return &BuildExistsError{Component: state.Component, BuildID: state.BuildID}
+		}
+		return err
+	}
+	state.Version = 1
+	return writeState(dir, state)
+}
+
+// PutPipeline replaces the state of a build, holding a lock file so that
+// concurrent processes sharing the directory cannot overwrite each other's
+// changes.
+func (b *FileBackend) PutPipeline(ctx context.Context, state *PipelineState) error {
+	dir, err := b.buildDir(state.Component, state.BuildID)
+	if err != nil {
+		return err
+	}
+	current, err := readStateFile(filepath.Join(dir, stateFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return &BuildNotFoundError{Component: state.Component, BuildID: state.BuildID}
+	}
+	if err != nil {
+		return err
+	}
+	unlock, err := lockFile(ctx, filepath.Join(dir, stateLockFile))
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	// Read the state again now that no one else can change it.
+	if current, err = readStateFile(filepath.Join(dir, stateFile)); err != nil {
+		return err
+	}
+	if err := checkStateWrite(current, state); err != nil {
+		return err
+	}
+	next := *state
+	next.Version++
+	if err := writeState(dir, &next); err != nil {
+		return err
+	}
+	state.Version = next.Version
+	return nil
+}
+
+func writeState(dir string, state *PipelineState) error {
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal pipeline state: %w", err)
+	}
+	return writeFileAtomic(filepath.Join(dir, stateFile), data)
+}
+
+// PutPipelineEvent stores an event under its build, ordered by the event time.
+func (b *FileBackend) PutPipelineEvent(ctx context.Context, component string, buildID int64, event Event) error {
+	data, err := MarshalEvent(event)
+	if err != nil {
+		return err
+	}
+	dir, err := b.buildDir(component, buildID)
+	if err != nil {
+		return err
+	}
+	dir = filepath.Join(dir, eventsDir)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	b.mu.Lock()
+	b.eventSeq++
+	seq := b.eventSeq
+	b.mu.Unlock()
+	name := fmt.Sprintf("%s-%08d.json", event.Timestamp().UTC().Format(eventFileLayout), seq)
+	return writeFileAtomic(filepath.Join(dir, name), data)
+}
+
+// PutPipelineEvents stores events under their build in turn, as separate files
+// are needed to keep their order.
+func (b *FileBackend) PutPipelineEvents(ctx context.Context, component string, buildID int64, events []Event) error {
+	for _, event := range events {
+		if err := b.PutPipelineEvent(ctx, component, buildID, event); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *FileBackend) GetPipeline(ctx context.Context, component string, buildID int64) (*PipelineState, error) {
+	dir, err := b.buildDir(component, buildID)
+	if err != nil {
+		return nil, err
+	}
+	state, err := readStateFile(filepath.Join(dir, stateFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, &BuildNotFoundError{Component: component, BuildID: buildID}
+	}
+	return state, err
+}
+
+func readStateFile(path string) (*PipelineState, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var state PipelineState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal pipeline state %s: %w", path, err)
+	}
+	return &state, nil
+}
+
+// ListBuilds reads the state of each build of the component in turn, newest
+// first. The page token is the last build ID returned.
+func (b *FileBackend) ListBuilds(ctx context.Context, query *BuildQuery) (*BuildPage, error) {
+	if err := query.validate(); err != nil {
+		return nil, err
+	}
+	before, err := parseBuildIDPageToken(query.PageToken)
+	if err != nil {
+		return nil, err
+	}
+	ids, err := b.listBuildIDs(query.Component)
+	if err != nil {
+		return nil, err
+	}
+	return pageBuilds(ids, before, query, func(id int64) (*PipelineState, error) {
+		return b.GetPipeline(ctx, query.Component, id)
+	})
+}
+
+func (b *FileBackend) listBuildIDs(component string) ([]int64, error) {
+	dir, err := b.componentDir(component)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	var ids []int64
+	for _, entry := range entries {
+		if id, err := strconv.ParseInt(entry.Name(), 10, 64); err == nil && entry.IsDir() {
+			ids = append(ids, id)
+		}
+	}
+	return ids, nil
+}
+
+// ListPipelineEvents reads the event files in name order, the cursor being the
+// name of the last file returned.
+func (b *FileBackend) ListPipelineEvents(ctx context.Context, component string, buildID int64, cursor string, limit int) (*EventPage, error) {
+	if limit <= 0 {
+		limit = DefaultEventPageSize
+	}
+	dir, err := b.buildDir(component, buildID)
+	if err != nil {
+		return nil, err
+	}
+	dir = filepath.Join(dir, eventsDir)
+	entries, err := os.ReadDir(dir)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	page := &EventPage{Cursor: cursor}
+	for _, entry := range entries {
+		name := entry.Name()
+		if strings.HasPrefix(name, ".") || name <= cursor {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			return nil, err
+		}
+		event, err := UnmarshalEvent(data)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read event %s of build %d: %w", name, buildID, err)
+		}
+		page.Events = append(page.Events, event)
+		page.Cursor = name
+		if len(page.Events) == limit {
+			break
+		}
+	}
+	return page, nil
+}
+
+// PruneOutput deletes the event files holding the step output of old builds.
+func (b *FileBackend) PruneOutput(ctx context.Context, component string, before time.Time, keepDeployments bool) (int, error) {
+	return pruneOutput(ctx, b, component, before, keepDeployments, func(state *PipelineState) (int, error) {
+		dir, err := b.buildDir(state.Component, state.BuildID)
+		if err != nil {
+			return 0, err
+		}
+		dir = filepath.Join(dir, eventsDir)
+		entries, err := os.ReadDir(dir)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return 0, err
+		}
+		deleted := 0
+		for _, entry := range entries {
+			path := filepath.Join(dir, entry.Name())
+			data, err := os.ReadFile(path)
+			if err != nil {
+				return deleted, err
+			}
+			event, err := UnmarshalEvent(data)
+			if err != nil {
+				return deleted, fmt.Errorf("failed to read event %s: %w", path, err)
+			}
+			if _, ok := event.(StepOutputEvent); !ok {
+				continue
+			}
+			if err := os.Remove(path); err != nil {
+				return deleted, err
+			}
+			deleted++
+		}
+		return deleted, nil
+	})
+}
+
+// Init creates the history directory and moves any builds recorded with the
+// old global build ID counter to their component.
+func (b *FileBackend) Init(ctx context.Context) ([]string, error) {
+	var changes []string
+	if _, err := os.Stat(b.dir); errors.Is(err, os.ErrNotExist) {
+		if err := os.MkdirAll(b.dir, 0o755); err != nil {
+			return nil, err
+		}
+		changes = append(changes, fmt.Sprintf("created directory %s", b.dir))
+	}
+	moved, err := b.MigrateBuildIDs(ctx)
+	if err != nil {
+		return changes, fmt.Errorf("failed to migrate build IDs after moving %d builds: %w", moved, err)
+	}
+	if moved > 0 {
+		changes = append(changes, fmt.Sprintf("moved %d builds to per-component build IDs", moved))
+	}
+	return changes, nil
+}
+
+// MigrateBuildIDs moves builds from builds/<id> to builds/<component>/<id> and
+// starts each component's sequence after its highest build ID.
+func (b *FileBackend) MigrateBuildIDs(ctx context.Context) (int, error) {
+	root := filepath.Join(b.dir, buildsDir)
+	entries, err := os.ReadDir(root)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return 0, err
+	}
+	moved := 0
+	for _, entry := range entries {
+		id, err := strconv.ParseInt(entry.Name(), 10, 64)
+		if err != nil || !entry.IsDir() {
+			continue
+		}
+		// A component can have a numeric name, but only old builds hold a state file directly.
+		state, err := readStateFile(filepath.Join(root, entry.Name(), stateFile))
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return moved, err
+		}
+		target, err := b.buildDir(state.Component, id)
+		if err != nil {
+			return moved, err
+		}
+		if err := os.MkdirAll(filepath.Dir(target), 0o755); err != nil {
+			return moved, err
+		}
+		if _, err := os.Stat(target); err == nil {
+			return moved, &BuildExistsError{Component: state.Component, BuildID: id}
+		}
+		if err := os.Rename(filepath.Join(root, entry.Name()), target); err != nil {
+			return moved, err
+		}
+		moved++
+	}
+
+	entries, err = os.ReadDir(root)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return moved, err
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		ids, err := b.listBuildIDs(entry.Name())
+		if err != nil {
+			return moved, err
+		}
+		var highest int64
+		for _, id := range ids {
+			if id > highest {
+				highest = id
+			}
+		}
+		if err := b.updateBuildID(ctx, entry.Name(), func(last int64) int64 {
+			if highest > last {
+				return highest
+			}
+			return last
+		}); err != nil {
+			return moved, err
+		}
+	}
+	return moved, nil
+}
+
+// writeFileAtomic writes data to a temporary file and renames it into place,
+// so readers never see a partially written file.
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// lockFile creates path exclusively, waiting while another process holds it.
+// Locks older than lockStaleTimeout are assumed to be left behind by a process
+// that died and are removed.
+func lockFile(ctx context.Context, path string) (func(), error) {
+	for {
+		file, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o644)
+		if err == nil {
+			fmt.Fprintf(file, "%d\n", os.Getpid())
+			file.Close()
+			return func() { os.Remove(path) }, nil
+		}
+		if !errors.Is(err, os.ErrExist) {
+			return nil, fmt.Errorf("failed to create lock file: %w", err)
+		}
+		if info, err := os.Stat(path); err == nil && time.Since(info.ModTime()) > lockStaleTimeout {
+			os.Remove(path)
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("timed out waiting for lock file %s: %w", path, ctx.Err())
+		case <-time.After(lockRetryDelay):
+		}
+	}
+}
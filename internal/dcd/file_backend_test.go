@@ -0,0 +1,251 @@
+package dcd_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/progsoftware/dcd/internal/dcd"
+	"github.com/progsoftware/dcd/internal/dcd/dcdtest"
+)
+
+func TestFileBackendBehaviour(t *testing.T) {
+	dcdtest.TestBackend(t, func(t *testing.T) dcd.Backend {
+		return dcd.NewFileBackend(t.TempDir())
+	})
+}
+
+func TestFileBackendBuildIDsAcrossInstances(t *testing.T) {
+	// Separate instances share nothing but the directory, like separate processes.
+	dir := t.TempDir()
+	const count = 10
+	ids := make(chan int64, count)
+	var wg sync.WaitGroup
+	for i := 0; i < count; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			id, err := dcd.NewFileBackend(dir).GetBuildID(context.Background(), "test-component")
+			if err != nil {
+				t.Errorf("Unexpected error: %v", err)
+				return
+			}
+			ids <- id
+		}()
+	}
+	wg.Wait()
+	close(ids)
+
+	seen := map[int64]bool{}
+	for id := range ids {
+		seen[id] = true
+	}
+	for id := int64(1); id <= count; id++ {
+		if !seen[id] {
+			t.Errorf("Expected build ID %d to be allocated", id)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "build-ids", "test-component.lock")); !os.IsNotExist(err) {
+		t.Errorf("Expected lock file to be removed, got %v", err)
+	}
+}
+
+func TestFileBackendStaleLock(t *testing.T) {
+	dir := t.TempDir()
+	lock := filepath.Join(dir, "build-ids", "test-component.lock")
+	if err := os.MkdirAll(filepath.Dir(lock), 0o755); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if err := os.WriteFile(lock, []byte("1\n"), 0o644); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	old := time.Now().Add(-time.Hour)
+	if err := os.Chtimes(lock, old, old); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	id, err := dcd.NewFileBackend(dir).GetBuildID(ctx, "test-component")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if id != 1 {
+		t.Errorf("Expected ID to be 1, got %d", id)
+	}
+}
+
+func TestFileBackendLayout(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	backend := dcd.NewFileBackend(dir)
+	state := &dcd.PipelineState{
+		BuildID:   7,
+		Component: "test-component",
+		GitSHA:    "test-git-sha",
+		Status:    "pending",
+		StartTime: time.Now(),
+	}
+	if err := backend.StartPipeline(ctx, state); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	start := time.Now()
+	for i, output := range []string{"line 1\n", "line 2\n", "line 3\n"} {
+		// The first two events share a timestamp and must keep their order.
+		eventTime := start.Add(time.Duration(i/2) * time.Millisecond)
+		event := dcd.StepOutputEvent{BaseEvent: dcd.BaseEvent{EventTime: eventTime}, StepName: "step", Output: output}
+		if err := backend.PutPipelineEvent(ctx, "test-component", 7, event); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, "builds", "test-component", "7", "state.json"))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	var stored dcd.PipelineState
+	if err := json.Unmarshal(data, &stored); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if stored.Status != "pending" || stored.Component != "test-component" {
+		t.Errorf("Unexpected stored state: %+v", stored)
+	}
+
+	entries, err := os.ReadDir(filepath.Join(dir, "builds", "test-component", "7", "events"))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	var messages []string
+	for _, entry := range entries {
+		data, err := os.ReadFile(filepath.Join(dir, "builds", "test-component", "7", "events", entry.Name()))
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		event, err := dcd.UnmarshalEvent(data)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		messages = append(messages, event.LogMessage())
+	}
+	expected := "Output from step: line 1\n|Output from step: line 2\n|Output from step: line 3\n"
+	if got := strings.Join(messages, "|"); got != expected {
+		t.Errorf("Expected events %q, got %q", expected, got)
+	}
+}
+
+func TestFileBackendMigrateBuildIDs(t *testing.T) {
+	// Given builds stored by a version of dcd with a single build ID counter
+	ctx := context.Background()
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "build-id"), []byte("3\n"), 0o644); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	for id, component := range map[int64]string{1: "first-component", 2: "second-component", 3: "first-component"} {
+		writeLegacyBuild(t, dir, id, component)
+	}
+	backend := dcd.NewFileBackend(dir)
+
+	// When
+	moved, err := backend.MigrateBuildIDs(ctx)
+
+	// Then
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if moved != 3 {
+		t.Errorf("Expected 3 builds to be moved, got %d", moved)
+	}
+	state, err := backend.GetPipeline(ctx, "first-component", 3)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if state.GitSHA != "sha-3" {
+		t.Errorf("Expected build 3 of first-component to have git SHA sha-3, got %s", state.GitSHA)
+	}
+	page, err := backend.ListPipelineEvents(ctx, "first-component", 3, "", 0)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(page.Events) != 1 {
+		t.Errorf("Expected the event of build 3 to be moved, got %d events", len(page.Events))
+	}
+	for component, expected := range map[string]int64{"first-component": 4, "second-component": 3} {
+		id, err := backend.GetBuildID(ctx, component)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if id != expected {
+			t.Errorf("Expected next build ID of %s to be %d, got %d", component, expected, id)
+		}
+	}
+
+	// Running it again has nothing left to move.
+	moved, err = backend.MigrateBuildIDs(ctx)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if moved != 0 {
+		t.Errorf("Expected no builds to be moved, got %d", moved)
+	}
+}
+
+func writeLegacyBuild(t *testing.T, dir string, id int64, component string) {
+	t.Helper()
+	buildDir := filepath.Join(dir, "builds", fmt.Sprint(id))
+	if err := os.MkdirAll(filepath.Join(buildDir, "events"), 0o755); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	data, err := json.Marshal(&dcd.PipelineState{
+		BuildID:   id,
+		Component: component,
+		GitSHA:    fmt.Sprintf("sha-%d", id),
+		Status:    "succeeded",
+		StartTime: time.Now(),
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(buildDir, "state.json"), data, 0o644); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	data, err = dcd.MarshalEvent(dcd.PipelineStartEvent{BaseEvent: dcd.BaseEvent{EventTime: time.Now()}, BuildID: id})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(buildDir, "events", "event.json"), data, 0o644); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+}
+
+func TestFileBackendInit(t *testing.T) {
+	// Given a history directory with a build from the global build ID counter
+	ctx := context.Background()
+	dir := t.TempDir()
+	writeLegacyBuild(t, dir, 1, "test-component")
+	backend := dcd.NewFileBackend(dir)
+
+	// When
+	changes, err := backend.Init(ctx)
+
+	// Then
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	expected := []string{"moved 1 builds to per-component build IDs"}
+	if !reflect.DeepEqual(changes, expected) {
+		t.Errorf("Expected changes %q, got %q", expected, changes)
+	}
+	if _, err := backend.GetPipeline(ctx, "test-component", 1); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if changes, err := backend.Init(ctx); err != nil || len(changes) != 0 {
+		t.Errorf("Expected nothing to change, got %q, %v", changes, err)
+	}
+}
@@ -0,0 +1,88 @@
+package dcd
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+)
+
+const (
+	// secretMask replaces secrets in step output.
+	secretMask = "***"
+	// minSecretLength is the shortest value that is masked, as masking values
+	// such as "1" or "yes" would garble the output without hiding anything.
+	minSecretLength = 4
+)
+
+// secretPatterns match common token formats, which are masked whether or not
+// they were declared as secrets.
+var secretPatterns = []*regexp.Regexp{
+	regexp.MustCompile(`\b(AKIA|ASIA)[0-9A-Z]{16}\b`),                                        // AWS access key ID
+	regexp.MustCompile(`\bgh[pousr]_[A-Za-z0-9]{36,}\b`),                                     // GitHub token
+	regexp.MustCompile(`\bgithub_pat_[A-Za-z0-9_]{22,}\b`),                                   // GitHub fine-grained token
+	regexp.MustCompile(`\bglpat-[A-Za-z0-9_-]{20,}`),                                         // GitLab token
+	regexp.MustCompile(`\bxox[abposr]-[A-Za-z0-9-]{10,}`),                                    // Slack token
+	regexp.MustCompile(`\bnpm_[A-Za-z0-9]{36}\b`),                                            // npm token
+	regexp.MustCompile(`\b[rs]k_live_[A-Za-z0-9]{20,}\b`),                                    // Stripe key
+	regexp.MustCompile(`\bAIza[0-9A-Za-z_-]{35}`),                                            // Google API key
+	regexp.MustCompile(`\beyJ[A-Za-z0-9_-]{10,}\.eyJ[A-Za-z0-9_-]{10,}\.[A-Za-z0-9_-]{10,}`), // JWT
+}
+
+// secretMasker replaces secret values, and anything that looks like a token,
+// in step output.
+type secretMasker struct {
+	values   []string
+	replacer *strings.Replacer
+}
+
+// newSecretMasker creates a masker for the given secret values. Values
+// shorter than minSecretLength are not masked.
+func newSecretMasker(values []string) *secretMasker {
+	m := &secretMasker{}
+	seen := map[string]bool{}
+	for _, value := range values {
+		if len(value) >= minSecretLength && !seen[value] {
+			seen[value] = true
+			m.values = append(m.values, value)
+		}
+	}
+	// Longest first, so that a secret containing another is masked whole.
+	sort.Slice(m.values, func(i, j int) bool {
+		return len(m.values[i]) > len(m.values[j])
+	})
+	if len(m.values) > 0 {
+		var pairs []string
+		for _, value := range m.values {
+			pairs = append(pairs, value, secretMask)
+		}
+		m.replacer = strings.NewReplacer(pairs...)
+	}
+	return m
+}
+
+// mask replaces the secrets in output.
+func (m *secretMasker) mask(output string) string {
+	if m.replacer != nil {
+		output = m.replacer.Replace(output)
+	}
+	for _, pattern := range secretPatterns {
+		output = pattern.ReplaceAllLiteralString(output, secretMask)
+	}
+	return output
+}
+
+// partialSecret returns the length of the longest end of output that is the
+// start of a secret, which has to be held back until the rest of the output
+// shows whether it is one.
+func (m *secretMasker) partialSecret(output string) int {
+	longest := 0
+	for _, value := range m.values {
+		for n := min(len(value)-1, len(output)); n > longest; n-- {
+			if strings.HasSuffix(output, value[:n]) {
+				longest = n
+				break
+			}
+		}
+	}
+	return longest
+}
@@ -0,0 +1,216 @@
+package dcd
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var (
+	_ Backend          = (*MemoryBackend)(nil)
+	_ BatchEventWriter = (*MemoryBackend)(nil)
+	_ OutputPruner     = (*MemoryBackend)(nil)
+)
+
+// MemoryBackend keeps the build history in memory, for tests. The zero value is ready to use.
+type MemoryBackend struct {
+	mu       sync.Mutex
+	buildIDs map[string]int64
+	builds   map[buildKey]PipelineState
+	events   map[buildKey][]Event
+}
+
+// buildKey identifies a build.
+type buildKey struct {
+	component string
+	buildID   int64
+}
+
+func NewMemoryBackend() *MemoryBackend {
+	return &MemoryBackend{}
+}
+
+func (b *MemoryBackend) GetBuildID(ctx context.Context, component string) (int64, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.buildIDs == nil {
+		b.buildIDs = map[string]int64{}
+	}
+	b.buildIDs[component]++
+	return b.buildIDs[component], nil
+}
+
+func (b *MemoryBackend) StartPipeline(ctx context.Context, state *PipelineState) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.builds[buildKey{state.Component, state.BuildID}]; ok {
+		return &BuildExistsError{Component: state.Component, BuildID: state.BuildID}
+	}
+	state.Version = 1
+	b.putPipeline(state)
+	return nil
+}
+
+func (b *MemoryBackend) PutPipeline(ctx context.Context, state *PipelineState) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	current, ok := b.builds[buildKey{state.Component, state.BuildID}]
+	if !ok {
+		return &BuildNotFoundError{Component: state.Component, BuildID: state.BuildID}
+	}
+	if err := checkStateWrite(&current, state); err != nil {
+		return err
+	}
+	state.Version++
+	b.putPipeline(state)
+	return nil
+}
+
+func (b *MemoryBackend) putPipeline(state *PipelineState) {
+	if b.builds == nil {
+		b.builds = map[buildKey]PipelineState{}
+	}
+	b.builds[buildKey{state.Component, state.BuildID}] = *state
+}
+
+func (b *MemoryBackend) PutPipelineEvent(ctx context.Context, component string, buildID int64, event Event) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.events == nil {
+		b.events = map[buildKey][]Event{}
+	}
+	key := buildKey{component, buildID}
+	b.events[key] = append(b.events[key], event)
+	return nil
+}
+
+func (b *MemoryBackend) PutPipelineEvents(ctx context.Context, component string, buildID int64, events []Event) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.events == nil {
+		b.events = map[buildKey][]Event{}
+	}
+	key := buildKey{component, buildID}
+	b.events[key] = append(b.events[key], events...)
+	return nil
+}
+
+// PruneOutput deletes the step output of old builds.
+func (b *MemoryBackend) PruneOutput(ctx context.Context, component string, before time.Time, keepDeployments bool) (int, error) {
+	return pruneOutput(ctx, b, component, before, keepDeployments, func(state *PipelineState) (int, error) {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		key := buildKey{state.Component, state.BuildID}
+		var kept []Event
+		for _, event := range b.events[key] {
+			if _, ok := event.(StepOutputEvent); !ok {
+				kept = append(kept, event)
+			}
+		}
+		deleted := len(b.events[key]) - len(kept)
+		b.events[key] = kept
+		return deleted, nil
+	})
+}
+
+func (b *MemoryBackend) GetPipeline(ctx context.Context, component string, buildID int64) (*PipelineState, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	state, ok := b.builds[buildKey{component, buildID}]
+	if !ok {
+		return nil, &BuildNotFoundError{Component: component, BuildID: buildID}
+	}
+	return &state, nil
+}
+
+// ListBuilds pages through builds by ID, the page token being the last ID returned.
+func (b *MemoryBackend) ListBuilds(ctx context.Context, query *BuildQuery) (*BuildPage, error) {
+	if err := query.validate(); err != nil {
+		return nil, err
+	}
+	before, err := parseBuildIDPageToken(query.PageToken)
+	if err != nil {
+		return nil, err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var ids []int64
+	for key := range b.builds {
+		if key.component == query.Component {
+			ids = append(ids, key.buildID)
+		}
+	}
+	return pageBuilds(ids, before, query, func(id int64) (*PipelineState, error) {
+		state := b.builds[buildKey{query.Component, id}]
+		return &state, nil
+	})
+}
+
+// ListPipelineEvents uses the index of the next event as the cursor.
+func (b *MemoryBackend) ListPipelineEvents(ctx context.Context, component string, buildID int64, cursor string, limit int) (*EventPage, error) {
+	start := 0
+	if cursor != "" {
+		var err error
+		if start, err = strconv.Atoi(cursor); err != nil {
+			return nil, fmt.Errorf("invalid event cursor %q", cursor)
+		}
+	}
+	if limit <= 0 {
+		limit = DefaultEventPageSize
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	events := b.events[buildKey{component, buildID}]
+	if start > len(events) {
+		start = len(events)
+	}
+	end := start + limit
+	if end > len(events) {
+		end = len(events)
+	}
+	return &EventPage{
+		Events: append([]Event(nil), events[start:end]...),
+		Cursor: strconv.Itoa(end),
+	}, nil
+}
+
+// parseBuildIDPageToken parses a page token holding the last build ID of the
+// previous page, returning 0 for the first page.
+func parseBuildIDPageToken(token string) (int64, error) {
+	if token == "" {
+		return 0, nil
+	}
+	id, err := strconv.ParseInt(token, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid page token %q", token)
+	}
+	return id, nil
+}
+
+// pageBuilds returns the page of builds matching the query from those with the
+// given IDs, newest first, starting below before (if not zero).
+func pageBuilds(ids []int64, before int64, query *BuildQuery, getBuild func(int64) (*PipelineState, error)) (*BuildPage, error) {
+	sort.Slice(ids, func(i, j int) bool { return ids[i] > ids[j] })
+	page := &BuildPage{}
+	for _, id := range ids {
+		if before != 0 && id >= before {
+			continue
+		}
+		state, err := getBuild(id)
+		if err != nil {
+			return nil, err
+		}
+		if !query.matches(state) {
+			continue
+		}
+		if len(page.Builds) == query.limit() {
+			page.NextPageToken = strconv.FormatInt(page.Builds[len(page.Builds)-1].BuildID, 10)
+			break
+		}
+		page.Builds = append(page.Builds, *state)
+	}
+	return page, nil
+}
@@ -0,0 +1,268 @@
+package dcd
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+)
+
+// The outbox directory holds two file backends:
+//
+//	spooled/       builds that have a build ID from the backend, but whose
+//	               history could not all be written to it
+//	provisional/   builds run when no build ID could be allocated, numbered
+//	               from the outbox's own sequences
+//
+// Provisional builds are given a build ID from the backend when they are
+// synced, which is kept in sync.json in the build directory until the sync
+// completes so that it is only allocated once.
+const (
+	spooledDir     = "spooled"
+	provisionalDir = "provisional"
+	syncFile       = "sync.json"
+)
+
+// Outbox keeps the history of builds that could not be written to the backend
+// until it is replayed by Sync.
+type Outbox struct {
+	dir         string
+	spooled     *FileBackend
+	provisional *FileBackend
+}
+
+// OutboxBuild is a build waiting in the outbox.
+type OutboxBuild struct {
+	PipelineState
+	// Provisional is set if BuildID is a provisional ID from the outbox
+	// rather than one allocated by the backend.
+	Provisional bool
+}
+
+// SyncedBuild is a build written to the backend by Sync.
+type SyncedBuild struct {
+	Component     string
+	BuildID       int64
+	ProvisionalID int64 // the provisional build ID, if the build had one
+	Events        int   // the number of events written
+}
+
+// syncProgress is the contents of sync.json.
+type syncProgress struct {
+	BuildID int64
+}
+
+func NewOutbox(dir string) *Outbox {
+	return &Outbox{
+		dir:         dir,
+		spooled:     NewFileBackend(filepath.Join(dir, spooledDir)),
+		provisional: NewFileBackend(filepath.Join(dir, provisionalDir)),
+	}
+}
+
+// Dir returns the outbox directory.
+func (o *Outbox) Dir() string {
+	return o.dir
+}
+
+// ProvisionalBuildID allocates a provisional build ID for a build run while
+// the backend cannot allocate one.
+func (o *Outbox) ProvisionalBuildID(ctx context.Context, component string) (int64, error) {
+	return o.provisional.GetBuildID(ctx, component)
+}
+
+// backend returns the file backend holding a build.
+func (o *Outbox) backend(provisional bool) *FileBackend {
+	if provisional {
+		return o.provisional
+	}
+	return o.spooled
+}
+
+// ListBuilds returns the builds of a component waiting in the outbox that
+// match the query, newest first. The query's Limit and PageToken are ignored.
+func (o *Outbox) ListBuilds(ctx context.Context, query *BuildQuery) ([]OutboxBuild, error) {
+	var builds []OutboxBuild
+	for _, provisional := range []bool{false, true} {
+		backend := o.backend(provisional)
+		ids, err := backend.listBuildIDs(query.Component)
+		if err != nil {
+			return nil, err
+		}
+		for _, id := range ids {
+			state, err := backend.GetPipeline(ctx, query.Component, id)
+			if err != nil {
+				return nil, err
+			}
+			if query.matches(state) {
+				builds = append(builds, OutboxBuild{PipelineState: *state, Provisional: provisional})
+			}
+		}
+	}
+	sort.Slice(builds, func(i, j int) bool {
+		return builds[i].StartTime.After(builds[j].StartTime)
+	})
+	return builds, nil
+}
+
+// pendingBuilds returns every build in the outbox, oldest first so that
+// provisional builds are given build IDs in the order they ran.
+func (o *Outbox) pendingBuilds(ctx context.Context) ([]OutboxBuild, error) {
+	components := map[string]bool{}
+	for _, provisional := range []bool{false, true} {
+		entries, err := os.ReadDir(filepath.Join(o.backend(provisional).dir, buildsDir))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+		for _, entry := range entries {
+			if entry.IsDir() {
+				components[entry.Name()] = true
+			}
+		}
+	}
+	var builds []OutboxBuild
+	for component := range components {
+		found, err := o.ListBuilds(ctx, &BuildQuery{Component: component})
+		if err != nil {
+			return nil, err
+		}
+		builds = append(builds, found...)
+	}
+	sort.Slice(builds, func(i, j int) bool {
+		return builds[i].StartTime.Before(builds[j].StartTime)
+	})
+	return builds, nil
+}
+
+// Sync writes the builds in the outbox to the backend and removes them from
+// the outbox. Unfinished builds are left alone unless includeUnfinished is
+// set, as they may still be running. Sync can safely be run again after it is
+// interrupted: events already in the backend are not written twice, and
+// provisional builds keep the build ID they were first given.
+func (o *Outbox) Sync(ctx context.Context, backend Backend, includeUnfinished bool) ([]SyncedBuild, error) {
+	builds, err := o.pendingBuilds(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var synced []SyncedBuild
+	for _, build := range builds {
+		if !includeUnfinished && (build.Status == StatusPending || build.Status == StatusRunning) {
+			continue
+		}
+		result, err := o.syncBuild(ctx, backend, build)
+		if err != nil {
+			return synced, fmt.Errorf("failed to sync build %d of %s: %w", build.BuildID, build.Component, err)
+		}
+		synced = append(synced, *result)
+	}
+	return synced, nil
+}
+
+func (o *Outbox) syncBuild(ctx context.Context, backend Backend, build OutboxBuild) (*SyncedBuild, error) {
+	outbox := o.backend(build.Provisional)
+	dir, err := outbox.buildDir(build.Component, build.BuildID)
+	if err != nil {
+		return nil, err
+	}
+	result := &SyncedBuild{Component: build.Component, BuildID: build.BuildID}
+	state := build.PipelineState
+	if build.Provisional {
+		result.ProvisionalID = build.BuildID
+		if state.BuildID, err = o.assignBuildID(ctx, backend, dir, build.Component); err != nil {
+			return nil, err
+		}
+		result.BuildID = state.BuildID
+	}
+
+	// A spooled build, or one whose sync was interrupted, is already started.
+	var exists *BuildExistsError
+	if err := backend.StartPipeline(ctx, &state); err != nil && !errors.As(err, &exists) {
+		return nil, err
+	}
+
+	written := map[string]int{}
+	if err := StreamPipelineEvents(ctx, backend, state.Component, state.BuildID, func(event Event) error {
+		data, err := MarshalEvent(event)
+		written[string(data)]++
+		return err
+	}); err != nil {
+		return nil, err
+	}
+	var missing []Event
+	if err := StreamPipelineEvents(ctx, outbox, build.Component, build.BuildID, func(event Event) error {
+		if start, ok := event.(PipelineStartEvent); ok {
+			start.BuildID = state.BuildID
+			event = start
+		}
+		data, err := MarshalEvent(event)
+		if err != nil {
+			return err
+		}
+		if written[string(data)] > 0 {
+			written[string(data)]--
+			return nil
+		}
+		missing = append(missing, event)
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	for start := 0; start < len(missing); start += eventBatchSize {
+		end := start + eventBatchSize
+		if end > len(missing) {
+			end = len(missing)
+		}
+		if err := PutPipelineEvents(ctx, backend, state.Component, state.BuildID, missing[start:end]); err != nil {
+			return nil, err
+		}
+	}
+	result.Events = len(missing)
+
+	// The state is written against the backend's version of the build, unless
+	// it is already up to date.
+	current, err := backend.GetPipeline(ctx, state.Component, state.BuildID)
+	if err != nil {
+		return nil, err
+	}
+	if current.Status != state.Status {
+		state.Version = current.Version
+		if err := backend.PutPipeline(ctx, &state); err != nil {
+			return nil, err
+		}
+	}
+	return result, os.RemoveAll(dir)
+}
+
+// assignBuildID allocates the backend build ID of a provisional build, or
+// returns the one allocated by an earlier, interrupted sync.
+func (o *Outbox) assignBuildID(ctx context.Context, backend Backend, dir, component string) (int64, error) {
+	path := filepath.Join(dir, syncFile)
+	var progress syncProgress
+	data, err := os.ReadFile(path)
+	if err == nil {
+		if err := json.Unmarshal(data, &progress); err != nil {
+			return 0, fmt.Errorf("failed to parse %s: %w", path, err)
+		}
+		return progress.BuildID, nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return 0, err
+	}
+	if progress.BuildID, err = backend.GetBuildID(ctx, component); err != nil {
+		return 0, err
+	}
+	if data, err = json.Marshal(&progress); err != nil {
+		return 0, err
+	}
+	return progress.BuildID, writeFileAtomic(path, data)
+}
+
+// ProvisionalBuildIDString is how a provisional build ID is shown, so that it
+// cannot be mistaken for one allocated by the backend.
+func ProvisionalBuildIDString(buildID int64) string {
+	return "local-" + strconv.FormatInt(buildID, 10)
+}
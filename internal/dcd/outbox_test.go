@@ -0,0 +1,240 @@
+package dcd_test
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/progsoftware/dcd/internal/dcd"
+)
+
+// unreachableBackend fails every write, like a backend the network cannot reach.
+type unreachableBackend struct {
+	dcd.MemoryBackend
+}
+
+var errUnreachable = &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}
+
+func (b *unreachableBackend) GetBuildID(ctx context.Context, component string) (int64, error) {
+	return 0, errUnreachable
+}
+
+func (b *unreachableBackend) StartPipeline(ctx context.Context, state *dcd.PipelineState) error {
+	return errUnreachable
+}
+
+func runOfflinePipeline(t *testing.T, backend dcd.Backend, outbox *dcd.Outbox) []dcd.Event {
+	t.Helper()
+	pipeline := dcd.NewPipeline()
+	pipeline.SetMetadata(&dcd.Metadata{
+		Component: "test-component",
+		GitSHA:    "test-git-sha",
+	})
+	pipeline.SetDefinition(&dcd.PipelineDefinition{
+		Steps: []dcd.Step{
+			{
+				Name:   "SuccessStep",
+				Script: "../../test/step-defs/success/run.sh",
+			},
+		},
+	})
+	pipeline.SetBackend(backend)
+	pipeline.SetOutbox(outbox)
+	eventsChan, err := pipeline.Run()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	var events []dcd.Event
+	for event := range eventsChan {
+		events = append(events, event)
+	}
+	return events
+}
+
+func TestOutboxProvisionalBuild(t *testing.T) {
+	// Given a build run while the backend is unreachable
+	ctx := context.Background()
+	outbox := dcd.NewOutbox(t.TempDir())
+	events := runOfflinePipeline(t, &unreachableBackend{}, outbox)
+	var offline, succeeded bool
+	for _, event := range events {
+		switch event.(type) {
+		case dcd.BackendOfflineEvent:
+			offline = true
+		case dcd.PipelineSuccessEvent:
+			succeeded = true
+		}
+	}
+	if !offline || !succeeded {
+		t.Fatalf("Expected the pipeline to succeed offline, got:\n%s", dumpEvents(events))
+	}
+	pending, err := outbox.ListBuilds(ctx, &dcd.BuildQuery{Component: "test-component"})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(pending) != 1 || !pending[0].Provisional || pending[0].BuildID != 1 || pending[0].Status != dcd.StatusSucceeded {
+		t.Fatalf("Expected a succeeded provisional build 1 in the outbox, got %+v", pending)
+	}
+
+	// When
+	backend := dcd.NewMemoryBackend()
+	for i := 0; i < 2; i++ {
+		if _, err := backend.GetBuildID(ctx, "test-component"); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+	synced, err := outbox.Sync(ctx, backend, false)
+
+	// Then
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(synced) != 1 || synced[0].BuildID != 3 || synced[0].ProvisionalID != 1 {
+		t.Fatalf("Expected provisional build 1 to be synced as build 3, got %+v", synced)
+	}
+	state, err := backend.GetPipeline(ctx, "test-component", 3)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if state.Status != dcd.StatusSucceeded || state.BuildID != 3 {
+		t.Errorf("Expected build 3 to have succeeded, got %+v", state)
+	}
+	page, err := backend.ListPipelineEvents(ctx, "test-component", 3, "", 0)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(page.Events) != synced[0].Events || len(page.Events) == 0 {
+		t.Fatalf("Expected %d events, got %d", synced[0].Events, len(page.Events))
+	}
+	if start, ok := page.Events[0].(dcd.PipelineStartEvent); !ok || start.BuildID != 3 {
+		t.Errorf("Expected the first event to start build 3, got %#v", page.Events[0])
+	}
+	if pending, _ := outbox.ListBuilds(ctx, &dcd.BuildQuery{Component: "test-component"}); len(pending) != 0 {
+		t.Errorf("Expected the outbox to be empty, got %+v", pending)
+	}
+}
+
+// refusingBackend refuses to allocate build IDs, like a backend the
+// credentials do not give access to.
+type refusingBackend struct {
+	dcd.MemoryBackend
+}
+
+func (b *refusingBackend) GetBuildID(ctx context.Context, component string) (int64, error) {
+	return 0, errors.New("access denied")
+}
+
+func TestPipelineDoesNotGoOfflineWhenTheBackendRefusesABuildID(t *testing.T) {
+	// Given
+	ctx := context.Background()
+	outbox := dcd.NewOutbox(t.TempDir())
+	pipeline := dcd.NewPipeline()
+	pipeline.SetMetadata(&dcd.Metadata{Component: "test-component", GitSHA: "test-git-sha"})
+	pipeline.SetDefinition(&dcd.PipelineDefinition{
+		Steps: []dcd.Step{{Name: "SuccessStep", Script: "../../test/step-defs/success/run.sh"}},
+	})
+	pipeline.SetBackend(&refusingBackend{})
+	pipeline.SetOutbox(outbox)
+
+	// When
+	_, err := pipeline.Run()
+
+	// Then the build fails to start rather than being recorded in the outbox
+	if err == nil || err.Error() != "failed to get build ID: access denied" {
+		t.Fatalf("Expected the build ID error, got %v", err)
+	}
+	pending, err := outbox.ListBuilds(ctx, &dcd.BuildQuery{Component: "test-component"})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(pending) != 0 {
+		t.Errorf("Expected the outbox to be empty, got %+v", pending)
+	}
+}
+
+func TestOutboxSyncIsIdempotent(t *testing.T) {
+	// Given a build whose events could not be written, and a copy of the
+	// outbox from before it was synced
+	ctx := context.Background()
+	dir := t.TempDir()
+	outbox := dcd.NewOutbox(filepath.Join(dir, "outbox"))
+	backend := &MockBackend{EventErr: errUnreachable}
+	runOfflinePipeline(t, backend, outbox)
+	backend.EventErr = nil
+	if err := exec.Command("cp", "-r", outbox.Dir(), filepath.Join(dir, "copy")).Run(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	first, err := outbox.Sync(ctx, backend, false)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(first) != 1 || first[0].BuildID != 1 || first[0].Events == 0 {
+		t.Fatalf("Expected build 1 to be synced, got %+v", first)
+	}
+
+	// When the sync is repeated, as if it was interrupted before the outbox was cleared
+	if err := os.RemoveAll(outbox.Dir()); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if err := os.Rename(filepath.Join(dir, "copy"), outbox.Dir()); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	second, err := outbox.Sync(ctx, backend, false)
+
+	// Then
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(second) != 1 || second[0].Events != 0 {
+		t.Errorf("Expected no events to be written again, got %+v", second)
+	}
+	state, err := backend.GetPipeline(ctx, "test-component", 1)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if state.Status != dcd.StatusSucceeded {
+		t.Errorf("Expected build 1 to have succeeded, got %s", state.Status)
+	}
+}
+
+func TestOutboxSyncAfterReap(t *testing.T) {
+	// Given a build whose events could not be written, which dcd reap then
+	// marked abandoned
+	ctx := context.Background()
+	outbox := dcd.NewOutbox(t.TempDir())
+	backend := &MockBackend{EventErr: errUnreachable}
+	runOfflinePipeline(t, backend, outbox)
+	backend.EventErr = nil
+	abandoned, err := dcd.MarkAbandonedBuilds(ctx, backend, "test-component", 0)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(abandoned) != 1 {
+		t.Fatalf("Expected build 1 to be marked abandoned, got %+v", abandoned)
+	}
+
+	// When
+	synced, err := outbox.Sync(ctx, backend, false)
+
+	// Then
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(synced) != 1 || synced[0].BuildID != 1 || synced[0].Events == 0 {
+		t.Fatalf("Expected build 1 to be synced, got %+v", synced)
+	}
+	state, err := backend.GetPipeline(ctx, "test-component", 1)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if state.Status != dcd.StatusSucceeded {
+		t.Errorf("Expected build 1 to have succeeded, got %s", state.Status)
+	}
+	if pending, _ := outbox.ListBuilds(ctx, &dcd.BuildQuery{Component: "test-component"}); len(pending) != 0 {
+		t.Errorf("Expected the outbox to be empty, got %+v", pending)
+	}
+}
@@ -3,10 +3,12 @@ package dcd
 import (
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"os"
 	"os/exec"
+	"os/user"
 	"regexp"
 	"strconv"
 	"strings"
@@ -17,7 +19,39 @@ import (
 
 // NewPipeline creates a new Pipeline
 func NewPipeline() *Pipeline {
-	return &Pipeline{}
+	cancelled, cancel := context.WithCancelCause(context.Background())
+	return &Pipeline{cancelled: cancelled, cancel: cancel}
+}
+
+// Cancel stops a running pipeline: its running steps are stopped and no more
+// are started, then its cleanup steps run and it is recorded as cancelled.
+func (p *Pipeline) Cancel(reason string) {
+	p.cancel(errors.New(reason))
+}
+
+// Kill stops the processes of the running steps straight away, including any
+// they started, e.g. before dcd exits without waiting for a cancelled pipeline
+// to finish.
+func (p *Pipeline) Kill() {
+	p.runningMu.Lock()
+	defer p.runningMu.Unlock()
+	for cmd := range p.running {
+		killProcessGroup(cmd)
+	}
+}
+
+// setRunning records whether the process of a step is running, for Kill.
+func (p *Pipeline) setRunning(cmd *exec.Cmd, running bool) {
+	p.runningMu.Lock()
+	defer p.runningMu.Unlock()
+	if p.running == nil {
+		p.running = map[*exec.Cmd]bool{}
+	}
+	if running {
+		p.running[cmd] = true
+	} else {
+		delete(p.running, cmd)
+	}
 }
 
 // getRepoName extracts the repository name from a Git URL.
@@ -28,7 +62,7 @@ func getRepoName() (string, error) {
 	if err != nil {
 		return "", fmt.Errorf("failed to get git remote origin: %w", err)
 	}
-	gitURL := string(output)
+	gitURL := strings.TrimSpace(string(output))
 	repoName, err := getRepoNameFromGitURL(gitURL)
 	if err != nil {
 		return "", fmt.Errorf("failed to get repo name from git URL: %w", err)
@@ -58,26 +92,74 @@ func getGitSHA() (string, error) {
 	if err != nil {
 		return "", fmt.Errorf("failed to get git SHA: %w", err)
 	}
-	return string(output), nil
+	return strings.TrimSpace(string(output)), nil
 }
 
-// LoadMetadata gets the metadata from the environment.
-func (p *Pipeline) LoadMetadata() error {
+// getBranch gets the current branch, or HEAD if no branch is checked out.
+func getBranch() (string, error) {
+	cmd := exec.Command("git", "rev-parse", "--abbrev-ref", "HEAD")
+	output, err := cmd.Output()
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(output)), nil
+}
+
+// getUser gets who is running dcd: DCD_USER if set, otherwise the git user
+// email, otherwise the OS user.
+func getUser() string {
+	if name := os.Getenv("DCD_USER"); name != "" {
+		return name
+	}
+	if output, err := exec.Command("git", "config", "user.email").Output(); err == nil {
+		if email := strings.TrimSpace(string(output)); email != "" {
+			return email
+		}
+	}
+	if current, err := user.Current(); err == nil {
+		return current.Username
+	}
+	return ""
+}
+
+// ReadMetadata gets the metadata from the environment.
+func ReadMetadata() (*Metadata, error) {
 	repoName, err := getRepoName()
 	if err != nil {
-		return fmt.Errorf("failed to get repo name: %w", err)
+		return nil, fmt.Errorf("failed to get repo name: %w", err)
 	}
 	gitSha, err := getGitSHA()
 	if err != nil {
-		return fmt.Errorf("failed to get git SHA: %w", err)
+		return nil, fmt.Errorf("failed to get git SHA: %w", err)
 	}
-	p.metadata = &Metadata{
+	branch, err := getBranch()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get git branch: %w", err)
+	}
+	return &Metadata{
 		Component: repoName,
 		GitSHA:    gitSha,
+		Branch:    branch,
+		User:      getUser(),
+	}, nil
+}
+
+// LoadMetadata gets the metadata from the environment.
+func (p *Pipeline) LoadMetadata() error {
+	metadata, err := ReadMetadata()
+	if err != nil {
+		return err
 	}
+	p.metadata = metadata
 	return nil
 }
 
+// SetParameters sets the parameters of the pipeline, which when expressions
+// can refer to.
+func (p *Pipeline) SetParameters(params map[string]string) {
+	p.params = params
+}
+
 // SetMetadata sets the metadata.
 func (p *Pipeline) SetMetadata(metadata *Metadata) {
 	p.metadata = metadata
@@ -113,6 +195,25 @@ func (p *Pipeline) SetBackend(backend Backend) {
 	p.backend = backend
 }
 
+// SetOutbox sets the outbox the build is recorded in if the backend cannot be written to.
+func (p *Pipeline) SetOutbox(outbox *Outbox) {
+	p.outbox = outbox
+}
+
+// SetSecretProvider adds a provider of secrets, or replaces a built in one,
+// for references starting with name followed by a colon.
+func (p *Pipeline) SetSecretProvider(name string, provider SecretProvider) {
+	if p.secretProviders == nil {
+		p.secretProviders = map[string]SecretProvider{}
+	}
+	p.secretProviders[name] = provider
+}
+
+// SetArchive sets where step output is archived, rather than being stored in the backend.
+func (p *Pipeline) SetArchive(archive LogArchive) {
+	p.archive = archive
+}
+
 // Run the pipeline, streaming events to the provided channel.
 func (p *Pipeline) Run() (chan Event, error) {
 	if err := checkUncommittedChanges(); err != nil {
@@ -127,107 +228,213 @@ func (p *Pipeline) Run() (chan Event, error) {
 	if err := checkIfLocalIsAheadOfRemote(); err != nil {
 		return nil, err
 	}
+	if err := validateBuildIDFormat(p.definition.BuildIDFormat); err != nil {
+		return nil, err
+	}
+	if err := validateSteps(p.definition); err != nil {
+		return nil, err
+	}
+	if err := p.definition.Env.validate(); err != nil {
+		return nil, err
+	}
 	ctx := context.Background()
-	buildID, err := p.backend.GetBuildID(ctx)
+	secrets, err := p.resolveSecrets(ctx)
+	if err != nil {
+		return nil, err
+	}
+	env := p.definition.Env.hostEnv(os.Environ())
+	for k, v := range p.definition.GlobalEnv {
+		env = append(env, fmt.Sprintf("%s=%s", k, v))
+	}
+	for k, v := range secrets {
+		env = append(env, fmt.Sprintf("%s=%s", k, v))
+	}
+	secretNames := append([]string{}, p.definition.SecretEnv...)
+	for name := range secrets {
+		secretNames = append(secretNames, name)
+	}
+	envHash, envNames := envFingerprint(env, secretNames)
+	// Without the backend the build is recorded in the outbox, if there is
+	// one, with a provisional build ID if the backend could not allocate one.
+	var offlineReason error
+	provisional := false
+	buildID, err := p.backend.GetBuildID(ctx, p.metadata.Component)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get build ID: %w", err)
+		// A backend that refuses the request, e.g. for lack of permission,
+		// needs fixing rather than working around.
+		if p.outbox == nil || !isUnreachable(err) {
+			return nil, fmt.Errorf("failed to get build ID: %w", err)
+		}
+		offlineReason = err
+		provisional = true
+		if buildID, err = p.outbox.ProvisionalBuildID(ctx, p.metadata.Component); err != nil {
+			return nil, fmt.Errorf("failed to get provisional build ID: %w", err)
+		}
 	}
 
 	state := &PipelineState{
-		Status:  "pending",
-		BuildID: buildID,
+		BuildID:   buildID,
+		Component: p.metadata.Component,
+		GitSHA:    p.metadata.GitSHA,
+		User:      p.metadata.User,
+		Status:    StatusPending,
+		StartTime: time.Now(),
+	}
+	state.Heartbeat = state.StartTime
+	state.EnvHash = envHash
+	if p.definition.Env.RecordNames {
+		state.EnvNames = envNames
 	}
 
-	if err := p.backend.PutPipeline(ctx, state); err != nil {
-		return nil, fmt.Errorf("failed to put pipeline: %w", err)
+	if offlineReason == nil {
+		if err := p.backend.StartPipeline(ctx, state); err != nil {
+			var exists *BuildExistsError
+			if p.outbox == nil || errors.As(err, &exists) {
+				return nil, fmt.Errorf("failed to start pipeline: %w", err)
+			}
+			offlineReason = err
+		}
 	}
 
-	events := make(chan Event, 32)
+	recorder := newRecorder(ctx, p.backend, p.outbox, p.archive, state, provisional, offlineReason, HeartbeatInterval)
 	go func() {
-		defer close(events)
+		defer recorder.close()
 
-		events <- PipelineStartEvent{
+		recorder.emit(PipelineStartEvent{
 			BaseEvent: BaseEvent{EventTime: time.Now()},
 			BuildID:   buildID,
-		}
-		env := os.Environ()
-		for k, v := range p.definition.GlobalEnv {
-			env = append(env, fmt.Sprintf("%s=%s", k, v))
-		}
+		})
 		env = append(env, fmt.Sprintf("COMPONENT=%s", p.metadata.Component))
 		env = append(env, fmt.Sprintf("GIT_SHA=%s", p.metadata.GitSHA))
-		env = append(env, fmt.Sprintf("BUILD_ID=%d", buildID))
-		for _, step := range p.definition.Steps {
-			events <- StepStartEvent{BaseEvent{EventTime: time.Now()}, step.Name}
-			err := p.runStep(env, step, events)
-			if err != nil {
-				events <- StepFailureEvent{BaseEvent{EventTime: time.Now()}, fmt.Sprintf("step '%s' failed", step.Name), err.Error()}
-				events <- PipelineFailureEvent{BaseEvent{EventTime: time.Now()}, fmt.Sprintf("step '%s' failed", step.Name)}
-				return
-			}
-			events <- StepSuccessEvent{BaseEvent{EventTime: time.Now()}, step.Name}
+		id := strconv.FormatInt(buildID, 10)
+		if provisional {
+			id = ProvisionalBuildIDString(buildID)
+		}
+		env = append(env, fmt.Sprintf("BUILD_ID=%s", formatBuildID(p.definition.BuildIDFormat, p.metadata.Component, id)))
+		var secretValues []string
+		for _, name := range p.definition.SecretEnv {
+			secretValues = append(secretValues, envValue(env, name))
+		}
+		for _, value := range secrets {
+			secretValues = append(secretValues, value)
+		}
+		masker := newSecretMasker(secretValues)
+		conditions := p.newConditions(env)
+		reason := p.runSteps(env, masker, recorder, conditions)
+		if cleanupReason := p.runCleanupSteps(env, masker, recorder, conditions); reason == "" {
+			reason = cleanupReason
+		}
+		switch {
+		case p.cancelled.Err() != nil:
+			recorder.emit(PipelineCancelledEvent{BaseEvent{EventTime: time.Now()}, context.Cause(p.cancelled).Error()})
+		case reason != "":
+			recorder.emit(PipelineFailureEvent{BaseEvent{EventTime: time.Now()}, reason})
+		default:
+			recorder.emit(PipelineSuccessEvent{BaseEvent{EventTime: time.Now()}})
 		}
-		events <- PipelineSuccessEvent{BaseEvent{EventTime: time.Now()}}
 	}()
-	return events, nil
+	return recorder.events, nil
 }
 
-func (p *Pipeline) runStep(env []string, step Step, events chan Event) error {
-	cmd := exec.Command(step.Script)
-	stdout, err := cmd.StdoutPipe()
-	if err != nil {
-		return err
+// FormatBuildID formats a build ID as passed to steps. An empty format gives
+// just the build number.
+func FormatBuildID(format, component string, buildID int64) string {
+	return formatBuildID(format, component, strconv.FormatInt(buildID, 10))
+}
+
+func formatBuildID(format, component, id string) string {
+	if format == "" {
+		return id
+	}
+	return strings.NewReplacer("{component}", component, "{id}", id).Replace(format)
+}
+
+// envValue returns the value of a variable in env, where later entries
+// override earlier ones as they do for a command.
+func envValue(env []string, name string) string {
+	value := ""
+	for _, entry := range env {
+		if key, v, ok := strings.Cut(entry, "="); ok && key == name {
+			value = v
+		}
 	}
-	cmd.Stderr = cmd.Stdout
+	return value
+}
+
+// validateBuildIDFormat checks a build ID format includes the build number,
+// so that the BUILD_ID of each build is unique.
+func validateBuildIDFormat(format string) error {
+	if format != "" && !strings.Contains(format, "{id}") {
+		return fmt.Errorf("invalid build-id-format %q: must contain {id}", format)
+	}
+	return nil
+}
+
+// runStep runs a step, emitting its output with secrets masked.
+func (p *Pipeline) runStep(ctx context.Context, env []string, step Step, masker *secretMasker, emit func(Event)) error {
+	cmd := exec.CommandContext(ctx, step.Script)
+	stopped := stopProcessGroup(cmd, p.gracePeriod())
+	defer stopped()
+	output := &stepOutput{step: step.Name, masker: masker, emit: emit}
+	cmd.Stdout = output
+	cmd.Stderr = output
 	cmd.Env = env
 	if err := cmd.Start(); err != nil {
 		return err
 	}
-	done := make(chan error)
-	go func() {
-		var remainder []byte
-		buffer := make([]byte, 16*1024)
-		for {
-			n, err := stdout.Read(buffer)
-			if err != nil {
-				if err == io.EOF {
-					break
-				}
-				done <- err
-				return
-			}
-			chunk := append(remainder, buffer[:n]...)
-			i := bytes.LastIndex(chunk, []byte{'\n'})
-			if i == -1 {
-				remainder = chunk
-				continue
-			}
-			events <- StepOutputEvent{
-				BaseEvent{EventTime: time.Now()},
-				step.Name,
-				string(chunk[:i+1]),
-			}
-			remainder = chunk[i+1:]
-		}
-		if len(remainder) > 0 {
-			events <- StepOutputEvent{
-				BaseEvent{EventTime: time.Now()},
-				step.Name,
-				string(remainder),
-			}
-		}
-		done <- nil
-	}()
-
-	if err := cmd.Wait(); err != nil {
+	p.setRunning(cmd, true)
+	err := cmd.Wait()
+	p.setRunning(cmd, false)
+	output.flush()
+	// A process the step left running in the background may still hold its
+	// output open, which is only waited for until WaitDelay, so the step
+	// still succeeds.
+	if err != nil && !errors.Is(err, exec.ErrWaitDelay) {
 		return fmt.Errorf("command failed: %w", err)
 	}
+	return nil
+}
 
-	if err := <-done; err != nil {
-		return fmt.Errorf("reading command output failed: %w", err)
-	}
+// stepOutput emits the output of a step as it is written, a line at a time,
+// with secrets masked.
+type stepOutput struct {
+	step      string
+	masker    *secretMasker
+	emit      func(Event)
+	remainder []byte
+}
 
-	return nil
+func (o *stepOutput) Write(data []byte) (int, error) {
+	chunk := append(o.remainder, data...)
+	i := bytes.LastIndex(chunk, []byte{'\n'})
+	if i == -1 {
+		o.remainder = chunk
+		return len(data), nil
+	}
+	output := o.masker.mask(string(chunk[:i+1]))
+	// Hold back the start of a secret that may continue in the next chunk.
+	held := o.masker.partialSecret(output)
+	if held < len(output) {
+		o.emit(StepOutputEvent{
+			BaseEvent{EventTime: time.Now()},
+			o.step,
+			output[:len(output)-held],
+		})
+	}
+	o.remainder = append([]byte(output[len(output)-held:]), chunk[i+1:]...)
+	return len(data), nil
+}
+
+// flush emits any output after the last line.
+func (o *stepOutput) flush() {
+	if len(o.remainder) > 0 {
+		o.emit(StepOutputEvent{
+			BaseEvent{EventTime: time.Now()},
+			o.step,
+			o.masker.mask(string(o.remainder)),
+		})
+		o.remainder = nil
+	}
 }
 
 // checkUncommittedChanges checks if there are any uncommitted changes in the local repository.
@@ -43,3 +43,25 @@ func TestGetRepoName(t *testing.T) {
 		}
 	}
 }
+
+func TestFormatBuildID(t *testing.T) {
+	testCases := []struct {
+		format   string
+		expected string
+	}{
+		{"", "123"},
+		{"{id}", "123"},
+		{"{component}-{id}", "dcd-123"},
+		{"build-{id}", "build-123"},
+	}
+
+	for _, tc := range testCases {
+		if got := FormatBuildID(tc.format, "dcd", 123); got != tc.expected {
+			t.Errorf("Expected format '%s' to give '%s', got '%s'", tc.format, tc.expected, got)
+		}
+	}
+
+	if err := validateBuildIDFormat("{component}"); err == nil {
+		t.Errorf("Expected an error for a format without {id}, but got none")
+	}
+}
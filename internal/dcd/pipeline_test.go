@@ -1,32 +1,66 @@
 package dcd_test
 
 import (
+	"bytes"
 	"context"
+	"errors"
 	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
 	"testing"
+	"time"
+
+	"filippo.io/age"
 
 	"github.com/progsoftware/dcd/internal/dcd"
 )
 
+// MockBackend records what is written to it, and can be made to fail.
 type MockBackend struct {
-	BuildID int64
-}
+	dcd.MemoryBackend
+	States   []dcd.PipelineState
+	Events   []dcd.Event
+	EventErr error
 
-func (b *MockBackend) GetBuildID(ctx context.Context) (int64, error) {
-	b.BuildID++
-	return b.BuildID, nil
+	mu sync.Mutex
 }
 
-func (b *MockBackend) StartPipeline(ctx context.Context, buildID int64) error {
-	return nil
+func (b *MockBackend) StartPipeline(ctx context.Context, state *dcd.PipelineState) error {
+	b.mu.Lock()
+	b.States = append(b.States, *state)
+	b.mu.Unlock()
+	return b.MemoryBackend.StartPipeline(ctx, state)
 }
 
 func (b *MockBackend) PutPipeline(ctx context.Context, state *dcd.PipelineState) error {
-	return nil
+	b.mu.Lock()
+	b.States = append(b.States, *state)
+	b.mu.Unlock()
+	return b.MemoryBackend.PutPipeline(ctx, state)
+}
+
+func (b *MockBackend) PutPipelineEvent(ctx context.Context, component string, buildID int64, event dcd.Event) error {
+	if b.EventErr != nil {
+		return b.EventErr
+	}
+	b.mu.Lock()
+	b.Events = append(b.Events, event)
+	b.mu.Unlock()
+	return b.MemoryBackend.PutPipelineEvent(ctx, component, buildID, event)
 }
 
-func (b *MockBackend) PutPipelineEvent(ctx context.Context, event dcd.Event) error {
-	return nil
+func (b *MockBackend) PutPipelineEvents(ctx context.Context, component string, buildID int64, events []dcd.Event) error {
+	if b.EventErr != nil {
+		return b.EventErr
+	}
+	b.mu.Lock()
+	b.Events = append(b.Events, events...)
+	b.mu.Unlock()
+	return b.MemoryBackend.PutPipelineEvents(ctx, component, buildID, events)
 }
 
 func TestSingleStepPipelineSuccess(t *testing.T) {
@@ -113,6 +147,567 @@ func TestSingleStepPipelineSuccess(t *testing.T) {
 	}
 }
 
+func TestPipelineEventsArePersisted(t *testing.T) {
+	// Given
+	backend := &MockBackend{}
+	pipeline := dcd.NewPipeline()
+	pipeline.SetMetadata(&dcd.Metadata{
+		Component: "test-component",
+		GitSHA:    "test-git-sha",
+	})
+	pipeline.SetDefinition(&dcd.PipelineDefinition{
+		Steps: []dcd.Step{
+			{
+				Name:   "SuccessStep",
+				Script: "../../test/step-defs/success/run.sh",
+			},
+		},
+	})
+	pipeline.SetBackend(backend)
+
+	// When
+	eventsChan, err := pipeline.Run()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	var events []dcd.Event
+	for event := range eventsChan {
+		events = append(events, event)
+	}
+
+	// Then
+	// Output may be combined into fewer events when it is persisted.
+	persisted, emitted := joinOutput(backend.Events), joinOutput(events)
+	if len(persisted) != len(emitted) {
+		t.Fatalf("Expected %d persisted events, got %d:\n%s", len(emitted), len(persisted), dumpEvents(backend.Events))
+	}
+	for i := range emitted {
+		if persisted[i].LogMessage() != emitted[i].LogMessage() {
+			t.Errorf("Expected persisted event %d to be %q, got %q", i, emitted[i].LogMessage(), persisted[i].LogMessage())
+		}
+	}
+	expectedStatuses := []string{"pending", "running", "succeeded"}
+	if statuses := stateStatuses(backend.States); !reflect.DeepEqual(statuses, expectedStatuses) {
+		t.Errorf("Expected statuses %v, got %v", expectedStatuses, statuses)
+	}
+	if final := backend.States[len(backend.States)-1]; final.EndTime.IsZero() || final.Component != "test-component" {
+		t.Errorf("Expected final state to have an end time and component, got %+v", final)
+	}
+}
+
+func TestPipelineFailureIsPersisted(t *testing.T) {
+	// Given
+	backend := &MockBackend{}
+	pipeline := dcd.NewPipeline()
+	pipeline.SetMetadata(&dcd.Metadata{
+		Component: "test-component",
+		GitSHA:    "test-git-sha",
+	})
+	pipeline.SetDefinition(&dcd.PipelineDefinition{
+		Steps: []dcd.Step{
+			{
+				Name:   "FailureStep",
+				Script: "../../test/step-defs/failure/run.sh",
+			},
+		},
+	})
+	pipeline.SetBackend(backend)
+
+	// When
+	eventsChan, err := pipeline.Run()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	for range eventsChan {
+	}
+
+	// Then
+	expectedStatuses := []string{"pending", "running", "failed"}
+	if statuses := stateStatuses(backend.States); !reflect.DeepEqual(statuses, expectedStatuses) {
+		t.Errorf("Expected statuses %v, got %v", expectedStatuses, statuses)
+	}
+	var stepFailure *dcd.StepFailureEvent
+	for _, event := range backend.Events {
+		if e, ok := event.(dcd.StepFailureEvent); ok {
+			stepFailure = &e
+		}
+	}
+	if stepFailure == nil || stepFailure.StepName != "FailureStep" {
+		t.Errorf("Expected a persisted StepFailureEvent for FailureStep, got:\n%s", dumpEvents(backend.Events))
+	}
+}
+
+func TestPipelineDeploymentIsRecorded(t *testing.T) {
+	// Given
+	backend := &MockBackend{}
+	pipeline := dcd.NewPipeline()
+	pipeline.SetMetadata(&dcd.Metadata{
+		Component: "test-component",
+		GitSHA:    "test-git-sha",
+	})
+	pipeline.SetDefinition(&dcd.PipelineDefinition{
+		Steps: []dcd.Step{
+			{
+				Name:   "BuildStep",
+				Script: "../../test/step-defs/success/run.sh",
+			},
+			{
+				Name:       "DeployStep",
+				Script:     "../../test/step-defs/success/run.sh",
+				Deployment: true,
+			},
+		},
+	})
+	pipeline.SetBackend(backend)
+
+	// When
+	eventsChan, err := pipeline.Run()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	for range eventsChan {
+	}
+
+	// Then
+	state, err := backend.GetPipeline(context.Background(), "test-component", 1)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !state.Deployed || state.Status != dcd.StatusSucceeded {
+		t.Errorf("Expected a succeeded deployment, got %+v", state)
+	}
+}
+
+func TestPipelineMasksSecrets(t *testing.T) {
+	// Given
+	backend := &MockBackend{}
+	pipeline := dcd.NewPipeline()
+	pipeline.SetMetadata(&dcd.Metadata{
+		Component: "test-component",
+		GitSHA:    "test-git-sha",
+	})
+	pipeline.SetDefinition(&dcd.PipelineDefinition{
+		GlobalEnv: map[string]string{
+			"SECRET_TOKEN": "tok3n-value-123",
+			"PRIVATE_KEY":  "-----BEGIN KEY-----\nkey-body\n-----END KEY-----",
+			"SHORT_SECRET": "abc",
+		},
+		SecretEnv: []string{"SECRET_TOKEN", "PRIVATE_KEY", "SHORT_SECRET", "UNSET_SECRET"},
+		Steps: []dcd.Step{
+			{
+				Name:   "SecretStep",
+				Script: "../../test/step-defs/secrets/run.sh",
+			},
+		},
+	})
+	pipeline.SetBackend(backend)
+
+	// When
+	eventsChan, err := pipeline.Run()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	var events []dcd.Event
+	for event := range eventsChan {
+		events = append(events, event)
+	}
+
+	// Then
+	expected := "token: ***\nsplit: *** end\n***\ngithub token: ***\nshort: abc\n"
+	for name, recorded := range map[string][]dcd.Event{"emitted": events, "persisted": backend.Events} {
+		var output string
+		for _, event := range recorded {
+			if event, ok := event.(dcd.StepOutputEvent); ok {
+				output += event.Output
+			}
+		}
+		if output != expected {
+			t.Errorf("Expected %s output %q, got %q", name, expected, output)
+		}
+	}
+}
+
+// staticSecretProvider resolves references from a map.
+type staticSecretProvider map[string]string
+
+func (p staticSecretProvider) Resolve(ctx context.Context, ref string) (string, error) {
+	value, ok := p[ref]
+	if !ok {
+		return "", fmt.Errorf("no secret %s", ref)
+	}
+	return value, nil
+}
+
+func TestPipelineResolvesSecrets(t *testing.T) {
+	// Given secrets in the environment, a file, an age encrypted file and a custom store
+	dir := t.TempDir()
+	t.Setenv("DCD_TEST_ENV_SECRET", "from-environment")
+	if err := os.WriteFile(filepath.Join(dir, "secret.txt"), []byte("from-file\n"), 0o600); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	t.Setenv("DCD_AGE_KEY", identity.String())
+	var encrypted bytes.Buffer
+	writer, err := age.Encrypt(&encrypted, identity.Recipient())
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	fmt.Fprintln(writer, "db-password: from-age")
+	if err := writer.Close(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "secrets.yaml.age"), encrypted.Bytes(), 0o600); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	backend := &MockBackend{}
+	pipeline := dcd.NewPipeline()
+	pipeline.SetMetadata(&dcd.Metadata{
+		Component: "test-component",
+		GitSHA:    "test-git-sha",
+	})
+	pipeline.SetDefinition(&dcd.PipelineDefinition{
+		Secrets: map[string]string{
+			"ENV_SECRET":    "env:DCD_TEST_ENV_SECRET",
+			"FILE_SECRET":   "file:" + filepath.Join(dir, "secret.txt"),
+			"AGE_SECRET":    "age:" + filepath.Join(dir, "secrets.yaml.age") + "#db-password",
+			"CUSTOM_SECRET": "vault:deploy-key",
+		},
+		Steps: []dcd.Step{
+			{
+				Name:   "SecretStep",
+				Script: "../../test/step-defs/secret-env/run.sh",
+			},
+		},
+	})
+	pipeline.SetSecretProvider("vault", staticSecretProvider{"deploy-key": "from-vault"})
+	pipeline.SetBackend(backend)
+
+	// When
+	eventsChan, err := pipeline.Run()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	var output string
+	for event := range eventsChan {
+		if event, ok := event.(dcd.StepOutputEvent); ok {
+			output += event.Output
+		}
+	}
+
+	// Then the secrets are passed to the step and masked
+	expected := "ENV_SECRET: *** (16 characters)\nFILE_SECRET: *** (9 characters)\nAGE_SECRET: *** (8 characters)\nCUSTOM_SECRET: *** (10 characters)\n"
+	if output != expected {
+		t.Errorf("Expected output %q, got %q", expected, output)
+	}
+}
+
+func TestPipelineFailsOnUnresolvedSecrets(t *testing.T) {
+	testCases := []struct {
+		ref      string
+		expected string
+	}{
+		{"unknown:NAME", `invalid secret TOKEN: unknown provider "unknown" in "unknown:NAME"`},
+		{"no-provider", `invalid secret TOKEN: unknown provider "no-provider" in "no-provider"`},
+		{"env:DCD_TEST_UNSET_SECRET", "failed to resolve secret TOKEN from env:DCD_TEST_UNSET_SECRET: environment variable DCD_TEST_UNSET_SECRET is not set"},
+	}
+
+	for _, tc := range testCases {
+		// Given
+		backend := &MockBackend{}
+		pipeline := dcd.NewPipeline()
+		pipeline.SetMetadata(&dcd.Metadata{Component: "test-component", GitSHA: "test-git-sha"})
+		pipeline.SetDefinition(&dcd.PipelineDefinition{
+			Secrets: map[string]string{"TOKEN": tc.ref},
+			Steps:   []dcd.Step{{Name: "Step", Script: "../../test/step-defs/success/run.sh"}},
+		})
+		pipeline.SetBackend(backend)
+
+		// When
+		_, err := pipeline.Run()
+
+		// Then no build is started
+		if err == nil || err.Error() != tc.expected {
+			t.Errorf("Expected error %q, got %v", tc.expected, err)
+		}
+		if len(backend.States) != 0 {
+			t.Errorf("Expected no build to be started for %s, got %d states", tc.ref, len(backend.States))
+		}
+	}
+}
+
+func TestPipelineAllowlistEnv(t *testing.T) {
+	// Given
+	t.Setenv("DCD_TEST_ALLOWED", "allowed-value")
+	t.Setenv("DCD_TEST_HIDDEN", "hidden-value")
+	backend := &MockBackend{}
+	pipeline := dcd.NewPipeline()
+	pipeline.SetMetadata(&dcd.Metadata{
+		Component: "test-component",
+		GitSHA:    "test-git-sha",
+	})
+	pipeline.SetDefinition(&dcd.PipelineDefinition{
+		GlobalEnv: map[string]string{
+			"GLOBAL_ENV_VAR": "global_env_var_value",
+		},
+		Env: dcd.EnvConfig{
+			Mode:        dcd.EnvModeAllowlist,
+			Allow:       []string{"DCD_TEST_ALLOWED"},
+			RecordNames: true,
+		},
+		Steps: []dcd.Step{
+			{
+				Name:   "EnvStep",
+				Script: "../../test/step-defs/env/run.sh",
+			},
+		},
+	})
+	pipeline.SetBackend(backend)
+
+	// When
+	eventsChan, err := pipeline.Run()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	var output string
+	for event := range eventsChan {
+		if event, ok := event.(dcd.StepOutputEvent); ok {
+			output += event.Output
+		}
+	}
+
+	// Then
+	expected := "allowed: allowed-value\nhidden: unset\nglobal env var: global_env_var_value\ncomponent: test-component\n"
+	if output != expected {
+		t.Errorf("Expected output %q, got %q", expected, output)
+	}
+	state, err := backend.GetPipeline(context.Background(), "test-component", 1)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if expected := []string{"DCD_TEST_ALLOWED", "GLOBAL_ENV_VAR"}; !reflect.DeepEqual(state.EnvNames, expected) {
+		t.Errorf("Expected the environment names %v to be recorded, got %v", expected, state.EnvNames)
+	}
+	if len(state.EnvHash) != 64 {
+		t.Errorf("Expected the environment hash to be recorded, got %q", state.EnvHash)
+	}
+}
+
+func TestPipelineEnvHashLeavesOutSecretEnv(t *testing.T) {
+	runWithSecret := func(value string) string {
+		t.Setenv("DCD_TEST_SECRET", value)
+		backend := &MockBackend{}
+		pipeline := dcd.NewPipeline()
+		pipeline.SetMetadata(&dcd.Metadata{
+			Component: "test-component",
+			GitSHA:    "test-git-sha",
+		})
+		pipeline.SetDefinition(&dcd.PipelineDefinition{
+			SecretEnv: []string{"DCD_TEST_SECRET"},
+			Env: dcd.EnvConfig{
+				Mode:  dcd.EnvModeAllowlist,
+				Allow: []string{"DCD_TEST_SECRET"},
+			},
+			Steps: []dcd.Step{
+				{Name: "SuccessStep", Script: "../../test/step-defs/success/run.sh"},
+			},
+		})
+		pipeline.SetBackend(backend)
+		eventsChan, err := pipeline.Run()
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		for range eventsChan {
+		}
+		state, err := backend.GetPipeline(context.Background(), "test-component", 1)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		return state.EnvHash
+	}
+
+	// When the same pipeline runs with different values of a secret-env variable
+	first := runWithSecret("first-secret")
+	second := runWithSecret("second-secret")
+
+	// Then
+	if first != second {
+		t.Errorf("Expected the environment hash not to depend on the value of a secret, got %s and %s", first, second)
+	}
+}
+
+func TestPipelineRunsIndependentStepsInParallel(t *testing.T) {
+	// Given
+	backend := &MockBackend{}
+	pipeline := dcd.NewPipeline()
+	pipeline.SetMetadata(&dcd.Metadata{
+		Component: "test-component",
+		GitSHA:    "test-git-sha",
+	})
+	pipeline.SetDefinition(&dcd.PipelineDefinition{
+		MaxParallel: 2,
+		Steps: []dcd.Step{
+			{Name: "Lint", Script: "../../test/step-defs/sleep/run.sh"},
+			{Name: "Test", Script: "../../test/step-defs/sleep/run.sh"},
+			{Name: "Build", Script: "../../test/step-defs/sleep/run.sh"},
+			{Name: "Publish", Script: "../../test/step-defs/success/run.sh", DependsOn: []string{"Lint", "Test", "Build"}},
+		},
+	})
+	pipeline.SetBackend(backend)
+
+	// When
+	eventsChan, err := pipeline.Run()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	var order []string
+	for event := range eventsChan {
+		switch event := event.(type) {
+		case dcd.StepStartEvent:
+			order = append(order, "start "+event.StepName)
+		case dcd.StepSuccessEvent:
+			order = append(order, "success "+event.StepName)
+		case dcd.StepOutputEvent:
+			if event.StepName == "" {
+				t.Errorf("Expected output to be attributed to a step")
+			}
+		}
+	}
+
+	// Then two steps run at once, and Publish runs after the rest
+	if len(order) != 8 {
+		t.Fatalf("Expected 8 step events, got %v", order)
+	}
+	if !reflect.DeepEqual(order[:2], []string{"start Lint", "start Test"}) {
+		t.Errorf("Expected Lint and Test to start together, got %v", order)
+	}
+	if last := order[6:]; !reflect.DeepEqual(last, []string{"start Publish", "success Publish"}) {
+		t.Errorf("Expected Publish to run last, got %v", order)
+	}
+}
+
+func TestPipelineStopsSchedulingAfterFailure(t *testing.T) {
+	testCases := []struct {
+		onFailure     string
+		expectedSleep string
+	}{
+		{dcd.OnFailureWait, "Step succeeded: Sleep"},
+		{dcd.OnFailureCancel, "Step failed: Sleep, Reason: cancelled after step 'Fail' failed"},
+	}
+
+	for _, tc := range testCases {
+		// Given
+		backend := &MockBackend{}
+		pipeline := dcd.NewPipeline()
+		pipeline.SetMetadata(&dcd.Metadata{
+			Component: "test-component",
+			GitSHA:    "test-git-sha",
+		})
+		pipeline.SetDefinition(&dcd.PipelineDefinition{
+			MaxParallel: 2,
+			OnFailure:   tc.onFailure,
+			Steps: []dcd.Step{
+				{Name: "Sleep", Script: "../../test/step-defs/sleep/run.sh", DependsOn: []string{}},
+				{Name: "Fail", Script: "../../test/step-defs/failure/run.sh"},
+				{Name: "AfterSleep", Script: "../../test/step-defs/success/run.sh", DependsOn: []string{"Sleep"}},
+			},
+		})
+		pipeline.SetBackend(backend)
+
+		// When
+		eventsChan, err := pipeline.Run()
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		var messages []string
+		for event := range eventsChan {
+			if _, ok := event.(dcd.StepOutputEvent); !ok {
+				messages = append(messages, event.LogMessage())
+			}
+		}
+
+		// Then
+		expected := []string{
+			"Pipeline start",
+			"Step started: Sleep",
+			"Step started: Fail",
+			"Step failed: Fail, Reason: command failed: exit status 1",
+			tc.expectedSleep,
+			"Pipeline failed: step 'Fail' failed",
+		}
+		if !reflect.DeepEqual(messages, expected) {
+			t.Errorf("Expected events with on-failure %s:\n%s\ngot:\n%s", tc.onFailure, strings.Join(expected, "\n"), strings.Join(messages, "\n"))
+		}
+	}
+}
+
+func TestPipelineBackendErrorsAreReported(t *testing.T) {
+	// Given
+	backend := &MockBackend{EventErr: errors.New("backend unavailable")}
+	pipeline := dcd.NewPipeline()
+	pipeline.SetMetadata(&dcd.Metadata{
+		Component: "test-component",
+		GitSHA:    "test-git-sha",
+	})
+	pipeline.SetDefinition(&dcd.PipelineDefinition{
+		Steps: []dcd.Step{},
+	})
+	pipeline.SetBackend(backend)
+
+	// When
+	eventsChan, err := pipeline.Run()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	var backendErrors []dcd.BackendErrorEvent
+	succeeded := false
+	for event := range eventsChan {
+		switch e := event.(type) {
+		case dcd.BackendErrorEvent:
+			backendErrors = append(backendErrors, e)
+		case dcd.PipelineSuccessEvent:
+			succeeded = true
+		}
+	}
+
+	// Then
+	if len(backendErrors) == 0 {
+		t.Fatalf("Expected BackendErrorEvents, got none")
+	}
+	if !strings.Contains(backendErrors[0].LogMessage(), "backend unavailable") {
+		t.Errorf("Expected error to include the backend error, got %q", backendErrors[0].LogMessage())
+	}
+	if !succeeded {
+		t.Errorf("Expected pipeline to still succeed")
+	}
+}
+
+// joinOutput combines consecutive output of the same step into one event.
+func joinOutput(events []dcd.Event) []dcd.Event {
+	var joined []dcd.Event
+	for _, event := range events {
+		if output, ok := event.(dcd.StepOutputEvent); ok && len(joined) > 0 {
+			if previous, ok := joined[len(joined)-1].(dcd.StepOutputEvent); ok && previous.StepName == output.StepName {
+				previous.Output += output.Output
+				joined[len(joined)-1] = previous
+				continue
+			}
+		}
+		joined = append(joined, event)
+	}
+	return joined
+}
+
+func stateStatuses(states []dcd.PipelineState) []string {
+	var statuses []string
+	for _, state := range states {
+		statuses = append(statuses, state.Status)
+	}
+	return statuses
+}
+
 func dumpEvents(events []dcd.Event) string {
 	var dump string
 	for i, event := range events {
@@ -133,3 +728,469 @@ func dumpEvent(i int, event dcd.Event) string {
 	}
 	return fmt.Sprintf("%d: %T\n", i, event)
 }
+
+func TestPipelineStopsStepsThatTimeOut(t *testing.T) {
+	testCases := []struct {
+		name           string
+		stepTimeout    time.Duration
+		timeout        time.Duration
+		ignoreSIGTERM  string
+		expectedStep   string
+		expectedReason string
+	}{
+		{"step timeout", 200 * time.Millisecond, 0, "", "Step timed out: Hang after 200ms", "step 'Hang' timed out after 200ms"},
+		{"SIGTERM ignored", 200 * time.Millisecond, 0, "1", "Step timed out: Hang after 200ms", "step 'Hang' timed out after 200ms"},
+		{"pipeline timeout", 0, 300 * time.Millisecond, "", "Step timed out: Hang, the pipeline timed out after 300ms", "timed out after 300ms"},
+	}
+
+	for _, tc := range testCases {
+		// Given
+		backend := &MockBackend{}
+		pipeline := dcd.NewPipeline()
+		pipeline.SetMetadata(&dcd.Metadata{
+			Component: "test-component",
+			GitSHA:    "test-git-sha",
+		})
+		pipeline.SetDefinition(&dcd.PipelineDefinition{
+			GlobalEnv:   map[string]string{"IGNORE_SIGTERM": tc.ignoreSIGTERM},
+			Timeout:     tc.timeout,
+			GracePeriod: 200 * time.Millisecond,
+			Steps: []dcd.Step{
+				{Name: "Hang", Script: "../../test/step-defs/hang/run.sh", Timeout: tc.stepTimeout},
+				{Name: "After", Script: "../../test/step-defs/success/run.sh"},
+			},
+		})
+		pipeline.SetBackend(backend)
+
+		// When
+		start := time.Now()
+		eventsChan, err := pipeline.Run()
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		var messages []string
+		for event := range eventsChan {
+			if _, ok := event.(dcd.StepOutputEvent); !ok {
+				messages = append(messages, event.LogMessage())
+			}
+		}
+
+		// Then the step and the process it started are stopped
+		if elapsed := time.Since(start); elapsed > 5*time.Second {
+			t.Errorf("Expected the %s to stop the step and its children, took %s", tc.name, elapsed)
+		}
+		expected := []string{
+			"Pipeline start",
+			"Step started: Hang",
+			tc.expectedStep,
+			"Pipeline failed: " + tc.expectedReason,
+		}
+		if !reflect.DeepEqual(messages, expected) {
+			t.Errorf("Expected events with %s:\n%s\ngot:\n%s", tc.name, strings.Join(expected, "\n"), strings.Join(messages, "\n"))
+		}
+	}
+}
+
+func TestPipelineDoesNotWaitForBackgroundProcesses(t *testing.T) {
+	// Given a step that leaves a process running that holds its output open
+	pipeline := dcd.NewPipeline()
+	pipeline.SetMetadata(&dcd.Metadata{
+		Component: "test-component",
+		GitSHA:    "test-git-sha",
+	})
+	pipeline.SetDefinition(&dcd.PipelineDefinition{
+		GracePeriod: 200 * time.Millisecond,
+		Steps: []dcd.Step{
+			{Name: "Background", Script: "../../test/step-defs/background/run.sh"},
+		},
+	})
+	pipeline.SetBackend(&MockBackend{})
+
+	// When
+	start := time.Now()
+	eventsChan, err := pipeline.Run()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	var messages []string
+	for event := range eventsChan {
+		messages = append(messages, event.LogMessage())
+	}
+
+	// Then the step finishes once its output has been waited for
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Expected the step not to wait for its background process, took %s", elapsed)
+	}
+	expected := []string{
+		"Pipeline start",
+		"Step started: Background",
+		"Output from Background: done\n",
+		"Step succeeded: Background",
+		"Pipeline succeeded",
+	}
+	if !reflect.DeepEqual(messages, expected) {
+		t.Errorf("Expected events:\n%s\ngot:\n%s", strings.Join(expected, "\n"), strings.Join(messages, "\n"))
+	}
+}
+
+func TestPipelineRunsCleanupStepsAfterFailure(t *testing.T) {
+	// Given
+	backend := &MockBackend{}
+	pipeline := dcd.NewPipeline()
+	pipeline.SetMetadata(&dcd.Metadata{
+		Component: "test-component",
+		GitSHA:    "test-git-sha",
+	})
+	pipeline.SetDefinition(&dcd.PipelineDefinition{
+		Steps: []dcd.Step{
+			{Name: "Fail", Script: "../../test/step-defs/failure/run.sh"},
+			{Name: "Cleanup", Script: "../../test/step-defs/success/run.sh", Cleanup: true},
+			{Name: "After", Script: "../../test/step-defs/success/run.sh"},
+		},
+	})
+	pipeline.SetBackend(backend)
+
+	// When
+	eventsChan, err := pipeline.Run()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	var messages []string
+	for event := range eventsChan {
+		if _, ok := event.(dcd.StepOutputEvent); !ok {
+			messages = append(messages, event.LogMessage())
+		}
+	}
+
+	// Then
+	expected := []string{
+		"Pipeline start",
+		"Step started: Fail",
+		"Step failed: Fail, Reason: command failed: exit status 1",
+		"Step started: Cleanup",
+		"Step succeeded: Cleanup",
+		"Pipeline failed: step 'Fail' failed",
+	}
+	if !reflect.DeepEqual(messages, expected) {
+		t.Errorf("Expected events:\n%s\ngot:\n%s", strings.Join(expected, "\n"), strings.Join(messages, "\n"))
+	}
+}
+
+func TestPipelineCancel(t *testing.T) {
+	// Given
+	backend := &MockBackend{}
+	pipeline := dcd.NewPipeline()
+	pipeline.SetMetadata(&dcd.Metadata{
+		Component: "test-component",
+		GitSHA:    "test-git-sha",
+	})
+	pipeline.SetDefinition(&dcd.PipelineDefinition{
+		Steps: []dcd.Step{
+			{Name: "Hang", Script: "../../test/step-defs/hang/run.sh"},
+			{Name: "After", Script: "../../test/step-defs/success/run.sh"},
+			{Name: "Cleanup", Script: "../../test/step-defs/success/run.sh", Cleanup: true},
+		},
+	})
+	pipeline.SetBackend(backend)
+
+	// When the pipeline is cancelled once the step has started
+	start := time.Now()
+	eventsChan, err := pipeline.Run()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	var messages []string
+	for event := range eventsChan {
+		if output, ok := event.(dcd.StepOutputEvent); ok {
+			if output.StepName == "Hang" {
+				pipeline.Cancel("received interrupt")
+			}
+			continue
+		}
+		messages = append(messages, event.LogMessage())
+	}
+
+	// Then
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Expected cancelling to stop the step, took %s", elapsed)
+	}
+	expected := []string{
+		"Pipeline start",
+		"Step started: Hang",
+		"Step failed: Hang, Reason: cancelled: received interrupt",
+		"Step started: Cleanup",
+		"Step succeeded: Cleanup",
+		"Pipeline cancelled: received interrupt",
+	}
+	if !reflect.DeepEqual(messages, expected) {
+		t.Errorf("Expected events:\n%s\ngot:\n%s", strings.Join(expected, "\n"), strings.Join(messages, "\n"))
+	}
+	state, err := backend.GetPipeline(context.Background(), "test-component", 1)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if state.Status != dcd.StatusCancelled {
+		t.Errorf("Expected the build to be recorded as %s, got %s", dcd.StatusCancelled, state.Status)
+	}
+}
+
+func TestPipelineKill(t *testing.T) {
+	// Given a cancelled pipeline whose step ignores SIGTERM
+	pipeline := dcd.NewPipeline()
+	pipeline.SetMetadata(&dcd.Metadata{
+		Component: "test-component",
+		GitSHA:    "test-git-sha",
+	})
+	pipeline.SetDefinition(&dcd.PipelineDefinition{
+		GlobalEnv:   map[string]string{"IGNORE_SIGTERM": "1"},
+		GracePeriod: time.Minute,
+		Steps: []dcd.Step{
+			{Name: "Hang", Script: "../../test/step-defs/hang/run.sh"},
+		},
+	})
+	pipeline.SetBackend(&MockBackend{})
+
+	// When the pipeline is killed
+	start := time.Now()
+	eventsChan, err := pipeline.Run()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	var messages []string
+	for event := range eventsChan {
+		if output, ok := event.(dcd.StepOutputEvent); ok {
+			if output.StepName == "Hang" {
+				pipeline.Cancel("received interrupt")
+				pipeline.Kill()
+			}
+			continue
+		}
+		messages = append(messages, event.LogMessage())
+	}
+
+	// Then the step and the process it started are stopped without waiting
+	// for the grace period
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Expected killing to stop the step and its children, took %s", elapsed)
+	}
+	if last := messages[len(messages)-1]; last != "Pipeline cancelled: received interrupt" {
+		t.Errorf("Expected the pipeline to be cancelled, got:\n%s", strings.Join(messages, "\n"))
+	}
+}
+
+func TestPipelineRetriesFailedSteps(t *testing.T) {
+	testCases := []struct {
+		name             string
+		failures         string
+		exitCode         string
+		retry            dcd.RetryConfig
+		expectedAttempts []int
+		expectedResult   string
+		expectedRetried  []string
+	}{
+		{
+			"passes on retry", "2", "1", dcd.RetryConfig{MaxAttempts: 3, Backoff: 10 * time.Millisecond},
+			[]int{1, 2, 3}, "Step succeeded: Flaky", []string{"Flaky"},
+		},
+		{
+			"out of attempts", "3", "1", dcd.RetryConfig{MaxAttempts: 3, Backoff: 10 * time.Millisecond},
+			[]int{1, 2, 3}, "Step failed: Flaky, Reason: command failed: exit status 1 (after 3 attempts)", nil,
+		},
+		{
+			"exit code not retried", "2", "1", dcd.RetryConfig{MaxAttempts: 3, ExitCodes: []int{75}},
+			[]int{1}, "Step failed: Flaky, Reason: command failed: exit status 1", nil,
+		},
+		{
+			"exit code retried", "2", "75", dcd.RetryConfig{MaxAttempts: 3, ExitCodes: []int{75}},
+			[]int{1, 2, 3}, "Step succeeded: Flaky", []string{"Flaky"},
+		},
+	}
+
+	for _, tc := range testCases {
+		// Given
+		backend := &MockBackend{}
+		pipeline := dcd.NewPipeline()
+		pipeline.SetMetadata(&dcd.Metadata{
+			Component: "test-component",
+			GitSHA:    "test-git-sha",
+		})
+		pipeline.SetDefinition(&dcd.PipelineDefinition{
+			GlobalEnv: map[string]string{
+				"FLAKY_COUNT_FILE": filepath.Join(t.TempDir(), "count"),
+				"FLAKY_FAILURES":   tc.failures,
+				"FLAKY_EXIT_CODE":  tc.exitCode,
+			},
+			Steps: []dcd.Step{
+				{Name: "Flaky", Script: "../../test/step-defs/flaky/run.sh", Retry: tc.retry},
+			},
+		})
+		pipeline.SetBackend(backend)
+
+		// When
+		eventsChan, err := pipeline.Run()
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		var attempts []int
+		var result string
+		for event := range eventsChan {
+			switch event := event.(type) {
+			case dcd.StepStartEvent:
+				attempts = append(attempts, 1)
+			case dcd.StepRetryEvent:
+				attempts = append(attempts, event.Attempt)
+			case dcd.StepSuccessEvent, dcd.StepFailureEvent:
+				result = event.LogMessage()
+			}
+		}
+
+		// Then each attempt is an event, and the build records the retry
+		if result != tc.expectedResult {
+			t.Errorf("Expected %s to end with %q, got %q", tc.name, tc.expectedResult, result)
+		}
+		if !reflect.DeepEqual(attempts, tc.expectedAttempts) {
+			t.Errorf("Expected %s to make attempts %v, got %v", tc.name, tc.expectedAttempts, attempts)
+		}
+		state, err := backend.GetPipeline(context.Background(), "test-component", 1)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if !reflect.DeepEqual(state.RetriedSteps, tc.expectedRetried) {
+			t.Errorf("Expected %s to record retried steps %v, got %v", tc.name, tc.expectedRetried, state.RetriedSteps)
+		}
+	}
+}
+
+func TestPipelineSkipsStepsWhoseWhenIsFalse(t *testing.T) {
+	// Given
+	backend := &MockBackend{}
+	pipeline := dcd.NewPipeline()
+	pipeline.SetMetadata(&dcd.Metadata{
+		Component: "test-component",
+		GitSHA:    "test-git-sha",
+		Branch:    "main",
+	})
+	pipeline.SetParameters(map[string]string{"target": "staging"})
+	pipeline.SetDefinition(&dcd.PipelineDefinition{
+		Steps: []dcd.Step{
+			{Name: "Build", Script: "../../test/step-defs/success/run.sh", When: `branch == "main"`},
+			{Name: "Deploy", Script: "../../test/step-defs/success/run.sh", When: `params.target == "production"`},
+			{Name: "Notify", Script: "../../test/step-defs/success/run.sh", When: `skipped("Deploy")`},
+			{Name: "Rollback", Script: "../../test/step-defs/success/run.sh", Cleanup: true, When: `failed()`},
+		},
+	})
+	pipeline.SetBackend(backend)
+
+	// When
+	eventsChan, err := pipeline.Run()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	var messages []string
+	for event := range eventsChan {
+		if _, ok := event.(dcd.StepOutputEvent); !ok {
+			messages = append(messages, event.LogMessage())
+		}
+	}
+
+	// Then
+	expected := []string{
+		"Pipeline start",
+		"Step started: Build",
+		"Step succeeded: Build",
+		`Step skipped: Deploy, when: params.target == "production"`,
+		"Step started: Notify",
+		"Step succeeded: Notify",
+		"Step skipped: Rollback, when: failed()",
+		"Pipeline succeeded",
+	}
+	if !reflect.DeepEqual(messages, expected) {
+		t.Errorf("Expected events:\n%s\ngot:\n%s", strings.Join(expected, "\n"), strings.Join(messages, "\n"))
+	}
+	state, err := backend.GetPipeline(context.Background(), "test-component", 1)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if expected := []string{"Deploy", "Rollback"}; !reflect.DeepEqual(state.SkippedSteps, expected) {
+		t.Errorf("Expected the skipped steps %v to be recorded, got %v", expected, state.SkippedSteps)
+	}
+}
+
+// newGitRepo creates a clone of a new repo, with a commit on main pushed to
+// its origin, and changes to it for the rest of the test.
+func newGitRepo(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	origin := filepath.Join(dir, "widget.git")
+	repo := filepath.Join(dir, "widget")
+	git := func(dir string, args ...string) {
+		t.Helper()
+		cmd := exec.Command("git", append([]string{"-c", "user.name=Test", "-c", "user.email=test@example.com"}, args...)...)
+		cmd.Dir = dir
+		if output, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("git %s failed: %v\n%s", strings.Join(args, " "), err, output)
+		}
+	}
+	git(dir, "init", "--bare", "--initial-branch=main", origin)
+	git(dir, "clone", origin, repo)
+	if err := os.WriteFile(filepath.Join(repo, "README.md"), []byte("widget\n"), 0o644); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	git(repo, "checkout", "-B", "main")
+	git(repo, "add", ".")
+	git(repo, "commit", "-m", "Initial commit")
+	git(repo, "push", "-u", "origin", "main")
+
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if err := os.Chdir(repo); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	t.Cleanup(func() {
+		if err := os.Chdir(wd); err != nil {
+			t.Errorf("Could not change back to %s: %v", wd, err)
+		}
+	})
+	return repo
+}
+
+func TestPipelineRunsAgainWithDefaultFileBackend(t *testing.T) {
+	// Given
+	script, err := filepath.Abs("../../test/step-defs/success/run.sh")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	newGitRepo(t)
+	backend, err := dcd.NewBackend(context.Background(), &dcd.BackendConfig{Type: dcd.BackendTypeFile})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	for build := 1; build <= 2; build++ {
+		// When
+		pipeline := dcd.NewPipeline()
+		if err := pipeline.LoadMetadata(); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		pipeline.SetDefinition(&dcd.PipelineDefinition{
+			Steps: []dcd.Step{{Name: "Build", Script: script}},
+		})
+		pipeline.SetBackend(backend)
+		pipeline.SetOutbox((&dcd.OutboxConfig{}).NewOutbox())
+		eventsChan, err := pipeline.Run()
+		if err != nil {
+			t.Fatalf("Unexpected error running build %d: %v", build, err)
+		}
+		var last dcd.Event
+		for event := range eventsChan {
+			last = event
+		}
+
+		// Then the history is kept out of the working tree
+		if _, ok := last.(dcd.PipelineSuccessEvent); !ok {
+			t.Errorf("Expected build %d to succeed, got %s", build, last.LogMessage())
+		}
+	}
+}
@@ -0,0 +1,21 @@
+//go:build !unix
+
+package dcd
+
+import (
+	"os/exec"
+	"time"
+)
+
+// stopProcessGroup leaves cmd to be killed when its context is done. Processes
+// it started are not stopped on this platform, so its output is no longer
+// waited for after grace.
+func stopProcessGroup(cmd *exec.Cmd, grace time.Duration) func() {
+	cmd.WaitDelay = grace
+	return func() {}
+}
+
+// killProcessGroup kills a started cmd, but not processes it started.
+func killProcessGroup(cmd *exec.Cmd) {
+	_ = cmd.Process.Kill()
+}
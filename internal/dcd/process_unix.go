@@ -0,0 +1,52 @@
+//go:build unix
+
+package dcd
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// stopProcessGroup runs cmd in its own process group so that, when its
+// context is done, SIGTERM goes to the whole group, including processes the
+// script started, followed by SIGKILL if it has not exited after grace. Its
+// output is not waited for more than grace after it exits, since a process it
+// left running in the background may hold it open. The returned function must
+// be called once cmd has been waited for.
+func stopProcessGroup(cmd *exec.Cmd, grace time.Duration) func() {
+	var mu sync.Mutex
+	var kill *time.Timer
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.WaitDelay = grace
+	cmd.Cancel = func() error {
+		pgid := cmd.Process.Pid
+		mu.Lock()
+		kill = time.AfterFunc(grace, func() {
+			_ = syscall.Kill(-pgid, syscall.SIGKILL)
+		})
+		mu.Unlock()
+		if err := syscall.Kill(-pgid, syscall.SIGTERM); err != nil {
+			if errors.Is(err, syscall.ESRCH) {
+				return os.ErrProcessDone
+			}
+			return err
+		}
+		return nil
+	}
+	return func() {
+		mu.Lock()
+		defer mu.Unlock()
+		if kill != nil {
+			kill.Stop()
+		}
+	}
+}
+
+// killProcessGroup sends SIGKILL to the process group of a started cmd.
+func killProcessGroup(cmd *exec.Cmd) {
+	_ = syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+}
@@ -0,0 +1,120 @@
+package dcd
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// recorder records the events of a build in the backend as they happen,
+// keeping the PipelineState in step, and forwards them to the caller.
+// Writes happen in the background so that a slow backend does not slow the
+// steps, and the events channel is only closed once they are done.
+type recorder struct {
+	state  *PipelineState
+	events chan Event
+	writer *eventWriter
+	stop   chan struct{}
+	done   chan struct{}
+
+	mu sync.Mutex
+}
+
+// newRecorder starts recording a build, writing a heartbeat to the backend
+// every heartbeatInterval until it is closed. If the build could not be
+// started in the backend, offlineReason says why and it is recorded in the
+// outbox. Step output is archived if there is an archive.
+func newRecorder(ctx context.Context, backend Backend, outbox *Outbox, archive LogArchive, state *PipelineState, provisional bool, offlineReason error, heartbeatInterval time.Duration) *recorder {
+	r := &recorder{
+		state:  state,
+		events: make(chan Event, 32),
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	r.writer = newEventWriter(ctx, backend, outbox, archive, *state, provisional, offlineReason, func(event Event) {
+		r.events <- event
+	})
+	go r.heartbeat(heartbeatInterval)
+	return r
+}
+
+// heartbeat periodically records that the build is still running, so that
+// builds whose runner has gone away can be told apart from running ones.
+func (r *recorder) heartbeat(interval time.Duration) {
+	defer close(r.done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.stop:
+			return
+		case now := <-ticker.C:
+			r.mu.Lock()
+			if r.state.Status == StatusRunning {
+				r.state.Heartbeat = now
+				r.writer.writeState(*r.state)
+			}
+			r.mu.Unlock()
+		}
+	}
+}
+
+// emit queues an event and any resulting state transition to be persisted,
+// then passes the event on.
+func (r *recorder) emit(event Event) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.writer.writeEvent(event)
+
+	switch e := event.(type) {
+	case PipelineStartEvent:
+		r.updateStatus(StatusRunning, event.Timestamp())
+	case PipelineSuccessEvent:
+		r.updateStatus(StatusSucceeded, event.Timestamp())
+	case PipelineFailureEvent:
+		r.updateStatus(StatusFailed, event.Timestamp())
+	case PipelineCancelledEvent:
+		r.updateStatus(StatusCancelled, event.Timestamp())
+	case StepSkippedEvent:
+		r.state.SkippedSteps = append(r.state.SkippedSteps, e.StepName)
+		r.writer.writeState(*r.state)
+	}
+
+	r.events <- event
+}
+
+// stepSucceeded records what a step that succeeded changes about the build:
+// whether it has deployed the component, and which steps only succeeded when
+// they were retried.
+func (r *recorder) stepSucceeded(result stepResult) {
+	if !result.step.Deployment && result.attempts <= 1 {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if result.step.Deployment {
+		r.state.Deployed = true
+	}
+	if result.attempts > 1 {
+		r.state.RetriedSteps = append(r.state.RetriedSteps, result.step.Name)
+	}
+	r.writer.writeState(*r.state)
+}
+
+func (r *recorder) updateStatus(status string, eventTime time.Time) {
+	r.state.Status = status
+	r.state.Heartbeat = eventTime
+	if status != StatusRunning {
+		r.state.EndTime = eventTime
+	}
+	r.writer.writeState(*r.state)
+}
+
+// close flushes the history to the backend and then closes the events channel.
+func (r *recorder) close() {
+	close(r.stop)
+	<-r.done
+	r.writer.close()
+	close(r.events)
+}
@@ -0,0 +1,40 @@
+package dcd
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestRecorderWritesHeartbeats(t *testing.T) {
+	// Given
+	ctx := context.Background()
+	backend := NewMemoryBackend()
+	start := time.Now()
+	state := &PipelineState{BuildID: 1, Component: "test-component", Status: StatusPending, StartTime: start, Heartbeat: start}
+	if err := backend.StartPipeline(ctx, state); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	recorder := newRecorder(ctx, backend, nil, nil, state, false, nil, 10*time.Millisecond)
+	go func() {
+		for range recorder.events {
+		}
+	}()
+
+	// When
+	recorder.emit(PipelineStartEvent{BaseEvent: BaseEvent{EventTime: start}, BuildID: 1})
+	time.Sleep(eventBatchInterval + 100*time.Millisecond)
+	recorder.close()
+
+	// Then
+	stored, err := backend.GetPipeline(ctx, "test-component", 1)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if stored.Status != StatusRunning {
+		t.Errorf("Expected the build to be running, got %s", stored.Status)
+	}
+	if !stored.Heartbeat.After(start) {
+		t.Errorf("Expected a heartbeat after %v, got %v", start, stored.Heartbeat)
+	}
+}
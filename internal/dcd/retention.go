@@ -0,0 +1,34 @@
+package dcd
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// pruneOutput pages through the builds a backend's PruneOutput applies to,
+// deleting the output of each with deleteOutput.
+func pruneOutput(ctx context.Context, backend Backend, component string, before time.Time, keepDeployments bool, deleteOutput func(state *PipelineState) (int, error)) (int, error) {
+	query := &BuildQuery{Component: component, StartedBefore: before}
+	deleted := 0
+	for {
+		page, err := backend.ListBuilds(ctx, query)
+		if err != nil {
+			return deleted, err
+		}
+		for _, state := range page.Builds {
+			if state.Status == StatusPending || state.Status == StatusRunning || (keepDeployments && state.Deployed) {
+				continue
+			}
+			n, err := deleteOutput(&state)
+			deleted += n
+			if err != nil {
+				return deleted, fmt.Errorf("failed to prune the output of build %d of %s: %w", state.BuildID, state.Component, err)
+			}
+		}
+		if page.NextPageToken == "" {
+			return deleted, nil
+		}
+		query.PageToken = page.NextPageToken
+	}
+}
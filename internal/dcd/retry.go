@@ -0,0 +1,75 @@
+package dcd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"slices"
+	"time"
+)
+
+// RetryConfig controls how a step that fails is retried.
+type RetryConfig struct {
+	// MaxAttempts is how many times the step is run before it fails,
+	// including the first. Zero or one means it is not retried.
+	MaxAttempts int `yaml:"max-attempts"`
+	// Backoff is how long to wait before the second attempt, doubling before
+	// each attempt after that.
+	Backoff time.Duration `yaml:"backoff"`
+	// ExitCodes limits retries to attempts that exit with one of these codes,
+	// so that e.g. a failed network fetch is retried but a failed test is not.
+	// Attempts that time out are then not retried, as they have no exit code.
+	ExitCodes []int `yaml:"exit-codes"`
+}
+
+func (c *RetryConfig) validate(step string) error {
+	if c.MaxAttempts < 0 {
+		return fmt.Errorf("invalid retry for step %q: max-attempts must not be negative", step)
+	}
+	if c.Backoff < 0 {
+		return fmt.Errorf("invalid retry for step %q: backoff must not be negative", step)
+	}
+	return nil
+}
+
+// retries reports whether an attempt that failed with err is retried, if it
+// was not the last.
+func (c *RetryConfig) retries(err error) bool {
+	if len(c.ExitCodes) == 0 {
+		return true
+	}
+	var exitErr *exec.ExitError
+	return errors.As(err, &exitErr) && slices.Contains(c.ExitCodes, exitErr.ExitCode())
+}
+
+// runAttempts runs a step until it succeeds, or fails in a way its retry does
+// not allow for, waiting the backoff between attempts. Each attempt is stopped
+// if it runs for longer than the timeout of the step. It returns the result of
+// the last attempt.
+func (p *Pipeline) runAttempts(ctx context.Context, env []string, step Step, masker *secretMasker, recorder *recorder) stepResult {
+	backoff := step.Retry.Backoff
+	for attempt := 1; ; attempt++ {
+		attemptCtx, cancel := context.WithCancel(ctx)
+		if step.Timeout > 0 {
+			attemptCtx, cancel = context.WithTimeout(ctx, step.Timeout)
+		}
+		err := p.runStep(attemptCtx, env, step, masker, recorder.emit)
+		timedOut := err != nil && attemptCtx.Err() == context.DeadlineExceeded
+		cancel()
+		if err == nil || attempt >= step.Retry.MaxAttempts || ctx.Err() != nil || !step.Retry.retries(err) {
+			return stepResult{step, err, timedOut, attempt}
+		}
+		reason := err.Error()
+		if timedOut {
+			reason = fmt.Sprintf("timed out after %s", step.Timeout)
+		}
+		recorder.emit(StepRetryEvent{BaseEvent{EventTime: time.Now()}, step.Name, attempt + 1, step.Retry.MaxAttempts, reason, backoff})
+		select {
+		case <-ctx.Done():
+			return stepResult{step, err, timedOut, attempt}
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
@@ -0,0 +1,58 @@
+package dcd
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// S3Archive archives step output as objects in an S3 bucket, or in any
+// storage with an S3 compatible API such as MinIO.
+type S3Archive struct {
+	client *s3.Client
+	bucket string
+	prefix string
+}
+
+// NewS3Archive creates an archive storing logs in bucket, with keys starting
+// with prefix.
+func NewS3Archive(client *s3.Client, bucket, prefix string) *S3Archive {
+	return &S3Archive{client: client, bucket: bucket, prefix: prefix}
+}
+
+// PutLog uploads a log, returning its s3:// URL.
+func (a *S3Archive) PutLog(ctx context.Context, key string, data []byte) (string, error) {
+	key = a.prefix + key
+	_, err := a.client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:      aws.String(a.bucket),
+		Key:         aws.String(key),
+		Body:        bytes.NewReader(data),
+		ContentType: aws.String("application/gzip"),
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to upload %s to bucket %s: %w", key, a.bucket, err)
+	}
+	return fmt.Sprintf("s3://%s/%s", a.bucket, key), nil
+}
+
+// GetLog downloads the log at an s3:// URL.
+func (a *S3Archive) GetLog(ctx context.Context, location string) ([]byte, error) {
+	bucket, key, ok := strings.Cut(strings.TrimPrefix(location, "s3://"), "/")
+	if !ok || !strings.HasPrefix(location, "s3://") {
+		return nil, fmt.Errorf("invalid archive location %q", location)
+	}
+	output, err := a.client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer output.Body.Close()
+	return io.ReadAll(output.Body)
+}
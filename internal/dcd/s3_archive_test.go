@@ -0,0 +1,91 @@
+package dcd_test
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/testcontainers/testcontainers-go"
+	"github.com/testcontainers/testcontainers-go/wait"
+
+	"github.com/progsoftware/dcd/internal/dcd"
+)
+
+// startMinIO starts a MinIO container with an empty bucket, returning its endpoint.
+func startMinIO(t *testing.T, bucket string) string {
+	ctx := context.Background()
+	container, err := testcontainers.GenericContainer(ctx, testcontainers.GenericContainerRequest{
+		ContainerRequest: testcontainers.ContainerRequest{
+			Image:        "minio/minio:latest",
+			Cmd:          []string{"server", "/data"},
+			ExposedPorts: []string{"9000/tcp"},
+			Env: map[string]string{
+				"MINIO_ROOT_USER":     "minioadmin",
+				"MINIO_ROOT_PASSWORD": "minioadmin",
+			},
+			WaitingFor: wait.ForHTTP("/minio/health/live").WithPort("9000/tcp"),
+		},
+		Started: true,
+	})
+	if err != nil {
+		t.Fatalf("Failed to start the MinIO container: %v", err)
+	}
+	t.Cleanup(func() {
+		if err := container.Terminate(ctx); err != nil {
+			t.Errorf("Could not stop the MinIO container: %v", err)
+		}
+	})
+	endpoint, err := container.PortEndpoint(ctx, "9000/tcp", "http")
+	if err != nil {
+		t.Fatalf("Failed to get the MinIO endpoint: %v", err)
+	}
+	client := s3.New(s3.Options{
+		Region:       "us-east-1",
+		BaseEndpoint: aws.String(endpoint),
+		UsePathStyle: true,
+		Credentials:  credentials.NewStaticCredentialsProvider("minioadmin", "minioadmin", ""),
+	})
+	if _, err := client.CreateBucket(ctx, &s3.CreateBucketInput{Bucket: aws.String(bucket)}); err != nil {
+		t.Fatalf("Failed to create bucket: %v", err)
+	}
+	return endpoint
+}
+
+func TestS3Archive(t *testing.T) {
+	// Given
+	ctx := context.Background()
+	endpoint := startMinIO(t, "dcd-logs")
+	t.Setenv("AWS_ACCESS_KEY_ID", "minioadmin")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "minioadmin")
+	config := dcd.ArchiveConfig{Bucket: "dcd-logs", Prefix: "builds/", Endpoint: endpoint}
+	archive, err := config.NewArchive(ctx)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	data := []byte(strings.Repeat("compressed log", 1000))
+
+	// When
+	location, err := archive.PutLog(ctx, "test-component/1/build-1.log.gz", data)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	fetched, err := archive.GetLog(ctx, location)
+
+	// Then
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if expected := "s3://dcd-logs/builds/test-component/1/build-1.log.gz"; location != expected {
+		t.Errorf("Expected location %q, got %q", expected, location)
+	}
+	if !bytes.Equal(fetched, data) {
+		t.Errorf("Expected the log that was put, got %d bytes", len(fetched))
+	}
+	if _, err := archive.GetLog(ctx, "s3://dcd-logs/builds/missing.log.gz"); err == nil {
+		t.Errorf("Expected an error for a missing log")
+	}
+}
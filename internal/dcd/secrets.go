@@ -0,0 +1,204 @@
+package dcd
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"filippo.io/age"
+	"filippo.io/age/armor"
+	"gopkg.in/yaml.v2"
+)
+
+// SecretProvider resolves references to the secrets held in one kind of store.
+type SecretProvider interface {
+	// Resolve returns the value of the secret a reference refers to.
+	Resolve(ctx context.Context, ref string) (string, error)
+}
+
+// defaultSecretProviders returns the built in providers, by the name that
+// starts references to their secrets, e.g. "env:NPM_TOKEN".
+func defaultSecretProviders() map[string]SecretProvider {
+	return map[string]SecretProvider{
+		"env":                 envSecretProvider{},
+		"file":                fileSecretProvider{},
+		"age":                 &ageSecretProvider{},
+		"aws-secrets-manager": NewSecretsManagerProvider(nil),
+		"aws-ssm":             NewSSMProvider(nil),
+	}
+}
+
+// resolveSecrets resolves the secrets of the pipeline definition, returning
+// their values by environment variable name.
+func (p *Pipeline) resolveSecrets(ctx context.Context) (map[string]string, error) {
+	providers := defaultSecretProviders()
+	for name, provider := range p.secretProviders {
+		providers[name] = provider
+	}
+	names := make([]string, 0, len(p.definition.Secrets))
+	for name := range p.definition.Secrets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	secrets := map[string]string{}
+	for _, name := range names {
+		ref := p.definition.Secrets[name]
+		if _, ok := p.definition.GlobalEnv[name]; ok {
+			return nil, fmt.Errorf("invalid secret %s: it is also set in global-env", name)
+		}
+		providerName, reference, _ := strings.Cut(ref, ":")
+		provider, ok := providers[providerName]
+		if !ok {
+			return nil, fmt.Errorf("invalid secret %s: unknown provider %q in %q", name, providerName, ref)
+		}
+		value, err := provider.Resolve(ctx, reference)
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve secret %s from %s: %w", name, ref, err)
+		}
+		secrets[name] = value
+	}
+	return secrets, nil
+}
+
+// envSecretProvider resolves the name of a variable in the environment of
+// dcd, for secrets that are already set up on the machine running it.
+type envSecretProvider struct{}
+
+func (envSecretProvider) Resolve(ctx context.Context, ref string) (string, error) {
+	value, ok := os.LookupEnv(ref)
+	if !ok {
+		return "", fmt.Errorf("environment variable %s is not set", ref)
+	}
+	return value, nil
+}
+
+// fileSecretProvider resolves the path of a file holding a secret, without
+// its final newline. A path starting with ~/ is in the home directory.
+type fileSecretProvider struct{}
+
+func (fileSecretProvider) Resolve(ctx context.Context, ref string) (string, error) {
+	path, err := expandHome(ref)
+	if err != nil {
+		return "", err
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return trimNewline(string(data)), nil
+}
+
+// ageSecretProvider resolves "path#key" to the value of key in a YAML file
+// encrypted with age (https://age-encryption.org), which can be committed to
+// the repo, or "path" to the whole decrypted file. Files are decrypted with
+// the identities in DCD_AGE_KEY, or in the file named by DCD_AGE_KEY_FILE
+// (default ~/.config/dcd/age/keys.txt).
+type ageSecretProvider struct {
+	mu    sync.Mutex
+	files map[string]string
+}
+
+func (p *ageSecretProvider) Resolve(ctx context.Context, ref string) (string, error) {
+	path, key, hasKey := strings.Cut(ref, "#")
+	plaintext, err := p.decrypt(path)
+	if err != nil {
+		return "", err
+	}
+	if !hasKey {
+		return trimNewline(plaintext), nil
+	}
+	var values map[string]string
+	if err := yaml.Unmarshal([]byte(plaintext), &values); err != nil {
+		return "", fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+	value, ok := values[key]
+	if !ok {
+		return "", fmt.Errorf("%s has no key %q", path, key)
+	}
+	return value, nil
+}
+
+// decrypt decrypts a file, which can be ASCII armored, once per run.
+func (p *ageSecretProvider) decrypt(path string) (string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if plaintext, ok := p.files[path]; ok {
+		return plaintext, nil
+	}
+	identities, err := ageIdentities()
+	if err != nil {
+		return "", err
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	var reader io.Reader = bufio.NewReader(file)
+	if header, _ := reader.(*bufio.Reader).Peek(len(armor.Header)); string(header) == armor.Header {
+		reader = armor.NewReader(reader)
+	}
+	decrypted, err := age.Decrypt(reader, identities...)
+	if err != nil {
+		return "", fmt.Errorf("failed to decrypt %s: %w", path, err)
+	}
+	plaintext, err := io.ReadAll(decrypted)
+	if err != nil {
+		return "", fmt.Errorf("failed to decrypt %s: %w", path, err)
+	}
+	if p.files == nil {
+		p.files = map[string]string{}
+	}
+	p.files[path] = string(plaintext)
+	return string(plaintext), nil
+}
+
+func ageIdentities() ([]age.Identity, error) {
+	if key := os.Getenv("DCD_AGE_KEY"); key != "" {
+		identities, err := age.ParseIdentities(strings.NewReader(key))
+		if err != nil {
+			return nil, fmt.Errorf("invalid DCD_AGE_KEY: %w", err)
+		}
+		return identities, nil
+	}
+	path := os.Getenv("DCD_AGE_KEY_FILE")
+	if path == "" {
+		path = "~/.config/dcd/age/keys.txt"
+	}
+	path, err := expandHome(path)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("no age key to decrypt secrets with (DCD_AGE_KEY or DCD_AGE_KEY_FILE): %w", err)
+	}
+	defer file.Close()
+	identities, err := age.ParseIdentities(file)
+	if err != nil {
+		return nil, fmt.Errorf("invalid age key file %s: %w", path, err)
+	}
+	return identities, nil
+}
+
+func expandHome(path string) (string, error) {
+	if !strings.HasPrefix(path, "~/") {
+		return path, nil
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, path[2:]), nil
+}
+
+func trimNewline(value string) string {
+	value = strings.TrimSuffix(value, "\n")
+	return strings.TrimSuffix(value, "\r")
+}
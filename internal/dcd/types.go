@@ -1,26 +1,97 @@
 package dcd
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"net"
+	"os/exec"
 	"strings"
+	"sync"
 	"time"
 )
 
 type Metadata struct {
 	Component string
 	GitSHA    string
+	Branch    string
+	User      string
 }
 
 // Step represents a single step in the pipeline.
 type Step struct {
 	Name   string `yaml:"name"`
 	Script string `yaml:"script"`
+	// Deployment marks a step that deploys the component, so that builds in
+	// which it succeeds can be kept by the retention policy.
+	Deployment bool `yaml:"deployment"`
+	// DependsOn names the steps that must succeed before this one starts. If
+	// no step has it, each step depends on the one before.
+	DependsOn []string `yaml:"depends-on"`
+	// Timeout is how long the step may run before it is stopped and fails,
+	// e.g. 10m. Zero means no limit.
+	Timeout time.Duration `yaml:"timeout"`
+	// When is an expression deciding whether the step runs, e.g.
+	// branch == "main" && changed("web/**"). The step runs if it is empty.
+	When string `yaml:"when"`
+	// Retry controls how the step is retried if it fails.
+	Retry RetryConfig `yaml:"retry"`
+	// Cleanup marks a step that runs once the other steps have finished,
+	// whether they succeeded, failed or were cancelled.
+	Cleanup bool `yaml:"cleanup"`
 }
 
+// Statuses of a pipeline recorded in PipelineState.
+const (
+	StatusPending   = "pending"
+	StatusRunning   = "running"
+	StatusSucceeded = "succeeded"
+	StatusFailed    = "failed"
+	// StatusAbandoned is a build that stopped sending heartbeats before it
+	// finished, e.g. because the machine running it went to sleep.
+	StatusAbandoned = "abandoned"
+	// StatusCancelled is a build that was stopped while it ran, e.g. with
+	// Ctrl-C.
+	StatusCancelled = "cancelled"
+)
+
 // PipelineState represents the state of a pipeline at a point in time as serialised.
 type PipelineState struct {
-	BuildID int64
-	Status  string
+	BuildID   int64
+	Component string
+	GitSHA    string
+	User      string
+	Status    string
+	StartTime time.Time
+	EndTime   time.Time
+	// Heartbeat is when the runner last reported the build was still running.
+	Heartbeat time.Time
+	// Deployed is set once a deployment step of the build has succeeded.
+	Deployed bool
+	// EnvHash is a hash of the environment the steps run with, apart from the
+	// variables set by dcd, so that builds run in different environments can
+	// be told apart.
+	EnvHash string
+	// EnvNames are the names of the variables in that environment, if the
+	// pipeline records them.
+	EnvNames []string
+	// RetriedSteps names the steps that failed at first but succeeded when
+	// they were retried, so that flaky steps can be found.
+	RetriedSteps []string
+	// SkippedSteps names the steps that did not run because of their when
+	// expression.
+	SkippedSteps []string
+	// Version counts the writes of the state. Backends only accept a write
+	// made against the current version, and set Version to the new one.
+	Version int64
+}
+
+// LastSeen returns when the runner was last known to be running the build.
+func (s *PipelineState) LastSeen() time.Time {
+	if s.Heartbeat.After(s.StartTime) {
+		return s.Heartbeat
+	}
+	return s.StartTime
 }
 
 // Pipeline represents a pipeline that you run
@@ -28,12 +99,48 @@ type Pipeline struct {
 	definition *PipelineDefinition
 	metadata   *Metadata
 	backend    Backend
+	outbox     *Outbox
+	archive    LogArchive
+	// cancelled is done once the pipeline is cancelled, with the reason as
+	// its cause.
+	cancelled context.Context
+	cancel    context.CancelCauseFunc
+	// running are the processes of the steps that are running, for Kill.
+	runningMu sync.Mutex
+	running   map[*exec.Cmd]bool
+
+	params map[string]string
+
+	secretProviders map[string]SecretProvider
 }
 
 // PipelineDefinition represents the structure of the pipeline YAML.
 type PipelineDefinition struct {
 	GlobalEnv map[string]string `yaml:"global-env"`
 	Steps     []Step            `yaml:"steps"`
+	// SecretEnv names the environment variables holding secrets, whose
+	// values are masked in step output.
+	SecretEnv []string `yaml:"secret-env"`
+	// Env controls which variables of the environment of dcd steps get.
+	Env EnvConfig `yaml:"env"`
+	// Secrets are environment variables resolved from a secret provider when
+	// the pipeline runs, e.g. NPM_TOKEN: "env:NPM_TOKEN", and masked in step
+	// output.
+	Secrets map[string]string `yaml:"secrets"`
+	// MaxParallel is the most steps run at once, by default the number of CPUs.
+	MaxParallel int `yaml:"max-parallel"`
+	// OnFailure is what happens to running steps when a step fails:
+	// OnFailureWait (the default) or OnFailureCancel.
+	OnFailure string `yaml:"on-failure"`
+	// Timeout is how long the whole pipeline may run before its running steps
+	// are stopped and it fails. Zero means no limit.
+	Timeout time.Duration `yaml:"timeout"`
+	// GracePeriod is how long a step that is stopped has to exit after
+	// SIGTERM before it is sent SIGKILL, by default DefaultGracePeriod.
+	GracePeriod time.Duration `yaml:"grace-period"`
+	// BuildIDFormat is the format of the BUILD_ID passed to steps, where
+	// {component} and {id} are replaced by the component and build number.
+	BuildIDFormat string `yaml:"build-id-format"`
 }
 
 type Event interface {
@@ -42,7 +149,7 @@ type Event interface {
 }
 
 type BaseEvent struct {
-	EventTime time.Time
+	EventTime time.Time `json:"time"`
 }
 
 func (be BaseEvent) Timestamp() time.Time {
@@ -52,7 +159,7 @@ func (be BaseEvent) Timestamp() time.Time {
 // PipelineStartEvent signifies the start of the pipeline execution.
 type PipelineStartEvent struct {
 	BaseEvent
-	BuildID int64
+	BuildID int64 `json:"buildId"`
 }
 
 func (p PipelineStartEvent) LogMessage() string {
@@ -71,17 +178,38 @@ func (p PipelineSuccessEvent) LogMessage() string {
 // PipelineFailureEvent signifies a failure in pipeline execution.
 type PipelineFailureEvent struct {
 	BaseEvent
-	Reason string
+	Reason string `json:"reason"`
 }
 
 func (p PipelineFailureEvent) LogMessage() string {
 	return fmt.Sprintf("Pipeline failed: %s", p.Reason)
 }
 
+// PipelineCancelledEvent signifies that a pipeline was cancelled while it ran.
+type PipelineCancelledEvent struct {
+	BaseEvent
+	Reason string `json:"reason"`
+}
+
+func (p PipelineCancelledEvent) LogMessage() string {
+	return fmt.Sprintf("Pipeline cancelled: %s", p.Reason)
+}
+
+// PipelineAbandonedEvent signifies that a build was marked abandoned after
+// its heartbeats stopped.
+type PipelineAbandonedEvent struct {
+	BaseEvent
+	Reason string `json:"reason"`
+}
+
+func (p PipelineAbandonedEvent) LogMessage() string {
+	return fmt.Sprintf("Pipeline abandoned: %s", p.Reason)
+}
+
 // StepStartEvent signifies the start of a pipeline step.
 type StepStartEvent struct {
 	BaseEvent
-	StepName string
+	StepName string `json:"stepName"`
 }
 
 func (s StepStartEvent) LogMessage() string {
@@ -91,18 +219,34 @@ func (s StepStartEvent) LogMessage() string {
 // StepOutputEvent is used to log output from a pipeline step.
 type StepOutputEvent struct {
 	BaseEvent
-	StepName string
-	Output   string
+	StepName string `json:"stepName"`
+	Output   string `json:"output"`
 }
 
 func (s StepOutputEvent) LogMessage() string {
 	return fmt.Sprintf("Output from %s: %s", s.StepName, s.Output)
 }
 
+// StepOutputArchivedEvent records that the output of a step was archived,
+// keeping the end of it as the tail. It is written when the step finishes,
+// with OutputStart the time of the first of the output.
+type StepOutputArchivedEvent struct {
+	BaseEvent
+	StepName    string    `json:"stepName"`
+	Location    string    `json:"location"`
+	Size        int       `json:"size"` // bytes of output, before compression
+	Tail        string    `json:"tail"`
+	OutputStart time.Time `json:"outputStart"`
+}
+
+func (s StepOutputArchivedEvent) LogMessage() string {
+	return fmt.Sprintf("Output from %s archived to %s (%d bytes), ending: %s", s.StepName, s.Location, s.Size, s.Tail)
+}
+
 // StepSuccessEvent signifies the successful completion of a pipeline step.
 type StepSuccessEvent struct {
 	BaseEvent
-	StepName string
+	StepName string `json:"stepName"`
 }
 
 func (s StepSuccessEvent) LogMessage() string {
@@ -112,14 +256,121 @@ func (s StepSuccessEvent) LogMessage() string {
 // StepFailureEvent signifies a failure in a pipeline step.
 type StepFailureEvent struct {
 	BaseEvent
-	StepName string
-	Reason   string
+	StepName string `json:"stepName"`
+	Reason   string `json:"reason"`
 }
 
 func (s StepFailureEvent) LogMessage() string {
 	return fmt.Sprintf("Step failed: %s, Reason: %s", s.StepName, s.Reason)
 }
 
+// StepSkippedEvent signifies that a pipeline step did not run because its when
+// expression was false.
+type StepSkippedEvent struct {
+	BaseEvent
+	StepName string `json:"stepName"`
+	When     string `json:"when"`
+}
+
+func (s StepSkippedEvent) LogMessage() string {
+	return fmt.Sprintf("Step skipped: %s, when: %s", s.StepName, s.When)
+}
+
+// StepRetryEvent signifies that an attempt at a pipeline step failed, and that
+// the step is run again after a delay.
+type StepRetryEvent struct {
+	BaseEvent
+	StepName    string        `json:"stepName"`
+	Attempt     int           `json:"attempt"` // the attempt about to be made, from 2
+	MaxAttempts int           `json:"maxAttempts"`
+	Reason      string        `json:"reason"` // why the previous attempt failed
+	Delay       time.Duration `json:"delay"`
+}
+
+func (s StepRetryEvent) LogMessage() string {
+	return fmt.Sprintf("Step retrying: %s, attempt %d of %d in %s, Reason: %s", s.StepName, s.Attempt, s.MaxAttempts, s.Delay, s.Reason)
+}
+
+// StepTimeoutEvent signifies that a pipeline step failed because it ran for
+// longer than its timeout, or than the timeout of the pipeline.
+type StepTimeoutEvent struct {
+	BaseEvent
+	StepName string        `json:"stepName"`
+	Timeout  time.Duration `json:"timeout"`
+	// Pipeline is set when the timeout was that of the pipeline.
+	Pipeline bool `json:"pipeline,omitempty"`
+}
+
+func (s StepTimeoutEvent) LogMessage() string {
+	if s.Pipeline {
+		return fmt.Sprintf("Step timed out: %s, the pipeline timed out after %s", s.StepName, s.Timeout)
+	}
+	return fmt.Sprintf("Step timed out: %s after %s", s.StepName, s.Timeout)
+}
+
+// BackendErrorEvent signifies that part of the build history could not be written to the backend.
+type BackendErrorEvent struct {
+	BaseEvent
+	Operation string `json:"operation"`
+	Reason    string `json:"reason"`
+}
+
+func (b BackendErrorEvent) LogMessage() string {
+	return fmt.Sprintf("Build history error: failed to %s: %s", b.Operation, b.Reason)
+}
+
+// BackendOfflineEvent signifies that the backend could not be written to, so
+// the rest of the build is recorded in the outbox until it is synced.
+type BackendOfflineEvent struct {
+	BaseEvent
+	Directory string `json:"directory"`
+	Reason    string `json:"reason"`
+}
+
+func (b BackendOfflineEvent) LogMessage() string {
+	return fmt.Sprintf("Build history backend unavailable, recording the build in %s until dcd sync is run: %s", b.Directory, b.Reason)
+}
+
+type UnknownEventTypeError struct {
+	Type string
+}
+
+func (e UnknownEventTypeError) Error() string {
+	return fmt.Sprintf("unknown event type %q", e.Type)
+}
+
+type UnsupportedEventVersionError struct {
+	Type    string
+	Version int
+}
+
+func (e UnsupportedEventVersionError) Error() string {
+	return fmt.Sprintf("unsupported schema version %d for event type %q (supported up to %d)", e.Version, e.Type, EventSchemaVersion)
+}
+
+// BackendUnreachableError is returned by NewBackend, along with the backend,
+// when the backend is configured correctly but cannot be reached.
+type BackendUnreachableError struct {
+	Type string
+	Err  error
+}
+
+func (e BackendUnreachableError) Error() string {
+	return fmt.Sprintf("%s backend is not reachable: %v", e.Type, e.Err)
+}
+
+func (e BackendUnreachableError) Unwrap() error {
+	return e.Err
+}
+
+// isUnreachable tells whether err is from a backend that could not be reached
+// or did not answer in time, rather than one that refused a request.
+func isUnreachable(err error) bool {
+	var unreachable *BackendUnreachableError
+	var netErr net.Error
+	return errors.As(err, &unreachable) || errors.As(err, &netErr) || errors.Is(err, context.DeadlineExceeded)
+}
+
 type UncommittedChangesError struct{}
 
 func (e UncommittedChangesError) Error() string {
@@ -154,6 +405,54 @@ func (e NotOnMainBranchError) Error() string {
 	return fmt.Sprintf("the current branch is %q, not main", e.Branch)
 }
 
+type BuildExistsError struct {
+	Component string
+	BuildID   int64
+}
+
+func (e BuildExistsError) Error() string {
+	return fmt.Sprintf("build %d of %s already exists", e.BuildID, e.Component)
+}
+
+type BuildNotFoundError struct {
+	Component string
+	BuildID   int64
+}
+
+func (e BuildNotFoundError) Error() string {
+	return fmt.Sprintf("build %d of %s not found", e.BuildID, e.Component)
+}
+
+// StateConflictError is returned by PutPipeline when the build has been
+// changed since the state being written was read, or the status change is
+// not a valid transition (e.g. from succeeded back to running).
+type StateConflictError struct {
+	Component      string
+	BuildID        int64
+	Status         string // the status being written
+	Version        int64  // the version it was written against
+	CurrentStatus  string
+	CurrentVersion int64
+}
+
+func (e StateConflictError) Error() string {
+	if e.Version != e.CurrentVersion {
+		return fmt.Sprintf("build %d of %s was changed by another process (version %d, expected %d)", e.BuildID, e.Component, e.CurrentVersion, e.Version)
+	}
+	return fmt.Sprintf("build %d of %s cannot change from %s to %s", e.BuildID, e.Component, e.CurrentStatus, e.Status)
+}
+
+// TableSchemaError is returned when a DynamoDB table cannot be used or
+// upgraded by this version of dcd.
+type TableSchemaError struct {
+	Table   string
+	Problem string
+}
+
+func (e TableSchemaError) Error() string {
+	return fmt.Sprintf("table %s cannot be used: %s", e.Table, e.Problem)
+}
+
 type NotTrackingOriginMainError struct {
 	Output string
 }
@@ -0,0 +1,435 @@
+package dcd
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// A when expression decides whether a step runs. It is made of:
+//
+//   - strings, e.g. "main"
+//   - the metadata of the build: component, git_sha and branch
+//   - env.NAME, a variable of the environment of the steps
+//   - params.NAME, a parameter of the pipeline
+//   - changed("pattern", ...), whether files matching any of the patterns
+//     changed since the last successful build
+//   - succeeded("step"), failed("step") and skipped("step"), the result of a
+//     step that has finished, and failed(), whether any step failed
+//   - matches(value, "pattern"), whether a value matches a path.Match pattern
+//   - == and !=, which compare strings, and !, && and ||, with parentheses
+//
+// Every value is a string, which is true if it is not empty, so env.DEPLOY is
+// true if DEPLOY is set. Functions and operators give "true" or "".
+
+// statusSkipped is the result of a step that did not run because of its when
+// expression.
+const statusSkipped = "skipped"
+
+// whenExpr is a parsed when expression.
+type whenExpr func(c *conditions) string
+
+func whenBool(b bool) string {
+	if b {
+		return "true"
+	}
+	return ""
+}
+
+// conditions is what when expressions are evaluated against.
+type conditions struct {
+	metadata *Metadata
+	params   map[string]string
+	env      []string
+	backend  Backend
+	// results are the results of the steps that have finished, by name:
+	// StatusSucceeded, StatusFailed or statusSkipped.
+	results map[string]string
+
+	changedOnce  sync.Once
+	changedFiles []string
+	changedKnown bool
+}
+
+func (p *Pipeline) newConditions(env []string) *conditions {
+	return &conditions{
+		metadata: p.metadata,
+		params:   p.params,
+		env:      env,
+		backend:  p.backend,
+		results:  map[string]string{},
+	}
+}
+
+// runs reports whether a step runs, which it does unless its when expression,
+// which validateSteps has checked, is false.
+func (c *conditions) runs(step Step) bool {
+	if step.When == "" {
+		return true
+	}
+	expr, _, err := parseWhen(step.When)
+	return err == nil && expr(c) != ""
+}
+
+// changed reports whether any file matching the patterns changed since the
+// commit of the last successful build. Without one, or if that commit is not
+// in the local repository, every file counts as changed.
+func (c *conditions) changed(patterns []string) bool {
+	c.changedOnce.Do(func() {
+		c.changedFiles, c.changedKnown = c.findChangedFiles()
+	})
+	if !c.changedKnown {
+		return true
+	}
+	for _, file := range c.changedFiles {
+		for _, pattern := range patterns {
+			if matchChangedPath(pattern, file) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (c *conditions) findChangedFiles() ([]string, bool) {
+	page, err := c.backend.ListBuilds(context.Background(), &BuildQuery{
+		Component: c.metadata.Component,
+		Status:    StatusSucceeded,
+		Limit:     1,
+	})
+	if err != nil || len(page.Builds) == 0 {
+		return nil, false
+	}
+	output, err := exec.Command("git", "diff", "-z", "--name-only", page.Builds[0].GitSHA, "HEAD").Output()
+	if err != nil {
+		return nil, false
+	}
+	var files []string
+	for _, file := range strings.Split(string(output), "\x00") {
+		if file != "" {
+			files = append(files, file)
+		}
+	}
+	return files, true
+}
+
+// matchChangedPath matches a path against a path.Match pattern, or against
+// "dir/**" for anything under dir.
+func matchChangedPath(pattern, file string) bool {
+	if dir, ok := strings.CutSuffix(pattern, "/**"); ok {
+		return strings.HasPrefix(file, dir+"/")
+	}
+	matched, _ := path.Match(pattern, file)
+	return matched
+}
+
+// whenRefs is what a when expression refers to, beyond the build itself.
+type whenRefs struct {
+	// steps are the names of the steps whose results it refers to.
+	steps []string
+	// failures is whether it refers to failures, with failed() or
+	// failed("step").
+	failures bool
+}
+
+// parseWhen parses a when expression, returning it and what it refers to.
+func parseWhen(input string) (whenExpr, whenRefs, error) {
+	tokens, err := tokenizeWhen(input)
+	if err != nil {
+		return nil, whenRefs{}, err
+	}
+	p := &whenParser{tokens: tokens}
+	expr, err := p.parseOr()
+	if err != nil {
+		return nil, whenRefs{}, err
+	}
+	if token := p.peek(); token != "" {
+		return nil, whenRefs{}, fmt.Errorf("unexpected %s", token)
+	}
+	return expr, p.refs, nil
+}
+
+func tokenizeWhen(input string) ([]string, error) {
+	var tokens []string
+	for i := 0; i < len(input); {
+		c := input[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '"':
+			j := i + 1
+			for j < len(input) && input[j] != '"' {
+				if input[j] == '\\' {
+					j++
+				}
+				j++
+			}
+			if j >= len(input) {
+				return nil, fmt.Errorf("unterminated string %s", input[i:])
+			}
+			tokens = append(tokens, input[i:j+1])
+			i = j + 1
+		case strings.HasPrefix(input[i:], "==") || strings.HasPrefix(input[i:], "!=") ||
+			strings.HasPrefix(input[i:], "&&") || strings.HasPrefix(input[i:], "||"):
+			tokens = append(tokens, input[i:i+2])
+			i += 2
+		case strings.IndexByte("!(),", c) >= 0:
+			tokens = append(tokens, input[i:i+1])
+			i++
+		case isWhenNameChar(c):
+			j := i
+			for j < len(input) && isWhenNameChar(input[j]) {
+				j++
+			}
+			tokens = append(tokens, input[i:j])
+			i = j
+		default:
+			return nil, fmt.Errorf("unexpected %q", c)
+		}
+	}
+	return tokens, nil
+}
+
+func isWhenNameChar(c byte) bool {
+	return c == '_' || c == '.' || ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z') || ('0' <= c && c <= '9')
+}
+
+// whenParser is a recursive descent parser, from the operator that binds
+// least tightly, ||, to the values they apply to.
+type whenParser struct {
+	tokens []string
+	pos    int
+	refs   whenRefs
+}
+
+func (p *whenParser) peek() string {
+	if p.pos == len(p.tokens) {
+		return ""
+	}
+	return p.tokens[p.pos]
+}
+
+func (p *whenParser) next() string {
+	token := p.peek()
+	if token != "" {
+		p.pos++
+	}
+	return token
+}
+
+func (p *whenParser) expect(token string) error {
+	switch next := p.next(); next {
+	case token:
+		return nil
+	case "":
+		return fmt.Errorf("expected %s at the end", token)
+	default:
+		return fmt.Errorf("expected %s, got %s", token, next)
+	}
+}
+
+func (p *whenParser) parseOr() (whenExpr, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek() == "||" {
+		p.next()
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		left = func(c *conditions) string { return whenBool(l(c) != "" || right(c) != "") }
+	}
+	return left, nil
+}
+
+func (p *whenParser) parseAnd() (whenExpr, error) {
+	left, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek() == "&&" {
+		p.next()
+		right, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		left = func(c *conditions) string { return whenBool(l(c) != "" && right(c) != "") }
+	}
+	return left, nil
+}
+
+func (p *whenParser) parseNot() (whenExpr, error) {
+	if p.peek() != "!" {
+		return p.parseComparison()
+	}
+	p.next()
+	operand, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	return func(c *conditions) string { return whenBool(operand(c) == "") }, nil
+}
+
+func (p *whenParser) parseComparison() (whenExpr, error) {
+	left, err := p.parseValue()
+	if err != nil {
+		return nil, err
+	}
+	operator := p.peek()
+	if operator != "==" && operator != "!=" {
+		return left, nil
+	}
+	p.next()
+	right, err := p.parseValue()
+	if err != nil {
+		return nil, err
+	}
+	equal := operator == "=="
+	return func(c *conditions) string { return whenBool((left(c) == right(c)) == equal) }, nil
+}
+
+func (p *whenParser) parseValue() (whenExpr, error) {
+	token := p.next()
+	switch {
+	case token == "":
+		return nil, fmt.Errorf("unexpected end")
+	case token == "(":
+		expr, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		return expr, p.expect(")")
+	case token[0] == '"':
+		value, err := strconv.Unquote(token)
+		if err != nil {
+			return nil, fmt.Errorf("invalid string %s", token)
+		}
+		return func(*conditions) string { return value }, nil
+	case !isWhenNameChar(token[0]):
+		return nil, fmt.Errorf("unexpected %s", token)
+	case p.peek() == "(":
+		p.next()
+		return p.parseCall(token)
+	}
+	if name, ok := strings.CutPrefix(token, "env."); ok && name != "" {
+		return func(c *conditions) string { return envValue(c.env, name) }, nil
+	}
+	if name, ok := strings.CutPrefix(token, "params."); ok && name != "" {
+		return func(c *conditions) string { return c.params[name] }, nil
+	}
+	switch token {
+	case "component":
+		return func(c *conditions) string { return c.metadata.Component }, nil
+	case "git_sha":
+		return func(c *conditions) string { return c.metadata.GitSHA }, nil
+	case "branch":
+		return func(c *conditions) string { return c.metadata.Branch }, nil
+	}
+	return nil, fmt.Errorf("unknown name %s", token)
+}
+
+// parseCall parses the arguments of a function, after the opening
+// parenthesis.
+func (p *whenParser) parseCall(name string) (whenExpr, error) {
+	if name == "matches" {
+		value, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect(","); err != nil {
+			return nil, err
+		}
+		patterns, err := p.parseStringArgs()
+		if err != nil {
+			return nil, err
+		}
+		if len(patterns) != 1 {
+			return nil, fmt.Errorf("matches takes a value and a pattern")
+		}
+		pattern := patterns[0]
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid pattern %q", pattern)
+		}
+		return func(c *conditions) string {
+			matched, _ := path.Match(pattern, value(c))
+			return whenBool(matched)
+		}, nil
+	}
+
+	args, err := p.parseStringArgs()
+	if err != nil {
+		return nil, err
+	}
+	switch name {
+	case "changed":
+		if len(args) == 0 {
+			return nil, fmt.Errorf("changed takes at least one pattern")
+		}
+		for _, pattern := range args {
+			if _, err := path.Match(strings.TrimSuffix(pattern, "/**"), ""); err != nil {
+				return nil, fmt.Errorf("invalid pattern %q", pattern)
+			}
+		}
+		return func(c *conditions) string { return whenBool(c.changed(args)) }, nil
+	case "failed":
+		p.refs.failures = true
+		if len(args) == 0 {
+			return func(c *conditions) string {
+				for _, result := range c.results {
+					if result == StatusFailed {
+						return "true"
+					}
+				}
+				return ""
+			}, nil
+		}
+		return p.stepResult(name, args, StatusFailed)
+	case "succeeded":
+		return p.stepResult(name, args, StatusSucceeded)
+	case "skipped":
+		return p.stepResult(name, args, statusSkipped)
+	}
+	return nil, fmt.Errorf("unknown function %s", name)
+}
+
+func (p *whenParser) stepResult(name string, args []string, result string) (whenExpr, error) {
+	if len(args) != 1 {
+		return nil, fmt.Errorf("%s takes the name of a step", name)
+	}
+	step := args[0]
+	p.refs.steps = append(p.refs.steps, step)
+	return func(c *conditions) string { return whenBool(c.results[step] == result) }, nil
+}
+
+// parseStringArgs parses arguments that must be strings, up to and including
+// the closing parenthesis.
+func (p *whenParser) parseStringArgs() ([]string, error) {
+	var args []string
+	if p.peek() == ")" {
+		p.next()
+		return args, nil
+	}
+	for {
+		token := p.next()
+		if token == "" || token[0] != '"' {
+			return nil, fmt.Errorf("expected a string argument, got %q", token)
+		}
+		arg, err := strconv.Unquote(token)
+		if err != nil {
+			return nil, fmt.Errorf("invalid string %s", token)
+		}
+		args = append(args, arg)
+		if p.peek() != "," {
+			return args, p.expect(")")
+		}
+		p.next()
+	}
+}
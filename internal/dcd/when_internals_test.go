@@ -0,0 +1,119 @@
+package dcd
+
+import (
+	"context"
+	"os/exec"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestWhenExpressions(t *testing.T) {
+	c := &conditions{
+		metadata: &Metadata{Component: "web", GitSHA: "abc123", Branch: "release/1.2"},
+		params:   map[string]string{"target": "staging"},
+		env:      []string{"DEPLOY=1", "EMPTY="},
+		results:  map[string]string{"build": StatusSucceeded, "lint": StatusFailed, "docs": statusSkipped},
+	}
+	c.changedOnce.Do(func() {
+		c.changedFiles = []string{"web/index.html", "README.md"}
+		c.changedKnown = true
+	})
+
+	testCases := []struct {
+		when     string
+		expected bool
+	}{
+		{`component == "web"`, true},
+		{`git_sha != "abc123"`, false},
+		{`matches(branch, "release/*")`, true},
+		{`branch == "main"`, false},
+		{`env.DEPLOY`, true},
+		{`env.EMPTY || env.MISSING`, false},
+		{`params.target == "staging" && !params.force`, true},
+		{`succeeded("build")`, true},
+		{`failed("build")`, false},
+		{`failed()`, true},
+		{`skipped("docs")`, true},
+		{`changed("web/**")`, true},
+		{`changed("api/**", "*.go")`, false},
+		{`changed("*.md")`, true},
+		{`(branch == "main" || params.target == "staging") && succeeded("build")`, true},
+		{`!(failed("lint") || env.DEPLOY)`, false},
+	}
+
+	for _, tc := range testCases {
+		expr, _, err := parseWhen(tc.when)
+		if err != nil {
+			t.Errorf("Unexpected error parsing %s: %v", tc.when, err)
+			continue
+		}
+		if got := expr(c) != ""; got != tc.expected {
+			t.Errorf("Expected %s to be %v, got %v", tc.when, tc.expected, got)
+		}
+	}
+}
+
+func TestParseWhen(t *testing.T) {
+	testCases := []struct {
+		when          string
+		expectedSteps []string
+		expectedError string
+	}{
+		{`succeeded("build") && !failed("test") || skipped("docs")`, []string{"build", "test", "docs"}, ""},
+		{`branch ==`, nil, "unexpected end"},
+		{`branch = "main"`, nil, `unexpected '='`},
+		{`(branch == "main"`, nil, "expected ) at the end"},
+		{`branch == "main" env.X`, nil, "unexpected env.X"},
+		{`tag == "v1"`, nil, "unknown name tag"},
+		{`deployed("prod")`, nil, "unknown function deployed"},
+		{`changed()`, nil, "changed takes at least one pattern"},
+		{`succeeded(build)`, nil, `expected a string argument, got "build"`},
+		{`matches(branch, "[")`, nil, `invalid pattern "["`},
+		{`branch == "main`, nil, `unterminated string "main`},
+	}
+
+	for _, tc := range testCases {
+		_, refs, err := parseWhen(tc.when)
+		got := ""
+		if err != nil {
+			got = err.Error()
+		}
+		if got != tc.expectedError {
+			t.Errorf("Expected parsing %s to give error %q, got %q", tc.when, tc.expectedError, got)
+		}
+		if !reflect.DeepEqual(refs.steps, tc.expectedSteps) {
+			t.Errorf("Expected %s to refer to steps %v, got %v", tc.when, tc.expectedSteps, refs.steps)
+		}
+	}
+}
+
+func TestWhenChangedSinceLastSuccessfulBuild(t *testing.T) {
+	// Given a successful build of the current commit
+	ctx := context.Background()
+	output, err := exec.Command("git", "rev-parse", "HEAD").Output()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	backend := &MemoryBackend{}
+	state := &PipelineState{BuildID: 1, Component: "web", GitSHA: strings.TrimSpace(string(output)), Status: StatusPending}
+	if err := backend.StartPipeline(ctx, state); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	state.Status = StatusSucceeded
+	if err := backend.PutPipeline(ctx, state); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	// When
+	unchanged := (&conditions{metadata: &Metadata{Component: "web"}, backend: backend}).changed([]string{"*"})
+	firstBuild := (&conditions{metadata: &Metadata{Component: "api"}, backend: backend}).changed([]string{"api/**"})
+
+	// Then
+	if unchanged {
+		t.Errorf("Expected nothing to have changed since a build of the same commit")
+	}
+	if !firstBuild {
+		t.Errorf("Expected everything to count as changed without a successful build")
+	}
+}
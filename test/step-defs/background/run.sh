@@ -0,0 +1,5 @@
+#!/bin/sh
+
+# The child keeps the output open after the step has finished.
+sleep 10 &
+echo "done"
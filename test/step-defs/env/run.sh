@@ -0,0 +1,6 @@
+#!/bin/sh
+
+echo "allowed: ${DCD_TEST_ALLOWED-unset}"
+echo "hidden: ${DCD_TEST_HIDDEN-unset}"
+echo "global env var: ${GLOBAL_ENV_VAR-unset}"
+echo "component: ${COMPONENT-unset}"
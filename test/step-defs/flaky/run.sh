@@ -0,0 +1,11 @@
+#!/bin/sh
+
+# Fails with exit code $FLAKY_EXIT_CODE the first $FLAKY_FAILURES times it
+# runs, counting runs in $FLAKY_COUNT_FILE.
+count=$(cat "$FLAKY_COUNT_FILE" 2>/dev/null || echo 0)
+count=$((count + 1))
+echo "$count" > "$FLAKY_COUNT_FILE"
+echo "attempt $count"
+if [ "$count" -le "$FLAKY_FAILURES" ]; then
+    exit "$FLAKY_EXIT_CODE"
+fi
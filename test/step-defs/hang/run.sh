@@ -0,0 +1,9 @@
+#!/bin/sh
+
+echo "hanging"
+if [ -n "$IGNORE_SIGTERM" ]; then
+    trap '' TERM
+fi
+# The child keeps the output open, so the step only ends once it is stopped too.
+sleep 30 &
+wait
@@ -0,0 +1,6 @@
+#!/bin/sh
+
+for name in ENV_SECRET FILE_SECRET AGE_SECRET CUSTOM_SECRET; do
+	eval "value=\$$name"
+	echo "$name: $value (${#value} characters)"
+done
@@ -0,0 +1,12 @@
+#!/bin/sh
+
+echo "token: $SECRET_TOKEN"
+# Write a secret in two parts, so that it is read in separate chunks.
+printf 'split: %s' "$(echo "$SECRET_TOKEN" | cut -c1-6)"
+sleep 0.2
+printf '%s end\n' "$(echo "$SECRET_TOKEN" | cut -c7-)"
+echo "$PRIVATE_KEY" | head -n 1
+sleep 0.2
+echo "$PRIVATE_KEY" | tail -n +2
+echo "github token: ghp_$(printf '%036d' 0)"
+echo "short: $SHORT_SECRET"
@@ -0,0 +1,4 @@
+#!/bin/sh
+
+echo "sleeping"
+exec sleep 1